@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name        string
+	Methods     []string
+	Expires     *time.Time
+	ReceiveOnly bool
+	limiter     *rateLimiter
+	spending    *SpendingLimits
+	// Name of the token that created this identity, whose spending limits
+	// and budget also apply
+	owner string
+}
+
+// APIToken is an entry of the token table loaded from LNCD_TOKENS_PATH.
+type APIToken struct {
+	Name string
+	// The bearer token
+	Token string
+	// Hex encoded SHA-256 of the bearer token, can be used instead of Token
+	// to avoid storing the plaintext
+	TokenHash string
+	// Glob patterns of the methods this token can call, eg. "lnrpc.Lightning.*".
+	// Empty means every method.
+	Methods []string
+	// Optional expiration date (RFC3339)
+	Expires *time.Time
+	// Optional rate limit in the form "requests/interval", eg. "60/1m"
+	RateLimit string
+	// Optional subject of a client certificate mapped to this entry, matched
+	// against the full distinguished name or the common name.
+	ClientSubject string
+	// Restricts the token to read and receive methods
+	ReceiveOnly bool
+	// Optional spending limits, applied on top of the daemon ones
+	SpendingLimits
+}
+
+type identityContextKey struct{}
+
+var (
+	// Identity used when authentication is disabled
+	anonymousIdentity = &Identity{Name: "anonymous"}
+
+	tokensMutex sync.RWMutex
+	// Identities by the SHA-256 of their token
+	tokenTable    = map[[sha256.Size]byte]*Identity{}
+	subjectsTable = map[string]*Identity{}
+
+	authFailuresMutex sync.Mutex
+	authFailures      = map[string]*authFailure{}
+)
+
+type authFailure struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// parseTokenHash decodes a hex encoded SHA-256 hash, optionally prefixed by
+// "sha256:".
+func parseTokenHash(value string) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	decoded, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(value), "sha256:"))
+	if err != nil {
+		return hash, err
+	}
+	if len(decoded) != sha256.Size {
+		return hash, fmt.Errorf("invalid hash length %d", len(decoded))
+	}
+	copy(hash[:], decoded)
+	return hash, nil
+}
+
+// loadTokens reads the token table from tokensPath.
+// Rate limiters of unchanged tokens are preserved across reloads.
+func loadTokens(tokensPath string) error {
+	tokens := map[[sha256.Size]byte]*Identity{}
+	subjects := map[string]*Identity{}
+	if tokensPath != "" {
+		data, err := os.ReadFile(tokensPath)
+		if err != nil {
+			return err
+		}
+
+		var entries []APIToken
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("invalid token table: %v", err)
+		}
+
+		tokensMutex.RLock()
+		previous := map[string]*Identity{}
+		for _, identity := range tokenTable {
+			previous[identity.Name] = identity
+		}
+		for _, identity := range subjectsTable {
+			previous[identity.Name] = identity
+		}
+		tokensMutex.RUnlock()
+
+		for _, entry := range entries {
+			if entry.Token == "" && entry.TokenHash == "" && entry.ClientSubject == "" {
+				return fmt.Errorf("token %q has no secret nor client subject", entry.Name)
+			}
+
+			var hasToken = entry.Token != "" || entry.TokenHash != ""
+			var tokenHash [sha256.Size]byte
+			if entry.TokenHash != "" {
+				tokenHash, err = parseTokenHash(entry.TokenHash)
+				if err != nil {
+					return fmt.Errorf("token %q has invalid hash: %v", entry.Name, err)
+				}
+			} else if entry.Token != "" {
+				tokenHash = sha256.Sum256([]byte(entry.Token))
+			}
+			if _, exists := tokens[tokenHash]; exists && hasToken {
+				return fmt.Errorf("duplicated token for %q", entry.Name)
+			}
+			if _, exists := subjects[entry.ClientSubject]; exists && entry.ClientSubject != "" {
+				return fmt.Errorf("duplicated client subject for %q", entry.Name)
+			}
+			for _, pattern := range entry.Methods {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("token %q has invalid method pattern %q", entry.Name, pattern)
+				}
+			}
+
+			identity := &Identity{
+				Name:        entry.Name,
+				Methods:     entry.Methods,
+				Expires:     entry.Expires,
+				ReceiveOnly: entry.ReceiveOnly,
+			}
+			if entry.SpendingLimits.isSet() {
+				limits := entry.SpendingLimits
+				identity.spending = &limits
+			}
+			if entry.RateLimit != "" {
+				if old, ok := previous[entry.Name]; ok && old.limiter != nil && old.limiter.spec == entry.RateLimit {
+					identity.limiter = old.limiter
+				} else {
+					identity.limiter, err = parseRateLimit(entry.RateLimit)
+					if err != nil {
+						return fmt.Errorf("token %q: %v", entry.Name, err)
+					}
+				}
+			}
+			if hasToken {
+				tokens[tokenHash] = identity
+			}
+			if entry.ClientSubject != "" {
+				subjects[entry.ClientSubject] = identity
+			}
+		}
+	}
+
+	tokensMutex.Lock()
+	tokenTable = tokens
+	subjectsTable = subjects
+	tokensMutex.Unlock()
+
+	log.Infof("Loaded %d API tokens and %d client subjects", len(tokens), len(subjects))
+	return nil
+}
+
+// authenticate returns the identity associated to the bearer token,
+// or nil if the token is not valid.
+// Tokens are only compared by their hash, so the lookup time doesn't depend
+// on how much of the secret the caller guessed right.
+func authenticate(token string) *Identity {
+	tokenHash := sha256.Sum256([]byte(token))
+
+	tokensMutex.RLock()
+	identity, ok := tokenTable[tokenHash]
+	tokensMutex.RUnlock()
+	if ok {
+		return identity
+	}
+
+	if authTokenHash, ok := getAuthTokenHash(); ok &&
+		subtle.ConstantTimeCompare(tokenHash[:], authTokenHash[:]) == 1 {
+		return &Identity{Name: "default"}
+	}
+	return nil
+}
+
+// getAuthTokenHash returns the hash of the global token, from either
+// LNCD_AUTH_TOKEN or LNCD_AUTH_TOKEN_HASH.
+func getAuthTokenHash() ([sha256.Size]byte, bool) {
+	configMutex.RLock()
+	authToken, authTokenHash := LNCD_AUTH_TOKEN, LNCD_AUTH_TOKEN_HASH
+	configMutex.RUnlock()
+
+	if authToken != "" {
+		return sha256.Sum256([]byte(authToken)), true
+	}
+	if authTokenHash != "" {
+		// An invalid hash still enables authentication, so that nothing
+		// can match it.
+		hash, err := parseTokenHash(authTokenHash)
+		if err != nil {
+			log.Errorf("Invalid LNCD_AUTH_TOKEN_HASH: %v", err)
+		}
+		return hash, true
+	}
+	return [sha256.Size]byte{}, false
+}
+
+// clientIP returns the address of the remote peer, without the port.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// checkLockout returns how long ip is still locked out after too many
+// authentication failures.
+func checkLockout(ip string) time.Duration {
+	authFailuresMutex.Lock()
+	defer authFailuresMutex.Unlock()
+	failure, ok := authFailures[ip]
+	if !ok {
+		return 0
+	}
+	return time.Until(failure.lockedUntil)
+}
+
+func recordAuthFailure(ip string, identityName string) {
+	incMetric("auth_failures")
+
+	configMutex.RLock()
+	maxFailures, lockout := LNCD_AUTH_MAX_FAILURES, LNCD_AUTH_LOCKOUT
+	configMutex.RUnlock()
+
+	authFailuresMutex.Lock()
+	defer authFailuresMutex.Unlock()
+
+	now := time.Now()
+	failure, ok := authFailures[ip]
+	if !ok || now.Sub(failure.last) > lockout {
+		failure = &authFailure{}
+		authFailures[ip] = failure
+	}
+	failure.count++
+	failure.last = now
+	log.Warnf("Authentication failure from %v (%v), %d consecutive", ip, identityName, failure.count)
+
+	if maxFailures > 0 && failure.count >= maxFailures {
+		failure.lockedUntil = now.Add(lockout)
+		incMetric("auth_lockouts")
+		log.Warnf("Locking out %v for %v after %d authentication failures", ip, lockout, failure.count)
+	}
+
+	// forget peers that stopped failing
+	for peer, f := range authFailures {
+		if now.Sub(f.last) > lockout && now.After(f.lockedUntil) {
+			delete(authFailures, peer)
+		}
+	}
+}
+
+func resetAuthFailures(ip string) {
+	authFailuresMutex.Lock()
+	delete(authFailures, ip)
+	authFailuresMutex.Unlock()
+}
+
+// Client subject of the token table entry used for the certificates that
+// don't match any other entry
+const defaultClientSubject = "*"
+
+// authenticateCertificate maps a verified client certificate to an identity,
+// or returns nil if no entry of the token table matches it.
+func authenticateCertificate(cert *x509.Certificate) *Identity {
+	tokensMutex.RLock()
+	defer tokensMutex.RUnlock()
+	if identity, ok := subjectsTable[cert.Subject.String()]; ok {
+		return identity
+	}
+	if identity, ok := subjectsTable[cert.Subject.CommonName]; ok {
+		return identity
+	}
+	return subjectsTable[defaultClientSubject]
+}
+
+// spendingLimitsOf returns the spending limits of the token table entry with
+// the given name, nil if it has none.
+func spendingLimitsOf(name string) *SpendingLimits {
+	tokensMutex.RLock()
+	defer tokensMutex.RUnlock()
+	for _, identity := range tokenTable {
+		if identity.Name == name {
+			return identity.spending
+		}
+	}
+	for _, identity := range subjectsTable {
+		if identity.Name == name {
+			return identity.spending
+		}
+	}
+	return nil
+}
+
+// isAuthEnabled returns true if callers must authenticate: when a token,
+// a client subject or a client CA bundle is configured. Clients without a
+// certificate then need a bearer token, even if certificates are optional.
+func isAuthEnabled() bool {
+	_, hasAuthToken := getAuthTokenHash()
+
+	tokensMutex.RLock()
+	numTokens, numSubjects := len(tokenTable), len(subjectsTable)
+	tokensMutex.RUnlock()
+
+	return hasAuthToken || numTokens > 0 || numSubjects > 0 || LNCD_TLS_CLIENT_CA_PATH != ""
+}
+
+// allows returns true if the identity is allowed to call method.
+func (identity *Identity) allows(method string) bool {
+	if len(identity.Methods) == 0 {
+		return true
+	}
+	for _, pattern := range identity.Methods {
+		if matched, _ := path.Match(pattern, method); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeMethod checks that the identity can call the method, before any
+// connection is opened.
+func authorizeMethod(identity *Identity, method string) error {
+	if !identity.allows(method) {
+		return &StatusError{
+			Code:    http.StatusForbidden,
+			Message: "Method not allowed for this token",
+		}
+	}
+
+	configMutex.RLock()
+	receiveOnly := LNCD_RECEIVE_ONLY
+	configMutex.RUnlock()
+	if receiveOnly || identity.ReceiveOnly {
+		class := methodClass(method)
+		if class != MethodClassRead && class != MethodClassReceive {
+			return &StatusError{
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("Method not allowed in receive-only mode (%v)", class),
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeCall applies authorizeMethod and the rate limits of the
+// connection.
+func authorizeCall(identity *Identity, info ConnectionInfo, method string) error {
+	if err := authorizeMethod(identity, method); err != nil {
+		return err
+	}
+	var key ConnectionKey = ConnectionKey{info.Mailbox, info.PairingPhrase}
+	if ok, retryAfter := getRateLimits().allowCall(key, method); !ok {
+		log.Infof("Rate limit exceeded for method %v", method)
+		return newRateLimitedError(retryAfter)
+	}
+	return nil
+}
+
+func (identity *Identity) isExpired() bool {
+	return identity.Expires != nil && time.Now().After(*identity.Expires)
+}
+
+func identityFromContext(ctx context.Context) *Identity {
+	if identity, ok := ctx.Value(identityContextKey{}).(*Identity); ok {
+		return identity
+	}
+	return anonymousIdentity
+}
+
+// authenticateRequest returns the identity of a caller from its verified
+// client certificate or from the Authorization header, and applies the
+// lockout and the rate limits of the caller. It is shared by the HTTP and
+// gRPC listeners.
+func authenticateRequest(cert *x509.Certificate, authHeader string, ip string) (*Identity, error) {
+	unauthorized := &StatusError{Code: http.StatusUnauthorized, Message: "Unauthorized"}
+
+	// applied before authenticating, so it also limits guessing tokens
+	var limits *RateLimits = getRateLimits()
+	if ok, retryAfter := limits.allowIP(ip); !ok {
+		log.Infof("Rate limit exceeded for %v", ip)
+		incMetric("ratelimit_ip")
+		return nil, newRateLimitedError(retryAfter)
+	}
+
+	var identity *Identity = anonymousIdentity
+	if cert != nil {
+		identity = authenticateCertificate(cert)
+		if identity == nil {
+			recordAuthFailure(ip, "unknown client certificate "+cert.Subject.String())
+			return nil, unauthorized
+		}
+		if identity.isExpired() {
+			return nil, unauthorized
+		}
+	} else if isAuthEnabled() {
+		if lockedFor := checkLockout(ip); lockedFor > 0 {
+			incMetric("auth_locked_requests")
+			return nil, newRateLimitedError(lockedFor)
+		}
+
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			recordAuthFailure(ip, "no token")
+			return nil, unauthorized
+		}
+		token := strings.TrimPrefix(authHeader, "Bearer ")
+		identity = authenticate(token)
+		if identity == nil {
+			recordAuthFailure(ip, "invalid token")
+			return nil, unauthorized
+		}
+		if identity.isExpired() {
+			recordAuthFailure(ip, "expired token "+identity.Name)
+			return nil, unauthorized
+		}
+		resetAuthFailures(ip)
+	}
+
+	if ok, retryAfter := limits.allowIdentity(identity); !ok {
+		log.Infof("Rate limit exceeded for %v", identity.Name)
+		incMetric("ratelimit_identity")
+		return nil, newRateLimitedError(retryAfter)
+	}
+	return identity, nil
+}
+
+func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := authenticateRequest(clientCertificate(r), r.Header.Get("Authorization"), clientIP(r))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey{}, identity)))
+	}
+}
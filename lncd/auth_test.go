@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setTestTokens loads a token table with entries and clears the
+// authentication failures.
+func setTestTokens(t *testing.T, entries []APIToken) {
+	tokensMutex.RLock()
+	previousTokens, previousSubjects := tokenTable, subjectsTable
+	tokensMutex.RUnlock()
+	t.Cleanup(func() {
+		tokensMutex.Lock()
+		tokenTable, subjectsTable = previousTokens, previousSubjects
+		tokensMutex.Unlock()
+		authFailuresMutex.Lock()
+		authFailures = map[string]*authFailure{}
+		authFailuresMutex.Unlock()
+	})
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTokens(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func setTestAuthConfig(t *testing.T, authToken string, clientCAPath string, maxFailures int) {
+	configMutex.Lock()
+	previousToken, previousHash, previousFailures := LNCD_AUTH_TOKEN, LNCD_AUTH_TOKEN_HASH, LNCD_AUTH_MAX_FAILURES
+	LNCD_AUTH_TOKEN, LNCD_AUTH_TOKEN_HASH, LNCD_AUTH_MAX_FAILURES = authToken, "", maxFailures
+	configMutex.Unlock()
+	previousCAPath := LNCD_TLS_CLIENT_CA_PATH
+	LNCD_TLS_CLIENT_CA_PATH = clientCAPath
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_AUTH_TOKEN, LNCD_AUTH_TOKEN_HASH, LNCD_AUTH_MAX_FAILURES = previousToken, previousHash, previousFailures
+		configMutex.Unlock()
+		LNCD_TLS_CLIENT_CA_PATH = previousCAPath
+	})
+}
+
+func statusCode(err error) int {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code
+	}
+	return 0
+}
+
+func TestAuthenticateRequest(t *testing.T) {
+	expired := time.Now().Add(-time.Hour)
+	tokens := []APIToken{
+		{Name: "alice", Token: "alice-token"},
+		{Name: "expired", Token: "expired-token", Expires: &expired},
+		{Name: "invoices", ClientSubject: "invoice-service"},
+		{Name: "admin", ClientSubject: "CN=admin,O=Example"},
+	}
+	withDefault := append([]APIToken{{Name: "any-certificate", ClientSubject: defaultClientSubject}}, tokens...)
+	subjectsOnly := []APIToken{{Name: "invoices", ClientSubject: "invoice-service"}}
+	certificate := func(subject pkix.Name) *x509.Certificate {
+		return &x509.Certificate{Subject: subject}
+	}
+
+	tests := []struct {
+		name         string
+		tokens       []APIToken
+		authToken    string
+		clientCAPath string
+		cert         *x509.Certificate
+		header       string
+		identity     string
+		status       int
+	}{
+		{name: "auth disabled", identity: "anonymous"},
+		{name: "token", tokens: tokens, header: "Bearer alice-token", identity: "alice"},
+		{name: "invalid token", tokens: tokens, header: "Bearer bob-token", status: http.StatusUnauthorized},
+		{name: "not a bearer token", tokens: tokens, header: "alice-token", status: http.StatusUnauthorized},
+		{name: "no token", tokens: tokens, status: http.StatusUnauthorized},
+		{name: "expired token", tokens: tokens, header: "Bearer expired-token", status: http.StatusUnauthorized},
+		{name: "global token", authToken: "s3cret", header: "Bearer s3cret", identity: "default"},
+		{name: "wrong global token", authToken: "s3cret", header: "Bearer guess", status: http.StatusUnauthorized},
+		{name: "certificate common name", tokens: tokens, cert: certificate(pkix.Name{CommonName: "invoice-service"}), identity: "invoices"},
+		{name: "certificate subject", tokens: tokens, cert: certificate(pkix.Name{CommonName: "admin", Organization: []string{"Example"}}), identity: "admin"},
+		{name: "unknown certificate", tokens: tokens, cert: certificate(pkix.Name{CommonName: "mallory"}), status: http.StatusUnauthorized},
+		{name: "default certificate entry", tokens: withDefault, cert: certificate(pkix.Name{CommonName: "mallory"}), identity: "any-certificate"},
+		{name: "certificate without entries", clientCAPath: "/etc/lncd/ca.pem", cert: certificate(pkix.Name{CommonName: "mallory"}), status: http.StatusUnauthorized},
+		// with optional client certificates, a client without one must
+		// not be anonymous
+		{name: "no certificate with client subjects", tokens: subjectsOnly, status: http.StatusUnauthorized},
+		{name: "token with client subjects only", tokens: subjectsOnly, header: "Bearer alice-token", status: http.StatusUnauthorized},
+		{name: "no certificate with a client CA", clientCAPath: "/etc/lncd/ca.pem", status: http.StatusUnauthorized},
+		{name: "token with a client CA", tokens: tokens, clientCAPath: "/etc/lncd/ca.pem", header: "Bearer alice-token", identity: "alice"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestTokens(t, test.tokens)
+			setTestAuthConfig(t, test.authToken, test.clientCAPath, 0)
+
+			identity, err := authenticateRequest(test.cert, test.header, fmt.Sprintf("192.0.2.%d", i+1))
+			if test.status != 0 {
+				if statusCode(err) != test.status {
+					t.Fatalf("expected status %d, got %v", test.status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if identity.Name != test.identity {
+				t.Fatalf("expected identity %v, got %v", test.identity, identity.Name)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRequestLockout(t *testing.T) {
+	setTestTokens(t, []APIToken{{Name: "alice", Token: "alice-token"}})
+	setTestAuthConfig(t, "", "", 3)
+
+	for i := 0; i < 3; i++ {
+		if _, err := authenticateRequest(nil, "Bearer guess", "198.51.100.1"); statusCode(err) != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %v", i, err)
+		}
+	}
+	// locked out, even with the right token
+	if _, err := authenticateRequest(nil, "Bearer alice-token", "198.51.100.1"); statusCode(err) != http.StatusTooManyRequests {
+		t.Fatalf("expected the client to be locked out, got %v", err)
+	}
+	// other clients are not
+	if identity, err := authenticateRequest(nil, "Bearer alice-token", "198.51.100.2"); err != nil || identity.Name != "alice" {
+		t.Fatalf("unexpected result %v, %v", identity, err)
+	}
+
+	// a success resets the count of failures
+	authenticateRequest(nil, "Bearer guess", "198.51.100.3")
+	authenticateRequest(nil, "Bearer guess", "198.51.100.3")
+	authenticateRequest(nil, "Bearer alice-token", "198.51.100.3")
+	authenticateRequest(nil, "Bearer guess", "198.51.100.3")
+	if _, err := authenticateRequest(nil, "Bearer alice-token", "198.51.100.3"); err != nil {
+		t.Fatalf("client locked out after a success: %v", err)
+	}
+}
+
+func TestLoadTokensRejectsInvalidTables(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []APIToken
+	}{
+		{"no secret", []APIToken{{Name: "alice"}}},
+		{"duplicated token", []APIToken{{Name: "alice", Token: "t"}, {Name: "bob", Token: "t"}}},
+		{"duplicated subject", []APIToken{{Name: "alice", ClientSubject: "s"}, {Name: "bob", ClientSubject: "s"}}},
+		{"invalid hash", []APIToken{{Name: "alice", TokenHash: "zz"}}},
+		{"invalid pattern", []APIToken{{Name: "alice", Token: "t", Methods: []string{"lnrpc.["}}}},
+		{"invalid rate limit", []APIToken{{Name: "alice", Token: "t", RateLimit: "fast"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, _ := json.Marshal(test.entries)
+			path := filepath.Join(t.TempDir(), "tokens.json")
+			if err := os.WriteFile(path, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err := loadTokens(path); err == nil {
+				t.Fatal("invalid token table loaded")
+			}
+		})
+	}
+}
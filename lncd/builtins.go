@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+)
+
+// builtinMethod is a method handled by the daemon itself rather than
+// forwarded to the node.
+type builtinMethod struct {
+	// Macaroon permissions required by the method, reported by checkPerms
+	// and explainPerms. Methods without permissions don't use the node.
+	permissions []bakery.Op
+	// Node methods called by the built-in, the caveats of the macaroon are
+	// checked against them
+	calls []string
+	// Run on their own goroutine, for methods that wait on the node, so
+	// that the connection keeps handling other actions
+	async bool
+	// report publishes an intermediate result, it is nil unless the call
+	// runs as an async job
+	run func(conn *Connection, payload string, report func(string)) (string, error)
+}
+
+var builtins = map[string]*builtinMethod{}
+
+func registerBuiltin(name string, method *builtinMethod) {
+	builtins[name] = method
+}
+
+func init() {
+	registerBuiltin("macaroonInfo", &builtinMethod{run: macaroonInfo})
+	registerBuiltin("explainPerms", &builtinMethod{run: explainPerms})
+	registerBuiltin("checkPerms", &builtinMethod{run: checkPerms})
+	registerBuiltin("decodeInvoice", &builtinMethod{
+		run: func(_ *Connection, payload string, _ func(string)) (string, error) {
+			return decodeInvoice(payload)
+		},
+	})
+	registerBuiltin("nodeSummary", &builtinMethod{
+		permissions: []bakery.Op{
+			{Entity: "info", Action: "read"},
+			{Entity: "onchain", Action: "read"},
+			{Entity: "offchain", Action: "read"},
+		},
+		calls: []string{
+			"lnrpc.Lightning.GetInfo",
+			"lnrpc.Lightning.WalletBalance",
+			"lnrpc.Lightning.ChannelBalance",
+		},
+		run: nodeSummary,
+	})
+	registerBuiltin("createInvoiceAndWait", &builtinMethod{
+		permissions: []bakery.Op{
+			{Entity: "invoices", Action: "write"},
+			{Entity: "invoices", Action: "read"},
+		},
+		calls: []string{
+			"lnrpc.Lightning.AddInvoice",
+			"lnrpc.Lightning.LookupInvoice",
+		},
+		async: true,
+		run:   createInvoiceAndWait,
+	})
+	registerBuiltin("canReceive", &builtinMethod{
+		permissions: []bakery.Op{
+			{Entity: "offchain", Action: "read"},
+		},
+		calls: []string{"lnrpc.Lightning.ListChannels"},
+		run:   canReceive,
+	})
+}
+
+// runBuiltin checks the permissions of a built-in and runs it.
+func (conn *Connection) runBuiltin(req Action, method *builtinMethod) {
+	configMutex.RLock()
+	enforcePermissions := LNCD_ENFORCE_PERMISSIONS
+	configMutex.RUnlock()
+	if enforcePermissions {
+		if err := conn.perms.enforce(req.method); err != nil {
+			log.Infof("Refusing method %v: %v", req.method, err)
+			req.onError(err)
+			return
+		}
+	}
+
+	if req.onDispatch != nil {
+		req.onDispatch()
+	}
+	log.Debugf("Running built-in method: %v", req.method)
+	if UNSAFE_LOGS {
+		log.Debugf("Execution: %v %v %v", conn.connInfo, req.method, req.payload)
+	}
+	execute := func() {
+		result, err := method.run(conn, req.payload, req.onProgress)
+		if err != nil {
+			req.onError(err)
+		} else {
+			req.onResponse(conn.connInfo, result)
+		}
+	}
+	if !method.async {
+		execute()
+		return
+	}
+	// the connection is kept open until the method returns
+	atomic.AddInt32(&conn.inFlight, 1)
+	go func() {
+		defer conn.release()
+		execute()
+	}()
+}
+
+// call runs a registered method on the node and returns its response.
+func (conn *Connection) call(method string, payload string) (string, error) {
+	methodFunc, ok := conn.registry[method]
+	if !ok {
+		return "", fmt.Errorf("unknown method %v", method)
+	}
+	var results chan callResult = make(chan callResult, 1)
+	methodFunc(context.Background(), conn.grpcClient, payload, func(result string, err error) {
+		select {
+		case results <- callResult{result: result, err: err}:
+		default:
+		}
+	})
+	result := <-results
+	return result.result, result.err
+}
+
+// callProto is call with the response decoded into response.
+func (conn *Connection) callProto(method string, payload string, response proto.Message) error {
+	result, err := conn.call(method, payload)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(result), response)
+}
+
+func macaroonInfo(conn *Connection, _ string, _ func(string)) (string, error) {
+	var methods []string = make([]string, 0, len(conn.registry))
+	for method := range conn.registry {
+		methods = append(methods, method)
+	}
+	info, err := conn.perms.info(methods)
+	if err != nil {
+		return "", err
+	}
+	result, err := json.Marshal(info)
+	return string(result), err
+}
+
+// explainPerms evaluates each method of the payload against the macaroon of
+// the connection and returns the reason of each result, checkPerms only
+// returns whether they are allowed.
+func explainPerms(conn *Connection, payload string, _ func(string)) (string, error) {
+	perms := []string{}
+	if err := json.Unmarshal([]byte(payload), &perms); err != nil {
+		return "", err
+	}
+	var results []*PermissionCheck = make([]*PermissionCheck, len(perms))
+	for i, perm := range perms {
+		results[i] = conn.perms.evaluate(perm)
+	}
+	result, err := json.Marshal(results)
+	return string(result), err
+}
+
+func checkPerms(conn *Connection, payload string, _ func(string)) (string, error) {
+	perms := []string{}
+	if err := json.Unmarshal([]byte(payload), &perms); err != nil {
+		return "", err
+	}
+	var valid []bool = make([]bool, len(perms))
+	for i, perm := range perms {
+		allowed, err := conn.perms.check(perm)
+		if err != nil {
+			log.Errorf("Error checking permission: %v", err)
+			valid[i] = false
+		} else {
+			valid[i] = allowed
+		}
+	}
+	result, err := json.Marshal(valid)
+	return string(result), err
+}
+
+// NodeSummary is the result of the nodeSummary built-in.
+type NodeSummary struct {
+	Alias               string
+	PubKey              string
+	Version             string
+	Network             string
+	BlockHeight         uint32
+	SyncedToChain       bool
+	SyncedToGraph       bool
+	NumPeers            uint32
+	ActiveChannels      uint32
+	InactiveChannels    uint32
+	PendingChannels     uint32
+	OnchainConfirmedSat int64
+	OnchainPendingSat   int64
+	LocalBalanceSat     uint64
+	RemoteBalanceSat    uint64
+	PendingOpenSat      uint64
+}
+
+// nodeSummary returns the info, the balances and the channel counts of the
+// node in one call.
+func nodeSummary(conn *Connection, _ string, _ func(string)) (string, error) {
+	var info lnrpc.GetInfoResponse
+	if err := conn.callProto("lnrpc.Lightning.GetInfo", "{}", &info); err != nil {
+		return "", err
+	}
+	var wallet lnrpc.WalletBalanceResponse
+	if err := conn.callProto("lnrpc.Lightning.WalletBalance", "{}", &wallet); err != nil {
+		return "", err
+	}
+	var channels lnrpc.ChannelBalanceResponse
+	if err := conn.callProto("lnrpc.Lightning.ChannelBalance", "{}", &channels); err != nil {
+		return "", err
+	}
+
+	summary := NodeSummary{
+		Alias:               info.Alias,
+		PubKey:              info.IdentityPubkey,
+		Version:             info.Version,
+		BlockHeight:         info.BlockHeight,
+		SyncedToChain:       info.SyncedToChain,
+		SyncedToGraph:       info.SyncedToGraph,
+		NumPeers:            info.NumPeers,
+		ActiveChannels:      info.NumActiveChannels,
+		InactiveChannels:    info.NumInactiveChannels,
+		PendingChannels:     info.NumPendingChannels,
+		OnchainConfirmedSat: wallet.ConfirmedBalance,
+		OnchainPendingSat:   wallet.UnconfirmedBalance,
+		LocalBalanceSat:     channels.GetLocalBalance().GetSat(),
+		RemoteBalanceSat:    channels.GetRemoteBalance().GetSat(),
+		PendingOpenSat:      channels.GetPendingOpenLocalBalance().GetSat(),
+	}
+	if len(info.Chains) > 0 {
+		summary.Network = info.Chains[0].Network
+	}
+	result, err := json.Marshal(summary)
+	return string(result), err
+}
+
+// createInvoiceAndWait creates an invoice with the AddInvoice request in
+// "invoice" and waits until it is settled or canceled, or until "timeout"
+// expires. The AddInvoice response, with the payment request to show to the
+// payer, is reported as the progress of the job, so the method can only be
+// called as an async job.
+func createInvoiceAndWait(conn *Connection, payload string, report func(string)) (string, error) {
+	if report == nil {
+		return "", &StatusError{Code: http.StatusBadRequest, Message: "createInvoiceAndWait must be called as an async job"}
+	}
+	var request struct {
+		Invoice json.RawMessage `json:"invoice"`
+		Timeout string          `json:"timeout"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil {
+		return "", &StatusError{Code: http.StatusBadRequest, Message: "invalid payload: " + err.Error()}
+	}
+	if len(request.Invoice) == 0 {
+		request.Invoice = json.RawMessage("{}")
+	}
+
+	configMutex.RLock()
+	maxTimeout := LNCD_INVOICE_WAIT_MAX_TIMEOUT
+	configMutex.RUnlock()
+	var timeout time.Duration = min(defaultInvoiceWaitTimeout, maxTimeout)
+	if request.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(request.Timeout); err != nil || timeout < 0 {
+			return "", &StatusError{Code: http.StatusBadRequest, Message: "invalid timeout"}
+		}
+		timeout = min(timeout, maxTimeout)
+	}
+
+	// listen before creating the invoice, so no update is lost
+	var updates chan *lnrpc.Invoice = make(chan *lnrpc.Invoice, 16)
+	unsubscribe := invoiceStreams.subscribe(conn.connInfo, func(_ ConnectionInfo, invoice *lnrpc.Invoice) {
+		if isFinalInvoiceState(invoice.State) {
+			select {
+			case updates <- invoice:
+			default:
+			}
+		}
+	})
+	defer unsubscribe()
+
+	addResult, err := conn.call("lnrpc.Lightning.AddInvoice", string(request.Invoice))
+	if err != nil {
+		return "", err
+	}
+	var created lnrpc.AddInvoiceResponse
+	err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(addResult), &created)
+	if err != nil {
+		return "", err
+	}
+	report(addResult)
+	log.Infof("Waiting for invoice %x (timeout %v)", created.RHash, timeout)
+
+	lookup := func() (*lnrpc.Invoice, error) {
+		invoice := &lnrpc.Invoice{}
+		payload := fmt.Sprintf(`{"r_hash_str": "%x"}`, created.RHash)
+		return invoice, conn.callProto("lnrpc.Lightning.LookupInvoice", payload, invoice)
+	}
+	invoice, err := lookup()
+	if err != nil {
+		return "", err
+	}
+
+	var timedOut bool
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for !isFinalInvoiceState(invoice.State) && !timedOut {
+		select {
+		case update := <-updates:
+			if bytes.Equal(update.RHash, created.RHash) {
+				invoice = update
+			}
+		case <-timer.C:
+			// the stream may have been opened after the update, so check
+			// the invoice once more
+			if invoice, err = lookup(); err != nil {
+				return "", err
+			}
+			timedOut = !isFinalInvoiceState(invoice.State)
+		}
+	}
+
+	invoiceData, err := invoiceJSON(invoice)
+	if err != nil {
+		return "", err
+	}
+	result, err := json.Marshal(InvoiceWaitResponse{
+		State:    invoice.State.String(),
+		TimedOut: timedOut,
+		Invoice:  invoiceData,
+	})
+	return string(result), err
+}
+
+// CanReceiveResponse is the result of the canReceive built-in. InboundSat is
+// what the peers of the active channels can send, without their reserve.
+type CanReceiveResponse struct {
+	CanReceive bool
+	AmountSat  int64
+	InboundSat int64
+	// Largest amount that can be received through a single channel, for
+	// payers that don't support multi-part payments
+	MaxSingleChannelSat int64
+	ActiveChannels      int
+}
+
+// canReceive checks that the active channels have enough inbound liquidity
+// to receive {"amount_sat": N}.
+func canReceive(conn *Connection, payload string, _ func(string)) (string, error) {
+	var request struct {
+		AmountSat int64 `json:"amount_sat"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil || request.AmountSat <= 0 {
+		return "", &StatusError{Code: http.StatusBadRequest, Message: "amount_sat must be a positive number"}
+	}
+
+	var channels lnrpc.ListChannelsResponse
+	if err := conn.callProto("lnrpc.Lightning.ListChannels", `{"active_only": true}`, &channels); err != nil {
+		return "", err
+	}
+
+	response := CanReceiveResponse{AmountSat: request.AmountSat, ActiveChannels: len(channels.Channels)}
+	for _, channel := range channels.Channels {
+		var reserve int64 = channel.RemoteChanReserveSat
+		if channel.RemoteConstraints != nil {
+			reserve = int64(channel.RemoteConstraints.ChanReserveSat)
+		}
+		inbound := max(channel.RemoteBalance-reserve, 0)
+		response.InboundSat += inbound
+		response.MaxSingleChannelSat = max(response.MaxSingleChannelSat, inbound)
+	}
+	response.CanReceive = response.InboundSat >= request.AmountSat
+
+	result, err := json.Marshal(response)
+	return string(result), err
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How a call uses the response cache, from the Cache-Control header of the
+// request.
+type cacheMode int
+
+const (
+	// Serve from the cache when possible
+	cacheDefault cacheMode = iota
+	// Always call the node, and cache the fresh response (no-cache)
+	cacheRevalidate
+	// Neither read nor write the cache (no-store)
+	cacheBypass
+)
+
+type cacheModeContextKey struct{}
+
+func withCacheMode(ctx context.Context, mode cacheMode) context.Context {
+	return context.WithValue(ctx, cacheModeContextKey{}, mode)
+}
+
+func cacheModeFromContext(ctx context.Context) cacheMode {
+	mode, _ := ctx.Value(cacheModeContextKey{}).(cacheMode)
+	return mode
+}
+
+// parseCacheControl returns the cache mode requested by a Cache-Control
+// header.
+func parseCacheControl(header string) cacheMode {
+	var mode cacheMode = cacheDefault
+	for _, directive := range strings.Split(header, ",") {
+		switch strings.ToLower(strings.TrimSpace(directive)) {
+		case "no-store":
+			return cacheBypass
+		case "no-cache", "max-age=0":
+			mode = cacheRevalidate
+		}
+	}
+	return mode
+}
+
+// cacheControlMiddleware passes the Cache-Control header of the request to
+// the calls made by the handler.
+func cacheControlMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Cache-Control"); header != "" {
+			r = r.WithContext(withCacheMode(r.Context(), parseCacheControl(header)))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+type cacheRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+var (
+	cacheRulesMutex sync.RWMutex
+	cacheRules      []cacheRule
+)
+
+// loadCacheRules parses LNCD_CACHE_METHODS, comma separated method=ttl pairs
+// where the method can be a glob pattern.
+func loadCacheRules() error {
+	configMutex.RLock()
+	spec := LNCD_CACHE_METHODS
+	configMutex.RUnlock()
+
+	var rules []cacheRule
+	for _, entry := range strings.Split(spec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, ttlStr, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return fmt.Errorf("LNCD_CACHE_METHODS: invalid entry %q, expected method=ttl", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("LNCD_CACHE_METHODS: invalid pattern %q", pattern)
+		}
+		ttl, err := time.ParseDuration(strings.TrimSpace(ttlStr))
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("LNCD_CACHE_METHODS: invalid ttl %q", ttlStr)
+		}
+		if isKnownMethod(pattern) && !isCacheableMethod(pattern) {
+			return fmt.Errorf("LNCD_CACHE_METHODS: %v is not a read-only method", pattern)
+		}
+		rules = append(rules, cacheRule{pattern, ttl})
+	}
+
+	cacheRulesMutex.Lock()
+	cacheRules = rules
+	cacheRulesMutex.Unlock()
+	return nil
+}
+
+// isCacheableMethod returns true for the read-only methods that return a
+// single response. Streams are never cached.
+func isCacheableMethod(method string) bool {
+	name := method[strings.LastIndex(method, ".")+1:]
+	if strings.HasPrefix(name, "Subscribe") || strings.HasPrefix(name, "Track") {
+		return false
+	}
+	return methodClass(method) == MethodClassRead
+}
+
+// cacheTTL returns how long the responses of the method are cached, 0 if
+// they are not. Only the first matching pattern is applied.
+func cacheTTL(method string) time.Duration {
+	cacheRulesMutex.RLock()
+	defer cacheRulesMutex.RUnlock()
+	for _, rule := range cacheRules {
+		if ok, _ := path.Match(rule.pattern, method); ok {
+			if !isCacheableMethod(method) {
+				return 0
+			}
+			return rule.ttl
+		}
+	}
+	return 0
+}
+
+type cacheEntry struct {
+	result  string
+	expires time.Time
+}
+
+// responseCache holds the cached responses of a connection, it is dropped
+// with the connection.
+type responseCache struct {
+	entries map[string]cacheEntry
+	mutex   sync.Mutex
+}
+
+// cacheKey identifies a call by its method and payload, payloads are
+// compacted so that formatting doesn't matter.
+func cacheKey(method string, payload string) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(payload)); err == nil {
+		payload = compact.String()
+	}
+	return method + "\x00" + payload
+}
+
+func (cache *responseCache) get(key string) (string, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, ok := cache.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return "", false
+	}
+	return entry.result, true
+}
+
+func (cache *responseCache) put(key string, result string, ttl time.Duration) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]cacheEntry)
+	}
+	now := time.Now()
+	for key, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[key] = cacheEntry{result: result, expires: now.Add(ttl)}
+}
+
+func (cache *responseCache) len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.entries)
+}
+
+func (cache *responseCache) clear() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.entries = nil
+}
+
+// cached answers the action from the cache of the connection if possible,
+// otherwise it returns the action with its response stored in the cache.
+func (conn *Connection) cached(req Action) (Action, bool) {
+	ttl := cacheTTL(req.method)
+	if ttl == 0 || req.cache == cacheBypass {
+		return req, false
+	}
+
+	key := cacheKey(req.method, req.payload)
+	if req.cache == cacheDefault {
+		if result, ok := conn.cache.get(key); ok {
+			incMetric("cache_hits")
+			log.Debugf("Cache hit for %v", req.method)
+			req.onResponse(conn.connInfo, result)
+			return req, true
+		}
+	}
+	incMetric("cache_misses")
+
+	onResponse := req.onResponse
+	req.onResponse = func(info ConnectionInfo, result string) {
+		conn.cache.put(key, result, ttl)
+		onResponse(info, result)
+	}
+	return req, false
+}
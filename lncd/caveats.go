@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lightningnetwork/lnd/macaroons"
+	"gopkg.in/macaroon-bakery.v2/bakery/checkers"
+	"gopkg.in/macaroon.v2"
+)
+
+const (
+	// IP lock caveat added by lnd
+	caveatIPAddr = "ipaddr"
+
+	// Custom caveats added by lit, see lightning-terminal/accounts and
+	// lightning-terminal/firewall
+	caveatLitAccount  = "account"
+	caveatLitFirewall = "lit-mac-fw"
+)
+
+// Methods that lit allows on macaroons bound to an account, every other
+// call is refused by the node. Keep in sync with the checkers in
+// lightning-terminal/accounts/checkers.go.
+var litAccountMethods = map[string]bool{
+	"lnrpc.Lightning.AddInvoice":      true,
+	"lnrpc.Lightning.ListInvoices":    true,
+	"lnrpc.Lightning.LookupInvoice":   true,
+	"lnrpc.Lightning.SendPayment":     true,
+	"lnrpc.Lightning.SendPaymentSync": true,
+	"routerrpc.Router.SendPaymentV2":  true,
+	"lnrpc.Lightning.SendToRoute":     true,
+	"lnrpc.Lightning.SendToRouteSync": true,
+	"routerrpc.Router.SendToRouteV2":  true,
+	"lnrpc.Lightning.DecodePayReq":    true,
+	"lnrpc.Lightning.ListPayments":    true,
+	"routerrpc.Router.TrackPaymentV2": true,
+	"lnrpc.Lightning.PendingChannels": true,
+	"lnrpc.Lightning.ListChannels":    true,
+	"lnrpc.Lightning.ClosedChannels":  true,
+	"lnrpc.Lightning.ChannelBalance":  true,
+	"lnrpc.Lightning.WalletBalance":   true,
+	"lnrpc.Lightning.GetTransactions": true,
+	"lnrpc.Lightning.ListPeers":       true,
+	"lnrpc.Lightning.GetInfo":         true,
+	"lnrpc.Lightning.GetNodeInfo":     true,
+}
+
+// Caveat is a first party caveat of a macaroon.
+type Caveat struct {
+	// The raw condition, eg. "time-before 2024-01-01T00:00:00Z"
+	Condition string
+	// The caveat type, eg. "time-before", "ipaddr" or "lnd-custom"
+	Type string
+	// The name of lnd custom caveats, eg. "account"
+	Name  string `json:",omitempty"`
+	Value string
+}
+
+// parseCaveats returns the first party caveats of the macaroon.
+// Third party caveats are not supported by lnd and are ignored.
+func parseCaveats(mac *macaroon.Macaroon) []Caveat {
+	var caveats []Caveat = []Caveat{}
+	for _, caveat := range mac.Caveats() {
+		if len(caveat.VerificationId) > 0 {
+			continue
+		}
+
+		condition := string(caveat.Id)
+		cond, arg, err := checkers.ParseCaveat(condition)
+		if err != nil {
+			cond, arg, _ = strings.Cut(condition, " ")
+		}
+
+		parsed := Caveat{
+			Condition: condition,
+			Type:      cond,
+			Value:     arg,
+		}
+		if cond == macaroons.CondLndCustom {
+			parsed.Name, parsed.Value, _ = strings.Cut(arg, " ")
+		}
+		caveats = append(caveats, parsed)
+	}
+	return caveats
+}
+
+// macaroonExpiry returns the earliest time-before caveat, or nil if the
+// macaroon doesn't expire.
+func macaroonExpiry(caveats []Caveat) *time.Time {
+	var expiry *time.Time
+	for _, caveat := range caveats {
+		if caveat.Type != checkers.CondTimeBefore {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, caveat.Value)
+		if err != nil {
+			continue
+		}
+		if expiry == nil || t.Before(*expiry) {
+			expiry = &t
+		}
+	}
+	return expiry
+}
+
+// evaluateCaveat checks if the caveat allows calling method at the given
+// time. Caveats that can't be verified by the daemon are allowed, with a note
+// explaining why the node could still refuse the call.
+func evaluateCaveat(caveat Caveat, method string, now time.Time) (allowed bool, note string) {
+	switch caveat.Type {
+	case checkers.CondTimeBefore:
+		expiry, err := time.Parse(time.RFC3339Nano, caveat.Value)
+		if err != nil {
+			return false, fmt.Sprintf("invalid time-before caveat %q", caveat.Value)
+		}
+		if !now.Before(expiry) {
+			return false, fmt.Sprintf("macaroon expired at %v", expiry.Format(time.RFC3339))
+		}
+		return true, ""
+
+	case caveatIPAddr:
+		// lnd checks the address of the grpc peer, which is the
+		// mailbox connection and not something the daemon can know.
+		return true, fmt.Sprintf("macaroon is locked to IP %v", caveat.Value)
+
+	case macaroons.CondLndCustom:
+		switch caveat.Name {
+		case caveatLitAccount:
+			if !litAccountMethods[method] {
+				return false, fmt.Sprintf("method not supported with lit account %v", caveat.Value)
+			}
+			return true, fmt.Sprintf("calls are bound to lit account %v", caveat.Value)
+
+		case caveatLitFirewall:
+			kind, _, _ := strings.Cut(caveat.Value, ":")
+			if kind == "meta" {
+				return true, ""
+			}
+			return true, "calls are subject to lit firewall rules"
+
+		default:
+			return true, fmt.Sprintf("unknown custom caveat %q", caveat.Name)
+		}
+
+	default:
+		return true, fmt.Sprintf("unknown caveat %q", caveat.Type)
+	}
+}
+
+// PermissionOp is an entity/action pair required by a method.
+type PermissionOp struct {
+	Entity string
+	Action string
+}
+
+// PermissionCheck is the result of checking a method against the macaroon
+// of a connection.
+type PermissionCheck struct {
+	Method  string
+	Allowed bool
+	// Why the call is refused, or "granted"
+	Reason  string
+	Missing []PermissionOp `json:",omitempty"`
+	// Caveats that the daemon can't fully verify
+	Notes []string `json:",omitempty"`
+	// False if the method is not in the known permissions list
+	known bool
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	ossignal "os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/btcsuite/btclog"
+)
+
+// Path to an optional file of KEY=VALUE lines that override the environment.
+// Unlike the environment, this file is re-read on SIGHUP.
+var LNCD_CONFIG_PATH = os.Getenv("LNCD_CONFIG_PATH")
+
+var (
+	configMutex      sync.RWMutex
+	configFileValues = loadConfigFile(LNCD_CONFIG_PATH)
+)
+
+// loadConfigFile parses a dotenv-like file. Empty lines and lines starting
+// with # are ignored, values can optionally be quoted.
+func loadConfigFile(path string) map[string]string {
+	values := make(map[string]string)
+	if path == "" {
+		return values
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		// the logger is not ready yet when this is called during init
+		if log != nil {
+			log.Errorf("Unable to read config file %v: %v", path, err)
+		}
+		return values
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[key] = value
+	}
+	return values
+}
+
+func lookupConfigFile(key string) (string, bool) {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	value, ok := configFileValues[key]
+	return value, ok
+}
+
+// reloadConfig re-reads the config file and updates the settings that can be
+// changed at runtime, including the token table. Listener addresses and
+// TLS paths require a restart.
+func reloadConfig() {
+	values := loadConfigFile(LNCD_CONFIG_PATH)
+
+	configMutex.Lock()
+	configFileValues = values
+	configMutex.Unlock()
+
+	timeout := getEnvAsDuration("LNCD_TIMEOUT", defaultTimeout)
+	limitActiveConnections := getEnvAsInt("LNCD_LIMIT_ACTIVE_CONNECTIONS", defaultLimitActiveConnections)
+	debug := getEnvAsBool("LNCD_DEBUG", false)
+	authToken := getEnv("LNCD_AUTH_TOKEN", "")
+	authTokenHash := getEnv("LNCD_AUTH_TOKEN_HASH", "")
+	authMaxFailures := getEnvAsInt("LNCD_AUTH_MAX_FAILURES", defaultAuthMaxFailures)
+	authLockout := getEnvAsDuration("LNCD_AUTH_LOCKOUT", defaultAuthLockout)
+	rateLimitIdentity := getEnv("LNCD_RATE_LIMIT_IDENTITY", "")
+	rateLimitIP := getEnv("LNCD_RATE_LIMIT_IP", "")
+	rateLimitConnection := getEnv("LNCD_RATE_LIMIT_CONNECTION", "")
+	rateLimitMethods := getEnv("LNCD_RATE_LIMIT_METHODS", "")
+	rateLimitHandshake := getEnv("LNCD_RATE_LIMIT_HANDSHAKE", "")
+	enforcePermissions := getEnvAsBool("LNCD_ENFORCE_PERMISSIONS", true)
+	receiveOnly := getEnvAsBool("LNCD_RECEIVE_ONLY", false)
+	spendMaxPayment := int64(getEnvAsInt("LNCD_SPEND_MAX_PAYMENT_SAT", 0))
+	spendDailyBudget := int64(getEnvAsInt("LNCD_SPEND_DAILY_BUDGET_SAT", 0))
+	spendAllowedDestinations := getEnv("LNCD_SPEND_ALLOWED_DESTINATIONS", "")
+	validatePaymentRequests := getEnvAsBool("LNCD_VALIDATE_PAYMENT_REQUESTS", true)
+	idempotencyTTL := getEnvAsDuration("LNCD_IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	jobRetention := getEnvAsDuration("LNCD_JOB_RETENTION", defaultJobRetention)
+	webhookMaxAttempts := getEnvAsInt("LNCD_WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts)
+	webhookDeadLetterPath := getEnv("LNCD_WEBHOOK_DEAD_LETTER_PATH", "")
+	invoiceWaitMaxTimeout := getEnvAsDuration("LNCD_INVOICE_WAIT_MAX_TIMEOUT", defaultInvoiceWaitMaxTimeout)
+	cacheMethods := getEnv("LNCD_CACHE_METHODS", "")
+
+	configMutex.Lock()
+	LNCD_TIMEOUT = timeout
+	LNCD_LIMIT_ACTIVE_CONNECTIONS = limitActiveConnections
+	LNCD_DEBUG = debug
+	LNCD_AUTH_TOKEN = authToken
+	LNCD_AUTH_TOKEN_HASH = authTokenHash
+	LNCD_AUTH_MAX_FAILURES = authMaxFailures
+	LNCD_AUTH_LOCKOUT = authLockout
+	LNCD_RATE_LIMIT_IDENTITY = rateLimitIdentity
+	LNCD_RATE_LIMIT_IP = rateLimitIP
+	LNCD_RATE_LIMIT_CONNECTION = rateLimitConnection
+	LNCD_RATE_LIMIT_METHODS = rateLimitMethods
+	LNCD_RATE_LIMIT_HANDSHAKE = rateLimitHandshake
+	LNCD_ENFORCE_PERMISSIONS = enforcePermissions
+	LNCD_RECEIVE_ONLY = receiveOnly
+	LNCD_SPEND_MAX_PAYMENT_SAT = spendMaxPayment
+	LNCD_SPEND_DAILY_BUDGET_SAT = spendDailyBudget
+	LNCD_SPEND_ALLOWED_DESTINATIONS = spendAllowedDestinations
+	LNCD_VALIDATE_PAYMENT_REQUESTS = validatePaymentRequests
+	LNCD_IDEMPOTENCY_TTL = idempotencyTTL
+	LNCD_JOB_RETENTION = jobRetention
+	LNCD_WEBHOOK_MAX_ATTEMPTS = webhookMaxAttempts
+	LNCD_WEBHOOK_DEAD_LETTER_PATH = webhookDeadLetterPath
+	LNCD_INVOICE_WAIT_MAX_TIMEOUT = invoiceWaitMaxTimeout
+	LNCD_CACHE_METHODS = cacheMethods
+	configMutex.Unlock()
+
+	if debug {
+		log.SetLevel(btclog.LevelTrace)
+	} else {
+		log.SetLevel(btclog.LevelInfo)
+	}
+
+	log.Infof("Configuration reloaded")
+	log.Infof("LNCD_TIMEOUT: %v", timeout)
+	log.Infof("LNCD_LIMIT_ACTIVE_CONNECTIONS: %v", limitActiveConnections)
+	log.Infof("LNCD_DEBUG: %v", debug)
+	log.Infof("LNCD_AUTH_TOKEN_HASH: %v", authTokenHash)
+	log.Infof("LNCD_AUTH_MAX_FAILURES: %v", authMaxFailures)
+	log.Infof("LNCD_AUTH_LOCKOUT: %v", authLockout)
+	log.Infof("LNCD_RATE_LIMIT_IDENTITY: %v", rateLimitIdentity)
+	log.Infof("LNCD_RATE_LIMIT_IP: %v", rateLimitIP)
+	log.Infof("LNCD_RATE_LIMIT_CONNECTION: %v", rateLimitConnection)
+	log.Infof("LNCD_RATE_LIMIT_METHODS: %v", rateLimitMethods)
+	log.Infof("LNCD_RATE_LIMIT_HANDSHAKE: %v", rateLimitHandshake)
+	log.Infof("LNCD_ENFORCE_PERMISSIONS: %v", enforcePermissions)
+	log.Infof("LNCD_RECEIVE_ONLY: %v", receiveOnly)
+	log.Infof("LNCD_SPEND_MAX_PAYMENT_SAT: %v", spendMaxPayment)
+	log.Infof("LNCD_SPEND_DAILY_BUDGET_SAT: %v", spendDailyBudget)
+	log.Infof("LNCD_SPEND_ALLOWED_DESTINATIONS: %v", spendAllowedDestinations)
+	log.Infof("LNCD_VALIDATE_PAYMENT_REQUESTS: %v", validatePaymentRequests)
+	log.Infof("LNCD_IDEMPOTENCY_TTL: %v", idempotencyTTL)
+	log.Infof("LNCD_JOB_RETENTION: %v", jobRetention)
+	log.Infof("LNCD_WEBHOOK_MAX_ATTEMPTS: %v", webhookMaxAttempts)
+	log.Infof("LNCD_WEBHOOK_DEAD_LETTER_PATH: %v", webhookDeadLetterPath)
+	log.Infof("LNCD_INVOICE_WAIT_MAX_TIMEOUT: %v", invoiceWaitMaxTimeout)
+	log.Infof("LNCD_CACHE_METHODS: %v", cacheMethods)
+	if UNSAFE_LOGS {
+		log.Infof("LNCD_AUTH_TOKEN: %v", authToken)
+	}
+
+	if err := loadTokens(LNCD_TOKENS_PATH); err != nil {
+		log.Errorf("Unable to reload API tokens, keeping the previous ones: %v", err)
+	}
+	if err := loadRateLimits(); err != nil {
+		log.Errorf("Unable to reload rate limits, keeping the previous ones: %v", err)
+	}
+	if err := loadCacheRules(); err != nil {
+		log.Errorf("Unable to reload cached methods, keeping the previous ones: %v", err)
+	}
+}
+
+// startReloadLoop reloads the configuration and the TLS certificates
+// every time the process receives SIGHUP.
+func startReloadLoop(certs *certReloader) {
+	sighup := make(chan os.Signal, 1)
+	ossignal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Infof("SIGHUP received, reloading")
+			reloadConfig()
+			if certs != nil {
+				if err := certs.reload(); err != nil {
+					log.Errorf("Unable to reload TLS certificate: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// rawFrame is a gRPC message that is forwarded without being decoded.
+type rawFrame struct {
+	data []byte
+}
+
+// rawCodec passes the serialized messages through, so the gRPC listener can
+// proxy any lnd service without knowing its types. It reports itself as
+// "proto" to keep the content type of the forwarded calls unchanged.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	frame, ok := v.(*rawFrame)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return frame.data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	frame, ok := v.(*rawFrame)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	frame.data = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// grpcError converts the errors of the daemon to gRPC status errors.
+func grpcError(err error) error {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return status.FromContextError(err).Err()
+		}
+		return status.Error(codes.Unknown, err.Error())
+	}
+
+	var code codes.Code
+	switch statusErr.Code {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, statusErr.Message)
+}
+
+func metadataValue(md metadata.MD, key string) string {
+	values := md.Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func peerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// peerCertificate returns the verified client certificate of the call, if
+// any.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+// methodDescriptor looks up a method like "/lnrpc.Lightning/SendPaymentSync"
+// in the registered proto files.
+func methodDescriptor(fullMethod string) (protoreflect.MethodDescriptor, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid method %v", fullMethod)
+	}
+	desc, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, err
+	}
+	serviceDesc, ok := desc.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a service", service)
+	}
+	methodDesc := serviceDesc.Methods().ByName(protoreflect.Name(name))
+	if methodDesc == nil {
+		return nil, fmt.Errorf("unknown method %v", fullMethod)
+	}
+	return methodDesc, nil
+}
+
+// frameToJSON decodes a forwarded message to the JSON format used by the
+// callbacks. It is only used for the spending limits.
+func frameToJSON(desc protoreflect.MessageDescriptor, frame *rawFrame) (string, error) {
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(desc.FullName())
+	if err != nil {
+		return "", err
+	}
+	msg := msgType.New().Interface()
+	if err := proto.Unmarshal(frame.data, msg); err != nil {
+		return "", err
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// acquire returns the pooled connection for info once the macaroon
+// permissions of method are checked. The caller must call release on the
+// connection when the call is completed.
+func (pool *ConnectionPool) acquire(ctx context.Context, info ConnectionInfo, identity *Identity, method string) (*Connection, error) {
+	type acquireResult struct {
+		conn *Connection
+		err  error
+	}
+
+	var waitConnection chan acquireResult = make(chan acquireResult, 1)
+	pool.execute(info, Action{
+		method:   method,
+		identity: identity,
+		onError: func(err error) {
+			waitConnection <- acquireResult{err: err}
+		},
+		onConnection: func(conn *Connection) {
+			waitConnection <- acquireResult{conn: conn}
+		},
+	})
+
+	select {
+	case res := <-waitConnection:
+		return res.conn, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-waitConnection; res.conn != nil {
+				res.conn.release()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// grpcProxy forwards the calls received by the gRPC listener to the node
+// over the pooled LNC connections.
+type grpcProxy struct {
+	pool *ConnectionPool
+}
+
+func (proxy *grpcProxy) handle(srv interface{}, serverStream grpc.ServerStream) error {
+	fullMethod, ok := grpc.MethodFromServerStream(serverStream)
+	if !ok {
+		return status.Error(codes.Internal, "unknown method")
+	}
+	// "/lnrpc.Lightning/GetInfo" is registered as "lnrpc.Lightning.GetInfo"
+	var method string = strings.Replace(strings.TrimPrefix(fullMethod, "/"), "/", ".", 1)
+
+	ctx := serverStream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	identity, err := authenticateRequest(peerCertificate(ctx), metadataValue(md, "authorization"), peerIP(ctx))
+	if err != nil {
+		return grpcError(err)
+	}
+	log.Infof("Incoming gRPC request: %v from %v (%v)", method, identity.Name, peerIP(ctx))
+
+	var sessionID string = metadataValue(md, strings.ToLower(headerSession))
+	info, err := resolveConnection(identity, sessionID, ConnectionInfo{
+		Mailbox:       metadataValue(md, strings.ToLower(headerMailbox)),
+		PairingPhrase: metadataValue(md, strings.ToLower(headerPairingPhrase)),
+		LocalKey:      metadataValue(md, strings.ToLower(headerLocalKey)),
+		RemoteKey:     metadataValue(md, strings.ToLower(headerRemoteKey)),
+	})
+	if err != nil {
+		return grpcError(err)
+	}
+	if info.Mailbox == "" || info.PairingPhrase == "" {
+		return status.Error(codes.InvalidArgument, "either lncd-session or lncd-mailbox and lncd-pairing-phrase metadata are required")
+	}
+	if err := authorizeCall(identity, info, method); err != nil {
+		log.Infof("Refusing method %v: %v", method, err)
+		return grpcError(err)
+	}
+
+	conn, err := proxy.pool.acquire(ctx, info, identity, method)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer conn.release()
+
+	if sessionID != "" {
+		sessions.updateKeys(sessionID, conn.connInfo)
+	} else {
+		grpc.SetHeader(ctx, metadata.Pairs(
+			strings.ToLower(headerLocalKey), conn.connInfo.LocalKey,
+			strings.ToLower(headerRemoteKey), conn.connInfo.RemoteKey,
+		))
+	}
+
+	return proxy.forward(ctx, serverStream, conn, identity, fullMethod, method)
+}
+
+// forward copies the messages between the client and the node until either
+// side ends the call. Messages of methods that are not read or receive
+// only are decoded to apply the spending limits, the same way as the calls
+// of the other APIs. Everything else is forwarded as is.
+func (proxy *grpcProxy) forward(ctx context.Context, serverStream grpc.ServerStream, conn *Connection, identity *Identity, fullMethod string, method string) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	clientStream, err := conn.grpcClient.NewStream(ctx, &grpc.StreamDesc{
+		ServerStreams: true,
+		ClientStreams: true,
+	}, fullMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return grpcError(err)
+	}
+
+	var methodDesc protoreflect.MethodDescriptor
+	var checkSpend bool
+	if class := methodClass(method); class != MethodClassRead && class != MethodClassReceive {
+		checkSpend = true
+		if methodDesc, err = methodDescriptor(fullMethod); err != nil && spendingLimitsSet(identity) {
+			// the messages can't be decoded to find out what they spend
+			return grpcError(&StatusError{
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("spending policy: the funds moved by %v cannot be determined", method),
+			})
+		}
+	}
+
+	// amounts reserved by the spending limits, released in order when
+	// the node reports a failed payment. They are kept when the call is
+	// canceled or broken, lnd completes the payments sent before.
+	var pending []func()
+	var pendingMutex sync.Mutex
+	releaseNext := func() {
+		pendingMutex.Lock()
+		defer pendingMutex.Unlock()
+		if len(pending) > 0 {
+			pending[0]()
+			pending = pending[1:]
+		}
+	}
+
+	var clientDone chan error = make(chan error, 1)
+	go func() {
+		for {
+			frame := &rawFrame{}
+			if err := serverStream.RecvMsg(frame); err != nil {
+				if err == io.EOF {
+					clientDone <- clientStream.CloseSend()
+				} else {
+					clientDone <- err
+				}
+				return
+			}
+			if checkSpend {
+				var payload string
+				if methodDesc != nil {
+					if payload, err = frameToJSON(methodDesc.Input(), frame); err != nil {
+						clientDone <- status.Error(codes.InvalidArgument, err.Error())
+						return
+					}
+				}
+				release, err := authorizeSpend(conn, identity, method, payload)
+				if err != nil {
+					log.Infof("Refusing method %v: %v", method, err)
+					clientDone <- err
+					return
+				}
+				pendingMutex.Lock()
+				pending = append(pending, release)
+				pendingMutex.Unlock()
+			}
+			if err := clientStream.SendMsg(frame); err != nil {
+				clientDone <- err
+				return
+			}
+		}
+	}()
+
+	var serverDone chan error = make(chan error, 1)
+	go func() {
+		header, err := clientStream.Header()
+		if err != nil {
+			serverDone <- err
+			return
+		}
+		if err := serverStream.SendHeader(header); err != nil {
+			serverDone <- err
+			return
+		}
+		for {
+			frame := &rawFrame{}
+			if err := clientStream.RecvMsg(frame); err != nil {
+				serverDone <- err
+				return
+			}
+			if methodDesc != nil {
+				if result, err := frameToJSON(methodDesc.Output(), frame); err == nil && spendFailed(result) {
+					releaseNext()
+				}
+			}
+			if err := serverStream.SendMsg(frame); err != nil {
+				serverDone <- err
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case err := <-clientDone:
+			if err != nil {
+				cancel()
+				<-serverDone
+				return grpcError(err)
+			}
+			// the client is done sending, wait for the node to end the call
+			clientDone = nil
+
+		case err := <-serverDone:
+			serverStream.SetTrailer(clientStream.Trailer())
+			if err == io.EOF {
+				return nil
+			}
+			return grpcError(err)
+		}
+	}
+}
+
+// startGRPCServer starts the gRPC listener, that accepts the calls of any
+// lnd service and forwards them over LNC. The connection is selected with
+// the same headers of the REST routes, sent as metadata.
+func startGRPCServer(pool *ConnectionPool, certs *certReloader, address string) (*grpc.Server, error) {
+	proxy := &grpcProxy{pool: pool}
+	var opts []grpc.ServerOption = []grpc.ServerOption{
+		grpc.ForceServerCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(proxy.handle),
+	}
+	if certs != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	server := grpc.NewServer(opts...)
+	go func() {
+		log.Infof("gRPC server starting at %v", address)
+		if err := server.Serve(listener); err != nil {
+			log.Errorf("Error running gRPC server: %v", err)
+		}
+	}()
+	return server, nil
+}
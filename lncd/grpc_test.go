@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// setTestSpendingStore replaces the spending store with an empty one and
+// sets the daily budget of each connection.
+func setTestSpendingStore(t *testing.T, dailyBudgetSat int64) {
+	configMutex.Lock()
+	previousBudget, previousEnforce := LNCD_SPEND_DAILY_BUDGET_SAT, LNCD_ENFORCE_PERMISSIONS
+	LNCD_SPEND_DAILY_BUDGET_SAT, LNCD_ENFORCE_PERMISSIONS = dailyBudgetSat, false
+	configMutex.Unlock()
+	previousStore := spendStore
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_SPEND_DAILY_BUDGET_SAT, LNCD_ENFORCE_PERMISSIONS = previousBudget, previousEnforce
+		configMutex.Unlock()
+		spendStore = previousStore
+	})
+	var err error
+	if spendStore, err = newSpendingStore(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// spentToday returns the amount counted in the daily budget of key.
+func spentToday(key string) int64 {
+	spendStore.mutex.Lock()
+	defer spendStore.mutex.Unlock()
+	return spendStore.total(key, time.Now())
+}
+
+// serveTestGRPC starts a gRPC server that passes every call to handler and
+// returns a client connection to it.
+func serveTestGRPC(t *testing.T, handler grpc.StreamHandler) *grpc.ClientConn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(handler))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := grpc.Dial(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newTestGRPCProxy returns a client of the gRPC listener, whose connection
+// for info forwards the calls to node.
+func newTestGRPCProxy(t *testing.T, info ConnectionInfo, node grpc.StreamHandler) lnrpc.LightningClient {
+	pool := NewConnectionPool()
+	conn := &Connection{connInfo: info, actions: make(chan Action, 1), grpcClient: serveTestGRPC(t, node), pool: pool}
+	pool.connections[ConnectionKey{info.Mailbox, info.PairingPhrase}] = conn
+	go conn.runLoop()
+	t.Cleanup(func() { close(conn.actions) })
+
+	proxy := &grpcProxy{pool: pool}
+	return lnrpc.NewLightningClient(serveTestGRPC(t, proxy.handle))
+}
+
+func withTestConnection(ctx context.Context, info ConnectionInfo) context.Context {
+	return metadata.AppendToOutgoingContext(ctx,
+		strings.ToLower(headerMailbox), info.Mailbox,
+		strings.ToLower(headerPairingPhrase), info.PairingPhrase,
+	)
+}
+
+func TestGRPCPaymentReservation(t *testing.T) {
+	tests := []struct {
+		name string
+		// response of the node, nil to wait until the call is canceled
+		response *lnrpc.SendResponse
+		cancel   bool
+		spent    int64
+	}{
+		// without a fee limit a payment of 1000 sat reserves 2000 sat
+		{"succeeded", &lnrpc.SendResponse{PaymentPreimage: []byte{1}}, false, 2000},
+		{"failed", &lnrpc.SendResponse{PaymentError: "no route"}, false, 0},
+		{"canceled by the client", nil, true, 2000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestSpendingStore(t, 10000)
+			info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "grpc " + test.name}
+			received, nodeDone := make(chan struct{}), make(chan struct{})
+			client := newTestGRPCProxy(t, info, func(_ interface{}, stream grpc.ServerStream) error {
+				defer close(nodeDone)
+				if err := stream.RecvMsg(&rawFrame{}); err != nil {
+					return err
+				}
+				close(received)
+				if test.response == nil {
+					// lnd keeps paying after the client is gone
+					<-stream.Context().Done()
+					return stream.Context().Err()
+				}
+				data, err := proto.Marshal(test.response)
+				if err != nil {
+					return err
+				}
+				return stream.SendMsg(&rawFrame{data})
+			})
+
+			ctx, cancel := context.WithCancel(withTestConnection(context.Background(), info))
+			defer cancel()
+			go func() {
+				<-received
+				if test.cancel {
+					cancel()
+				}
+			}()
+			_, err := client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: newTestPaymentRequest(t, 1000)})
+			if test.cancel != (err != nil) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			<-nodeDone
+			// the proxy ends the call after the node
+			time.Sleep(100 * time.Millisecond)
+
+			if spent := spentToday(connectionPolicyKey(info)); spent != test.spent {
+				t.Fatalf("expected %d sat to be counted, got %d", test.spent, spent)
+			}
+		})
+	}
+}
+
+func TestGRPCCanceledPaymentsExhaustBudget(t *testing.T) {
+	setTestSpendingStore(t, 3000)
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "grpc budget"}
+	received := make(chan struct{}, 2)
+	client := newTestGRPCProxy(t, info, func(_ interface{}, stream grpc.ServerStream) error {
+		if err := stream.RecvMsg(&rawFrame{}); err != nil {
+			return err
+		}
+		received <- struct{}{}
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	})
+
+	ctx, cancel := context.WithCancel(withTestConnection(context.Background(), info))
+	go func() {
+		<-received
+		cancel()
+	}()
+	client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: newTestPaymentRequest(t, 1000)})
+
+	// canceling doesn't refund the reservation, the next payment is over
+	// the budget
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel = context.WithTimeout(withTestConnection(context.Background(), info), 5*time.Second)
+	defer cancel()
+	_, err := client.SendPaymentSync(ctx, &lnrpc.SendRequest{PaymentRequest: newTestPaymentRequest(t, 1000)})
+	if err == nil || !strings.Contains(err.Error(), "daily budget exceeded") {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+	if len(received) != 0 {
+		t.Fatal("payment over the budget reached the node")
+	}
+}
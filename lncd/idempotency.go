@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentResponse is a response stored to be replayed to the retries of
+// a request.
+type idempotentResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type idempotencyEntry struct {
+	fingerprint [32]byte
+	// closed when the response is stored
+	done     chan struct{}
+	response *idempotentResponse
+	expires  time.Time
+}
+
+var (
+	idempotencyMutex     sync.Mutex
+	idempotencyEntries   = map[string]*idempotencyEntry{}
+	idempotencyLastPrune time.Time
+)
+
+// pruneIdempotencyEntries removes the expired responses, must be called
+// with the mutex held.
+func pruneIdempotencyEntries(now time.Time) {
+	if now.Sub(idempotencyLastPrune) < time.Minute {
+		return
+	}
+	idempotencyLastPrune = now
+	for key, entry := range idempotencyEntries {
+		if entry.response != nil && now.After(entry.expires) {
+			delete(idempotencyEntries, key)
+		}
+	}
+}
+
+// responseRecorder copies the response to the client and keeps it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(data)
+	return rec.ResponseWriter.Write(data)
+}
+
+func (response *idempotentResponse) replay(w http.ResponseWriter) {
+	for key, values := range response.header {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// isFinalStatus returns true for the responses that a retry would get again:
+// successes and the client errors that don't depend on timing. Server
+// errors, timeouts, conflicts and rate limits are only stored when a call
+// may have been executed by the node, otherwise the retry runs the request
+// again.
+func isFinalStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooEarly, http.StatusTooManyRequests:
+		return false
+	}
+	return status >= 200 && status < 500
+}
+
+type idempotencyContextKey struct{}
+
+// idempotencyState tracks the calls of a request with an idempotency key.
+type idempotencyState struct {
+	// a call failed with an error that is not final
+	notFinal atomic.Bool
+	// a call that is not read only was sent to the node
+	dispatched atomic.Bool
+}
+
+// recordCallError is called by the handlers that return the errors of their
+// calls in a successful response (batches and JSON-RPC): if the error is not
+// final, the response is handled like a server error.
+func recordCallError(ctx context.Context, err error) {
+	var code int = http.StatusInternalServerError
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code = statusErr.Code
+	}
+	if state, ok := ctx.Value(idempotencyContextKey{}).(*idempotencyState); ok && !isFinalStatus(code) {
+		state.notFinal.Store(true)
+	}
+}
+
+// markDispatched records that a call of method was sent to the node. If it
+// is not read only, the node may have executed it even when the call
+// fails, eg. when the LNC connection breaks after a payment was sent, so
+// the key is kept and the retries get the same error instead of running
+// the call again.
+func markDispatched(ctx context.Context, method string) {
+	if methodClass(method) == MethodClassRead {
+		return
+	}
+	if state, ok := ctx.Value(idempotencyContextKey{}).(*idempotencyState); ok {
+		state.dispatched.Store(true)
+	}
+}
+
+// idempotencyFingerprint identifies the request, so that a key reused for a
+// different request is refused.
+func idempotencyFingerprint(r *http.Request, body []byte) [32]byte {
+	hash := sha256.New()
+	for _, part := range []string{r.Method, r.URL.Path, r.Header.Get(headerSession), r.Header.Get(headerMailbox), r.Header.Get(headerPairingPhrase)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	hash.Write(body)
+	var fingerprint [32]byte
+	copy(fingerprint[:], hash.Sum(nil))
+	return fingerprint
+}
+
+// idempotencyMiddleware stores the response of the requests with an
+// Idempotency-Key header and returns it to the retries with the same key,
+// waiting for the first request if it is still running. Keys are scoped to
+// the identity of the caller.
+// Once started, the call is completed even if the client disconnects, so its
+// result is available to the retry.
+func idempotencyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configMutex.RLock()
+		ttl := LNCD_IDEMPOTENCY_TTL
+		configMutex.RUnlock()
+
+		var key string = r.Header.Get(idempotencyKeyHeader)
+		if key == "" || ttl <= 0 {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeJSONError(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		var identity *Identity = identityFromContext(r.Context())
+		var cacheKey string = identity.Name + "\x00" + key
+		var fingerprint [32]byte = idempotencyFingerprint(r, body)
+		var now time.Time = time.Now()
+
+		idempotencyMutex.Lock()
+		pruneIdempotencyEntries(now)
+		entry, ok := idempotencyEntries[cacheKey]
+		if ok && entry.response != nil && now.After(entry.expires) {
+			ok = false
+		}
+		if ok {
+			idempotencyMutex.Unlock()
+			if entry.fingerprint != fingerprint {
+				writeJSONError(w, "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			log.Infof("Replaying request with idempotency key %v for %v", key, identity.Name)
+			incMetric("idempotency_replays")
+			select {
+			case <-entry.done:
+				if entry.response == nil {
+					writeJSONError(w, "The original request did not complete, retry", http.StatusConflict)
+					return
+				}
+				entry.response.replay(w)
+			case <-r.Context().Done():
+			}
+			return
+		}
+		entry = &idempotencyEntry{
+			fingerprint: fingerprint,
+			done:        make(chan struct{}),
+		}
+		idempotencyEntries[cacheKey] = entry
+		idempotencyMutex.Unlock()
+
+		var state idempotencyState
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(context.WithValue(context.WithoutCancel(r.Context()), idempotencyContextKey{}, &state)))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		idempotencyMutex.Lock()
+		if !isFinalStatus(rec.status) || state.notFinal.Load() {
+			if !state.dispatched.Load() {
+				// the request failed before reaching the node, release
+				// the key so that the retry goes through
+				delete(idempotencyEntries, cacheKey)
+				idempotencyMutex.Unlock()
+				close(entry.done)
+				return
+			}
+			log.Infof("Keeping idempotency key %v for %v, the outcome of the request is unknown", key, identity.Name)
+			incMetric("idempotency_ambiguous")
+		}
+		entry.response = &idempotentResponse{
+			status: rec.status,
+			header: w.Header().Clone(),
+			body:   rec.body.Bytes(),
+		}
+		entry.expires = time.Now().Add(ttl)
+		idempotencyMutex.Unlock()
+		close(entry.done)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+func setTestIdempotencyTTL(t *testing.T, ttl time.Duration) {
+	configMutex.Lock()
+	previous := LNCD_IDEMPOTENCY_TTL
+	LNCD_IDEMPOTENCY_TTL = ttl
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_IDEMPOTENCY_TTL = previous
+		configMutex.Unlock()
+	})
+}
+
+func newIdempotentRequest(key string, body string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	r.Header.Set(idempotencyKeyHeader, key)
+	return r
+}
+
+// newTestPool returns a pool with a connection for info whose methods are
+// the ones of registry. The connection has no macaroon, the permissions are
+// not enforced.
+func newTestPool(t *testing.T, info ConnectionInfo, registry map[string]func(context.Context, *grpc.ClientConn, string, func(string, error))) *ConnectionPool {
+	configMutex.Lock()
+	previousEnforce := LNCD_ENFORCE_PERMISSIONS
+	LNCD_ENFORCE_PERMISSIONS = false
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_ENFORCE_PERMISSIONS = previousEnforce
+		configMutex.Unlock()
+	})
+
+	pool := NewConnectionPool()
+	conn := &Connection{connInfo: info, actions: make(chan Action, 1), registry: registry, pool: pool}
+	pool.connections[ConnectionKey{info.Mailbox, info.PairingPhrase}] = conn
+	go conn.runLoop()
+	t.Cleanup(func() { close(conn.actions) })
+	return pool
+}
+
+func TestIdempotencyKeyStorage(t *testing.T) {
+	setTestIdempotencyTTL(t, time.Minute)
+
+	tests := []struct {
+		name string
+		// method sent to the node before the request failed, if any
+		dispatched string
+		status     int
+		// error of a call of a batch, returned with a 200
+		callErr error
+		stored  bool
+	}{
+		{name: "success", dispatched: "lnrpc.Lightning.SendPaymentSync", status: http.StatusOK, stored: true},
+		{name: "client error", status: http.StatusBadRequest, stored: true},
+		{name: "rate limited", status: http.StatusTooManyRequests},
+		{name: "pool full", status: http.StatusServiceUnavailable},
+		{name: "payment interrupted", dispatched: "lnrpc.Lightning.SendPaymentSync", status: http.StatusBadGateway, stored: true},
+		{name: "payment timed out", dispatched: "routerrpc.Router.SendPaymentV2", status: http.StatusRequestTimeout, stored: true},
+		{name: "invoice interrupted", dispatched: "lnrpc.Lightning.AddInvoice", status: http.StatusInternalServerError, stored: true},
+		{name: "read interrupted", dispatched: "lnrpc.Lightning.GetInfo", status: http.StatusInternalServerError},
+		{name: "batch call interrupted", dispatched: "lnrpc.Lightning.SendPaymentSync", status: http.StatusOK, callErr: errors.New("connection reset"), stored: true},
+		{name: "batch call rate limited", status: http.StatusOK, callErr: newRateLimitedError(time.Second)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls int32
+			handler := idempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				if test.dispatched != "" {
+					markDispatched(r.Context(), test.dispatched)
+				}
+				if test.callErr != nil {
+					recordCallError(r.Context(), test.callErr)
+				}
+				w.WriteHeader(test.status)
+				w.Write([]byte(`{"attempt":1}`))
+			})
+
+			var key string = "key " + test.name
+			first := httptest.NewRecorder()
+			handler(first, newIdempotentRequest(key, `{"Method":"m"}`))
+			retry := httptest.NewRecorder()
+			handler(retry, newIdempotentRequest(key, `{"Method":"m"}`))
+
+			if test.stored {
+				if calls != 1 || retry.Header().Get("Idempotent-Replayed") != "true" {
+					t.Fatalf("expected the response to be replayed, the handler ran %d times", calls)
+				}
+				if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+					t.Fatalf("replayed %d %s, expected %d %s", retry.Code, retry.Body, first.Code, first.Body)
+				}
+			} else if calls != 2 {
+				t.Fatalf("expected the retry to run the request again, the handler ran %d times", calls)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyReusedForAnotherRequest(t *testing.T) {
+	setTestIdempotencyTTL(t, time.Minute)
+	handler := idempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+
+	handler(httptest.NewRecorder(), newIdempotentRequest("reused", `{"Method":"a"}`))
+	w := httptest.NewRecorder()
+	handler(w, newIdempotentRequest("reused", `{"Method":"b"}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", w.Code)
+	}
+}
+
+func TestIdempotencyRetryWaitsForTheRequest(t *testing.T) {
+	setTestIdempotencyTTL(t, time.Minute)
+
+	for _, dispatched := range []bool{true, false} {
+		started, finish := make(chan struct{}), make(chan struct{})
+		handler := idempotencyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-finish
+			if dispatched {
+				markDispatched(r.Context(), "lnrpc.Lightning.SendPaymentSync")
+			}
+			w.WriteHeader(http.StatusBadGateway)
+		})
+
+		var key string = "waiting"
+		if dispatched {
+			key = "waiting dispatched"
+		}
+		go handler(httptest.NewRecorder(), newIdempotentRequest(key, `{}`))
+		<-started
+		retried := make(chan *httptest.ResponseRecorder)
+		go func() {
+			w := httptest.NewRecorder()
+			handler(w, newIdempotentRequest(key, `{}`))
+			retried <- w
+		}()
+		time.Sleep(50 * time.Millisecond)
+		close(finish)
+
+		w := <-retried
+		if dispatched && w.Code != http.StatusBadGateway {
+			t.Fatalf("expected the error of the dispatched request, got %d", w.Code)
+		}
+		if !dispatched && w.Code != http.StatusConflict {
+			t.Fatalf("expected 409 for a request that failed before dispatch, got %d", w.Code)
+		}
+	}
+}
+
+func TestPoolCallMarksDispatchedCalls(t *testing.T) {
+	setTestSpendingStore(t, 0)
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "dispatch test"}
+	transportErr := func(_ context.Context, _ *grpc.ClientConn, _ string, cb func(string, error)) {
+		cb("", errors.New("transport is closing"))
+	}
+	pool := newTestPool(t, info, map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.SendPaymentSync": transportErr,
+		"lnrpc.Lightning.AddInvoice":      transportErr,
+		"lnrpc.Lightning.GetInfo":         transportErr,
+	})
+
+	tests := []struct {
+		name       string
+		method     string
+		payload    string
+		dispatched bool
+	}{
+		{"payment", "lnrpc.Lightning.SendPaymentSync", `{"payment_request":"` + newTestPaymentRequest(t, 1000) + `"}`, true},
+		{"invoice", "lnrpc.Lightning.AddInvoice", `{"value":1000}`, true},
+		{"read", "lnrpc.Lightning.GetInfo", `{}`, false},
+		{"invalid payment request", "lnrpc.Lightning.SendPaymentSync", `{"payment_request":"lnbc1invalid"}`, false},
+		{"unknown method", "lnrpc.Lightning.Unknown", `{}`, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state := &idempotencyState{}
+			ctx := context.WithValue(context.Background(), idempotencyContextKey{}, state)
+			if _, _, err := pool.call(ctx, info, "", anonymousIdentity, test.method, test.payload); err == nil {
+				t.Fatal("expected the call to fail")
+			}
+			if state.dispatched.Load() != test.dispatched {
+				t.Fatalf("expected dispatched to be %v", test.dispatched)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Networks that payment requests are decoded for, by LNCD_NETWORK name
+var networks = []struct {
+	name   string
+	params *chaincfg.Params
+}{
+	{"mainnet", &chaincfg.MainNetParams},
+	{"testnet", &chaincfg.TestNet3Params},
+	{"signet", &chaincfg.SigNetParams},
+	{"regtest", &chaincfg.RegressionNetParams},
+	{"simnet", &chaincfg.SimNetParams},
+}
+
+// chainParams returns the parameters of the network set in LNCD_NETWORK, or
+// nil if it is not set and the network of each node is used.
+func chainParams() (*chaincfg.Params, error) {
+	switch LNCD_NETWORK {
+	case "":
+		return nil, nil
+	case "mainnet", "bitcoin":
+		return &chaincfg.MainNetParams, nil
+	case "testnet", "testnet3", "testnet4":
+		return &chaincfg.TestNet3Params, nil
+	case "signet":
+		return &chaincfg.SigNetParams, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+	default:
+		return nil, fmt.Errorf("unknown network %q", LNCD_NETWORK)
+	}
+}
+
+func normalizePaymentRequest(payReq string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(payReq)), "lightning:")
+}
+
+// decodePaymentRequest decodes a BOLT11 invoice for the configured network,
+// or for any known network if LNCD_NETWORK is not set.
+func decodePaymentRequest(payReq string) (*zpay32.Invoice, error) {
+	params, err := chainParams()
+	if err != nil {
+		return nil, err
+	}
+	if params == nil {
+		invoice, _, err := decodeAnyPaymentRequest(payReq)
+		return invoice, err
+	}
+	return zpay32.Decode(normalizePaymentRequest(payReq), params)
+}
+
+// decodeAnyPaymentRequest decodes a BOLT11 invoice for any known network and
+// returns the name of its network.
+func decodeAnyPaymentRequest(payReq string) (*zpay32.Invoice, string, error) {
+	var err error
+	for _, network := range networks {
+		invoice, decodeErr := zpay32.Decode(normalizePaymentRequest(payReq), network.params)
+		if decodeErr == nil {
+			return invoice, network.name, nil
+		}
+		if err == nil {
+			err = decodeErr
+		}
+	}
+	return nil, "", err
+}
+
+// nodeNetworkName returns the name of a network reported by GetInfo, as
+// used to decode payment requests. Testnet4 invoices have the testnet
+// prefix.
+func nodeNetworkName(network string) string {
+	switch network {
+	case "testnet3", "testnet4":
+		return "testnet"
+	}
+	return network
+}
+
+func networkName(params *chaincfg.Params) string {
+	for _, network := range networks {
+		if network.params == params {
+			return network.name
+		}
+	}
+	return params.Name
+}
+
+// RouteHintHop is a hop of a route hint of a decoded invoice.
+type RouteHintHop struct {
+	NodeID                    string
+	ChannelID                 uint64
+	FeeBaseMsat               uint32
+	FeeProportionalMillionths uint32
+	CltvExpiryDelta           uint16
+}
+
+// DecodedInvoice is the result of the decodeInvoice built-in. WrongNetwork
+// is set if LNCD_NETWORK is set and the invoice is not for it.
+type DecodedInvoice struct {
+	Network            string
+	WrongNetwork       bool
+	Destination        string
+	PaymentHash        string
+	PaymentAddr        string `json:",omitempty"`
+	AmountMsat         *int64 `json:",omitempty"`
+	Description        string `json:",omitempty"`
+	DescriptionHash    string `json:",omitempty"`
+	Timestamp          time.Time
+	ExpiresAt          time.Time
+	Expired            bool
+	MinFinalCltvExpiry uint64
+	FallbackAddress    string `json:",omitempty"`
+	RouteHints         [][]RouteHintHop
+}
+
+func newDecodedInvoice(invoice *zpay32.Invoice, network string) *DecodedInvoice {
+	expected := configuredNetwork()
+	decoded := &DecodedInvoice{
+		Network:            network,
+		WrongNetwork:       expected != "" && network != expected,
+		Timestamp:          invoice.Timestamp,
+		ExpiresAt:          invoice.Timestamp.Add(invoice.Expiry()),
+		Expired:            time.Now().After(invoice.Timestamp.Add(invoice.Expiry())),
+		MinFinalCltvExpiry: invoice.MinFinalCLTVExpiry(),
+		RouteHints:         [][]RouteHintHop{},
+	}
+	if invoice.Destination != nil {
+		decoded.Destination = hex.EncodeToString(invoice.Destination.SerializeCompressed())
+	}
+	if invoice.PaymentHash != nil {
+		decoded.PaymentHash = hex.EncodeToString(invoice.PaymentHash[:])
+	}
+	if invoice.PaymentAddr != nil {
+		decoded.PaymentAddr = hex.EncodeToString(invoice.PaymentAddr[:])
+	}
+	if invoice.MilliSat != nil {
+		amount := int64(*invoice.MilliSat)
+		decoded.AmountMsat = &amount
+	}
+	if invoice.Description != nil {
+		decoded.Description = *invoice.Description
+	}
+	if invoice.DescriptionHash != nil {
+		decoded.DescriptionHash = hex.EncodeToString(invoice.DescriptionHash[:])
+	}
+	if invoice.FallbackAddr != nil {
+		decoded.FallbackAddress = invoice.FallbackAddr.String()
+	}
+	for _, hint := range invoice.RouteHints {
+		var hops []RouteHintHop = make([]RouteHintHop, 0, len(hint))
+		for _, hop := range hint {
+			hops = append(hops, RouteHintHop{
+				NodeID:                    hex.EncodeToString(hop.NodeID.SerializeCompressed()),
+				ChannelID:                 hop.ChannelID,
+				FeeBaseMsat:               hop.FeeBaseMSat,
+				FeeProportionalMillionths: hop.FeeProportionalMillionths,
+				CltvExpiryDelta:           hop.CLTVExpiryDelta,
+			})
+		}
+		decoded.RouteHints = append(decoded.RouteHints, hops)
+	}
+	return decoded
+}
+
+// configuredNetwork returns the name of the network set in LNCD_NETWORK, that
+// is validated on startup, or "" if it is not set.
+func configuredNetwork() string {
+	params, err := chainParams()
+	if err != nil || params == nil {
+		return ""
+	}
+	return networkName(params)
+}
+
+// network returns the network that the payment requests paid by the
+// connection must be for: LNCD_NETWORK if set, otherwise the network of the
+// node, asked with GetInfo the first time it is needed. It returns "" if the
+// network of the node can't be determined.
+func (conn *Connection) network() string {
+	if network := configuredNetwork(); network != "" {
+		return network
+	}
+	conn.nodeNetworkOnce.Do(func() {
+		info := &lnrpc.GetInfoResponse{}
+		if err := conn.callProto("lnrpc.Lightning.GetInfo", "{}", info); err != nil {
+			log.Infof("Unable to get the network of the node, payment requests are not checked against it: %v", err)
+			return
+		}
+		if len(info.Chains) > 0 {
+			conn.nodeNetwork = nodeNetworkName(info.Chains[0].Network)
+		}
+	})
+	return conn.nodeNetwork
+}
+
+// decodeInvoice is the decodeInvoice built-in, it decodes the invoice in
+// the {"pay_req": "..."} payload without calling the node.
+func decodeInvoice(payload string) (string, error) {
+	var request struct {
+		PayReq string `json:"pay_req"`
+	}
+	if err := json.Unmarshal([]byte(payload), &request); err != nil || request.PayReq == "" {
+		return "", &StatusError{Code: http.StatusBadRequest, Message: `payload must be {"pay_req": "<invoice>"}`}
+	}
+	invoice, network, err := decodeAnyPaymentRequest(request.PayReq)
+	if err != nil {
+		return "", &StatusError{Code: http.StatusBadRequest, Message: "invalid payment request: " + err.Error()}
+	}
+	result, err := json.Marshal(newDecodedInvoice(invoice, network))
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+// paymentRequestOf returns the payment request paid by a payment method, or
+// "" if the method doesn't pay a payment request.
+func paymentRequestOf(method string, payload string) string {
+	var req interface {
+		proto.Message
+		GetPaymentRequest() string
+	}
+	switch method {
+	case "lnrpc.Lightning.SendPayment", "lnrpc.Lightning.SendPaymentSync":
+		req = &lnrpc.SendRequest{}
+	case "routerrpc.Router.SendPaymentV2":
+		req = &routerrpc.SendPaymentRequest{}
+	default:
+		return ""
+	}
+	if strings.TrimSpace(payload) == "" {
+		return ""
+	}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal([]byte(payload), req); err != nil {
+		return ""
+	}
+	return req.GetPaymentRequest()
+}
+
+// validatePayment rejects the payments of invoices that are expired or for
+// another network than the one of the node before they are sent to it.
+func validatePayment(conn *Connection, method string, payload string) error {
+	configMutex.RLock()
+	validate := LNCD_VALIDATE_PAYMENT_REQUESTS
+	configMutex.RUnlock()
+	if !validate {
+		return nil
+	}
+	payReq := paymentRequestOf(method, payload)
+	if payReq == "" {
+		return nil
+	}
+
+	invoice, network, err := decodeAnyPaymentRequest(payReq)
+	if err != nil {
+		return &StatusError{Code: http.StatusBadRequest, Message: "invalid payment request: " + err.Error()}
+	}
+	if expected := conn.network(); expected != "" && network != expected {
+		incMetric("invalid_payment_requests")
+		return &StatusError{Code: http.StatusBadRequest, Message: fmt.Sprintf("payment request is for %v, expected %v", network, expected)}
+	}
+	if expiresAt := invoice.Timestamp.Add(invoice.Expiry()); time.Now().After(expiresAt) {
+		incMetric("invalid_payment_requests")
+		return &StatusError{Code: http.StatusBadRequest, Message: fmt.Sprintf("payment request expired at %v", expiresAt.UTC().Format(time.RFC3339))}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const (
+	invoiceStreamMinBackoff = time.Second
+	invoiceStreamMaxBackoff = time.Minute
+	// invoices listed to find the settle index of the node
+	settleIndexPageSize = 100
+)
+
+// invoiceListener is called for every invoice update received on a stream.
+type invoiceListener func(info ConnectionInfo, invoice *lnrpc.Invoice)
+
+// invoiceStream is a SubscribeInvoices stream kept open on a pooled
+// connection for as long as it has listeners, so every consumer of invoice
+// updates for a node shares a single upstream subscription.
+type invoiceStream struct {
+	info      ConnectionInfo
+	listeners map[uint64]invoiceListener
+	// last settle index received, to replay the settlements missed while
+	// reconnecting
+	settleIndex uint64
+	cancel      context.CancelFunc
+}
+
+// InvoiceStreams manages the invoice streams of the pool.
+type InvoiceStreams struct {
+	pool           *ConnectionPool
+	streams        map[ConnectionKey]*invoiceStream
+	nextListenerID uint64
+	mutex          sync.Mutex
+}
+
+var invoiceStreams *InvoiceStreams
+
+func NewInvoiceStreams(pool *ConnectionPool) *InvoiceStreams {
+	return &InvoiceStreams{
+		pool:    pool,
+		streams: make(map[ConnectionKey]*invoiceStream),
+	}
+}
+
+// subscribe adds a listener to the stream of the connection, opening it if
+// needed. The returned function removes the listener, and closes the
+// stream when it was the last one.
+func (streams *InvoiceStreams) subscribe(info ConnectionInfo, listener invoiceListener) func() {
+	return streams.subscribeFrom(info, 0, listener)
+}
+
+// subscribeFrom is subscribe for a listener that already received the
+// settlements up to settleIndex: if the stream is opened, the settlements
+// after it are replayed.
+func (streams *InvoiceStreams) subscribeFrom(info ConnectionInfo, settleIndex uint64, listener invoiceListener) func() {
+	var key ConnectionKey = ConnectionKey{info.Mailbox, info.PairingPhrase}
+
+	streams.mutex.Lock()
+	defer streams.mutex.Unlock()
+
+	stream, ok := streams.streams[key]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &invoiceStream{
+			info:        info,
+			listeners:   make(map[uint64]invoiceListener),
+			settleIndex: settleIndex,
+			cancel:      cancel,
+		}
+		streams.streams[key] = stream
+		go streams.run(ctx, stream)
+	}
+
+	streams.nextListenerID++
+	var id uint64 = streams.nextListenerID
+	stream.listeners[id] = listener
+
+	return func() {
+		streams.mutex.Lock()
+		defer streams.mutex.Unlock()
+		delete(stream.listeners, id)
+		if len(stream.listeners) == 0 && streams.streams[key] == stream {
+			log.Infof("Closing invoice stream for %v", info.Mailbox)
+			stream.cancel()
+			delete(streams.streams, key)
+		}
+	}
+}
+
+// run keeps the stream open, reconnecting with an exponential backoff,
+// until it is canceled.
+func (streams *InvoiceStreams) run(ctx context.Context, stream *invoiceStream) {
+	var backoff time.Duration = invoiceStreamMinBackoff
+	for {
+		connected, err := streams.receive(ctx, stream)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = invoiceStreamMinBackoff
+		}
+		log.Infof("Invoice stream interrupted, reconnecting in %v: %v", backoff, err)
+		incMetric("invoice_stream_reconnects")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > invoiceStreamMaxBackoff {
+			backoff = invoiceStreamMaxBackoff
+		}
+	}
+}
+
+// receive opens the subscription and dispatches the updates until it fails.
+// It returns true if the subscription was established.
+func (streams *InvoiceStreams) receive(ctx context.Context, stream *invoiceStream) (bool, error) {
+	streams.mutex.Lock()
+	info, settleIndex := stream.info, stream.settleIndex
+	streams.mutex.Unlock()
+
+	conn, err := streams.pool.acquire(ctx, info, anonymousIdentity, "lnrpc.Lightning.SubscribeInvoices")
+	if err != nil {
+		return false, err
+	}
+	defer conn.release()
+
+	// keep the keys negotiated by the connection, to reconnect with the
+	// same pairing
+	info = conn.connInfo
+	streams.mutex.Lock()
+	stream.info = info
+	streams.mutex.Unlock()
+	if sessions != nil {
+		sessions.updateConnectionKeys(info)
+	}
+	if subscriptions != nil {
+		subscriptions.updateConnectionKeys(info)
+	}
+
+	client := lnrpc.NewLightningClient(conn.grpcClient)
+	updates, err := client.SubscribeInvoices(ctx, &lnrpc.InvoiceSubscription{
+		SettleIndex: settleIndex,
+	})
+	if err != nil {
+		return false, err
+	}
+	log.Infof("Invoice stream open for %v", info.Mailbox)
+
+	for {
+		invoice, err := updates.Recv()
+		if err != nil {
+			return true, err
+		}
+		log.Debugf("Invoice update %x: %v", invoice.RHash, invoice.State)
+
+		streams.mutex.Lock()
+		if invoice.SettleIndex > stream.settleIndex {
+			stream.settleIndex = invoice.SettleIndex
+		}
+		var listeners []invoiceListener = make([]invoiceListener, 0, len(stream.listeners))
+		for _, listener := range stream.listeners {
+			listeners = append(listeners, listener)
+		}
+		streams.mutex.Unlock()
+
+		for _, listener := range listeners {
+			listener(info, invoice)
+		}
+	}
+}
+
+// lastSettleIndex returns the highest settle index of the last invoices of
+// the node, the settlements up to it happened before the caller subscribed.
+func (streams *InvoiceStreams) lastSettleIndex(ctx context.Context, info ConnectionInfo, identity *Identity) (uint64, error) {
+	// settle indexes follow the settlements, not the creation of the
+	// invoices: an old invoice settled recently is outside of the page
+	payload := fmt.Sprintf(`{"reversed": true, "num_max_invoices": %d}`, settleIndexPageSize)
+	// a cached response could miss the last settlements
+	ctx = withCacheMode(ctx, cacheRevalidate)
+	_, result, err := streams.pool.call(ctx, info, "", identity, "lnrpc.Lightning.ListInvoices", payload)
+	if err != nil {
+		return 0, err
+	}
+	response := &lnrpc.ListInvoiceResponse{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal([]byte(result), response); err != nil {
+		return 0, err
+	}
+	var settleIndex uint64
+	for _, invoice := range response.Invoices {
+		settleIndex = max(settleIndex, invoice.SettleIndex)
+	}
+	return settleIndex, nil
+}
+
+// invoiceJSON encodes an invoice in the same format of the JSON callbacks.
+func invoiceJSON(invoice *lnrpc.Invoice) (json.RawMessage, error) {
+	return protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}.Marshal(invoice)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+const defaultInvoiceWaitTimeout = time.Minute
+
+// InvoiceWaitResponse is the response of the invoice wait endpoint. State is
+// the last known state of the invoice, TimedOut is set if it didn't reach a
+// final state in time.
+type InvoiceWaitResponse struct {
+	State    string
+	TimedOut bool
+	Invoice  json.RawMessage
+}
+
+// parsePaymentHash accepts a payment hash encoded as hex or base64.
+func parsePaymentHash(value string) ([]byte, error) {
+	if hash, err := hex.DecodeString(value); err == nil && len(hash) == 32 {
+		return hash, nil
+	}
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if hash, err := encoding.DecodeString(value); err == nil && len(hash) == 32 {
+			return hash, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid payment hash %q", value)
+}
+
+func isFinalInvoiceState(state lnrpc.Invoice_InvoiceState) bool {
+	return state == lnrpc.Invoice_SETTLED || state == lnrpc.Invoice_CANCELED
+}
+
+// lookupInvoice returns the current invoice through the pool.
+func lookupInvoice(r *http.Request, pool *ConnectionPool, info ConnectionInfo, sessionID string, identity *Identity, hash []byte) (*lnrpc.Invoice, error) {
+	payload := fmt.Sprintf(`{"r_hash_str": %q}`, hex.EncodeToString(hash))
+	// a cached response could hide the settlement
+	ctx := withCacheMode(r.Context(), cacheRevalidate)
+	_, result, err := pool.call(ctx, info, sessionID, identity, "lnrpc.Lightning.LookupInvoice", payload)
+	if err != nil {
+		return nil, err
+	}
+	invoice := &lnrpc.Invoice{}
+	if err := (protojson.UnmarshalOptions{DiscardUnknown: true}).Unmarshal([]byte(result), invoice); err != nil {
+		return nil, err
+	}
+	return invoice, nil
+}
+
+// invoiceWaitHandler blocks until the invoice with the payment hash in the
+// path is settled or canceled, or until the timeout (?timeout=30s) expires.
+// Waiters share the invoice stream of the node with the webhook
+// subscriptions, the connection is selected with the headers of the REST
+// routes.
+func invoiceWaitHandler(pool *ConnectionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, err := parsePaymentHash(r.PathValue("hash"))
+		if err != nil {
+			writeJSONError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		configMutex.RLock()
+		maxTimeout := LNCD_INVOICE_WAIT_MAX_TIMEOUT
+		configMutex.RUnlock()
+		var timeout time.Duration = min(defaultInvoiceWaitTimeout, maxTimeout)
+		if value := r.URL.Query().Get("timeout"); value != "" {
+			if timeout, err = time.ParseDuration(value); err != nil || timeout < 0 {
+				writeJSONError(w, "invalid timeout", http.StatusBadRequest)
+				return
+			}
+			timeout = min(timeout, maxTimeout)
+		}
+
+		var identity *Identity = identityFromContext(r.Context())
+		var sessionID string = r.Header.Get(headerSession)
+		info, err := resolveConnection(identity, sessionID, ConnectionInfo{
+			Mailbox:       r.Header.Get(headerMailbox),
+			PairingPhrase: r.Header.Get(headerPairingPhrase),
+			LocalKey:      r.Header.Get(headerLocalKey),
+			RemoteKey:     r.Header.Get(headerRemoteKey),
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if info.Mailbox == "" || info.PairingPhrase == "" {
+			writeJSONError(w, "either "+headerSession+" or "+headerMailbox+" and "+headerPairingPhrase+" headers are required", http.StatusBadRequest)
+			return
+		}
+		if err := authorizeMethod(identity, "lnrpc.Lightning.SubscribeInvoices"); err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := authorizeCall(identity, info, "lnrpc.Lightning.LookupInvoice"); err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Infof("Waiting for invoice %x for %v (timeout %v)", hash, identity.Name, timeout)
+
+		// listen before looking up the invoice, so no update is lost
+		var updates chan *lnrpc.Invoice = make(chan *lnrpc.Invoice, 1)
+		unsubscribe := invoiceStreams.subscribe(info, func(_ ConnectionInfo, invoice *lnrpc.Invoice) {
+			if bytes.Equal(invoice.RHash, hash) && isFinalInvoiceState(invoice.State) {
+				select {
+				case updates <- invoice:
+				default:
+				}
+			}
+		})
+		defer unsubscribe()
+
+		invoice, err := lookupInvoice(r, pool, info, sessionID, identity, hash)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		var timedOut bool
+		if !isFinalInvoiceState(invoice.State) {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			select {
+			case invoice = <-updates:
+			case <-timer.C:
+				// the stream may have been opened after the update, so
+				// check the invoice once more
+				if invoice, err = lookupInvoice(r, pool, info, sessionID, identity, hash); err != nil {
+					writeError(w, err)
+					return
+				}
+				timedOut = !isFinalInvoiceState(invoice.State)
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		invoiceData, err := invoiceJSON(invoice)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(InvoiceWaitResponse{
+			State:    invoice.State.String(),
+			TimedOut: timedOut,
+			Invoice:  invoiceData,
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// Job is a call executed in the background for an async /rpc request.
+type Job struct {
+	ID       string
+	Method   string
+	Status   string
+	Created  time.Time
+	Finished *time.Time `json:",omitempty"`
+	// Set when the job succeeds, unless the call used a session. The
+	// webhooks only get the mailbox and the status
+	Connection *ConnectionInfo `json:",omitempty"`
+	// Last intermediate result reported while the job runs, eg. the
+	// invoice created by createInvoiceAndWait
+	Progress json.RawMessage `json:",omitempty"`
+	Result   json.RawMessage `json:",omitempty"`
+	Error    string          `json:",omitempty"`
+	// HTTP status that the call would have returned if it was synchronous
+	Code int `json:",omitempty"`
+	// Secret that signs the webhook deliveries, only returned when the job
+	// is created
+	WebhookSecret string `json:",omitempty"`
+	owner         string
+}
+
+// JobStore keeps the jobs in memory until their retention expires.
+type JobStore struct {
+	jobs      map[string]*Job
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+var jobs = &JobStore{jobs: make(map[string]*Job)}
+
+// prune removes the finished jobs older than the retention, must be called
+// with the mutex held.
+func (store *JobStore) prune(now time.Time) {
+	if now.Sub(store.lastPrune) < time.Minute {
+		return
+	}
+	store.lastPrune = now
+
+	configMutex.RLock()
+	retention := LNCD_JOB_RETENTION
+	configMutex.RUnlock()
+	for id, job := range store.jobs {
+		if job.Finished != nil && now.Sub(*job.Finished) > retention {
+			delete(store.jobs, id)
+		}
+	}
+}
+
+func (store *JobStore) create(owner *Identity, method string) (*Job, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{
+		ID:      id,
+		Method:  method,
+		Status:  JobRunning,
+		Created: time.Now(),
+		owner:   owner.Name,
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune(job.Created)
+	store.jobs[id] = job
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+// finish stores the outcome of the job and returns a copy of it.
+func (store *JobStore) finish(id string, connection *ConnectionInfo, result json.RawMessage, err error) *Job {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[id]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	job.Finished = &now
+	job.Connection = connection
+	if err != nil {
+		job.Status = JobFailed
+		job.Error = err.Error()
+		job.Code = http.StatusInternalServerError
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			job.Code = statusErr.Code
+		}
+	} else {
+		job.Status = JobSucceeded
+		job.Result = result
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
+// progress stores an intermediate result of the running job and returns a
+// copy of it.
+func (store *JobStore) progress(id string, result json.RawMessage) *Job {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	job, ok := store.jobs[id]
+	if !ok || job.Status != JobRunning {
+		return nil
+	}
+	job.Progress = result
+	jobCopy := *job
+	return &jobCopy
+}
+
+// get returns a copy of the job if it is owned by identity.
+func (store *JobStore) get(id string, identity *Identity) (*Job, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.prune(time.Now())
+	job, ok := store.jobs[id]
+	if !ok || job.owner != identity.Name {
+		return nil, &StatusError{Code: http.StatusNotFound, Message: "Job not found"}
+	}
+	jobCopy := *job
+	return &jobCopy, nil
+}
+
+type progressContextKey struct{}
+
+// withProgress sets the callback that receives the intermediate results of
+// the calls made with the context.
+func withProgress(ctx context.Context, onProgress func(string)) context.Context {
+	return context.WithValue(ctx, progressContextKey{}, onProgress)
+}
+
+func progressFromContext(ctx context.Context) func(string) {
+	onProgress, _ := ctx.Value(progressContextKey{}).(func(string))
+	return onProgress
+}
+
+// postJob sends the job to its webhook, without the pairing phrase and the
+// keys of the connection: the deliveries can end up in the dead letter log.
+func postJob(webhook string, secret string, job *Job, event string) {
+	if job == nil || webhook == "" {
+		return
+	}
+	if job.Connection != nil {
+		connection := publicConnection(*job.Connection)
+		job.Connection = &connection
+	}
+	body, err := json.Marshal(job)
+	if err != nil {
+		log.Errorf("Unable to encode job %v: %v", job.ID, err)
+		return
+	}
+	sendWebhook(webhook, body, secret, event)
+}
+
+// startJob executes the call in the background and returns the job that
+// tracks it. Intermediate results are POSTed to its webhook as they are
+// reported, and the job when the call completes. If secret is not set, a
+// random one is generated and returned with the job.
+func startJob(pool *ConnectionPool, identity *Identity, info ConnectionInfo, sessionID string, method string, payload string, typedResult bool, webhook string, secret string) (*Job, error) {
+	if webhook != "" && secret == "" {
+		var err error
+		if secret, err = newRandomID(); err != nil {
+			return nil, err
+		}
+	}
+	job, err := jobs.create(identity, method)
+	if err != nil {
+		return nil, err
+	}
+	if webhook != "" {
+		job.WebhookSecret = secret
+	}
+	log.Infof("Job %v started for %v by %v", job.ID, method, identity.Name)
+
+	ctx := withProgress(context.Background(), func(result string) {
+		postJob(webhook, secret, jobs.progress(job.ID, formatResult(result, typedResult)), "job.progress")
+	})
+	go func() {
+		info, result, err := pool.call(ctx, info, sessionID, identity, method, payload)
+		var finished *Job
+		if err != nil {
+			log.Infof("Job %v failed: %v", job.ID, err)
+			finished = jobs.finish(job.ID, nil, nil, err)
+		} else {
+			log.Infof("Job %v completed", job.ID)
+			var connection *ConnectionInfo
+			if sessionID == "" {
+				connection = &info
+			}
+			finished = jobs.finish(job.ID, connection, formatResult(result, typedResult), nil)
+		}
+		postJob(webhook, secret, finished, "job.finished")
+	}()
+	return job, nil
+}
+
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	job, err := jobs.get(r.PathValue("id"), identityFromContext(r.Context()))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"google.golang.org/grpc/status"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	jsonRpcParseError     = -32700
+	jsonRpcInvalidRequest = -32600
+	jsonRpcMethodNotFound = -32601
+	jsonRpcInvalidParams  = -32602
+	// Errors returned by the daemon or by the node, the gRPC code is in
+	// the error data
+	jsonRpcServerError = -32000
+)
+
+type JsonRpcRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type JsonRpcResponse struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JsonRpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type JsonRpcError struct {
+	Code    int                    `json:"code"`
+	Message string                 `json:"message"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// isNotification returns true if the request has no id, so it doesn't get
+// a response.
+func (request *JsonRpcRequest) isNotification() bool {
+	return len(request.ID) == 0
+}
+
+// newJsonRpcServerError converts an error of the daemon or of the node to a
+// JSON-RPC error carrying the gRPC code.
+func newJsonRpcServerError(err error) *JsonRpcError {
+	st := status.Convert(grpcError(err))
+	var data map[string]interface{} = map[string]interface{}{
+		"grpc_code":   int(st.Code()),
+		"grpc_status": st.Code().String(),
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for key, value := range statusErr.Details {
+			data[key] = value
+		}
+	}
+	return &JsonRpcError{
+		Code:    jsonRpcServerError,
+		Message: st.Message(),
+		Data:    data,
+	}
+}
+
+// validateJsonRpcRequest checks the request and returns the payload for the
+// method, or the error to respond with.
+func validateJsonRpcRequest(request *JsonRpcRequest) (string, *JsonRpcError) {
+	if request.Jsonrpc != "2.0" || request.Method == "" {
+		return "", &JsonRpcError{Code: jsonRpcInvalidRequest, Message: "Invalid Request"}
+	}
+	if !isKnownMethod(request.Method) {
+		return "", &JsonRpcError{Code: jsonRpcMethodNotFound, Message: "Method not found"}
+	}
+	params := bytes.TrimSpace(request.Params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return "", nil
+	}
+	if params[0] != '{' && params[0] != '[' {
+		return "", &JsonRpcError{Code: jsonRpcInvalidParams, Message: "Invalid params"}
+	}
+	return string(params), nil
+}
+
+// jsonRpcHandler implements JSON-RPC 2.0 over the registered methods. The
+// params of a request are the payload of the method. The connection is
+// selected with the same headers of the REST routes, so all the requests of
+// a batch share one connection and are executed in order.
+func jsonRpcHandler(pool *ConnectionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		if r.Method != http.MethodPost {
+			writeJSONError(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var body json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJsonRpc(w, JsonRpcResponse{
+				Jsonrpc: "2.0",
+				Error:   &JsonRpcError{Code: jsonRpcParseError, Message: "Parse error"},
+				ID:      json.RawMessage("null"),
+			})
+			return
+		}
+
+		var requests []*JsonRpcRequest
+		var isBatch bool = bytes.HasPrefix(bytes.TrimSpace(body), []byte("["))
+		if isBatch {
+			var items []json.RawMessage
+			if err := json.Unmarshal(body, &items); err != nil || len(items) == 0 {
+				writeJsonRpc(w, JsonRpcResponse{
+					Jsonrpc: "2.0",
+					Error:   &JsonRpcError{Code: jsonRpcInvalidRequest, Message: "Invalid Request"},
+					ID:      json.RawMessage("null"),
+				})
+				return
+			}
+			for _, item := range items {
+				request := &JsonRpcRequest{}
+				if err := json.Unmarshal(item, request); err != nil {
+					// respond to malformed items with an invalid request error
+					request = &JsonRpcRequest{ID: json.RawMessage("null")}
+				}
+				requests = append(requests, request)
+			}
+		} else {
+			request := &JsonRpcRequest{}
+			if err := json.Unmarshal(body, request); err != nil {
+				request = &JsonRpcRequest{ID: json.RawMessage("null")}
+			}
+			requests = append(requests, request)
+		}
+
+		var identity *Identity = identityFromContext(r.Context())
+		var sessionID string = r.Header.Get(headerSession)
+		// without a connection, each request gets an invalid params error
+		var connectionErr *JsonRpcError
+		info, err := resolveConnection(identity, sessionID, ConnectionInfo{
+			Mailbox:       r.Header.Get(headerMailbox),
+			PairingPhrase: r.Header.Get(headerPairingPhrase),
+			LocalKey:      r.Header.Get(headerLocalKey),
+			RemoteKey:     r.Header.Get(headerRemoteKey),
+		})
+		if err != nil {
+			log.Infof("Unable to resolve the JSON-RPC connection: %v", err)
+			connectionErr = &JsonRpcError{Code: jsonRpcInvalidParams, Message: err.Error()}
+		} else if info.Mailbox == "" || info.PairingPhrase == "" {
+			connectionErr = &JsonRpcError{
+				Code:    jsonRpcInvalidParams,
+				Message: "either " + headerSession + " or " + headerMailbox + " and " + headerPairingPhrase + " headers are required",
+			}
+		}
+		log.Infof("Incoming JSON-RPC request: %d calls from %v (%v)", len(requests), identity.Name, r.RemoteAddr)
+
+		var responses []*JsonRpcResponse = make([]*JsonRpcResponse, len(requests))
+		var calls []batchCall
+		var callIndexes []int
+		for i, request := range requests {
+			responses[i] = &JsonRpcResponse{Jsonrpc: "2.0", ID: request.ID}
+			if responses[i].ID == nil {
+				responses[i].ID = json.RawMessage("null")
+			}
+
+			payload, rpcErr := validateJsonRpcRequest(request)
+			if rpcErr != nil {
+				responses[i].Error = rpcErr
+				continue
+			}
+			if connectionErr != nil {
+				responses[i].Error = connectionErr
+				continue
+			}
+			if err := authorizeCall(identity, info, request.Method); err != nil {
+				log.Infof("Refusing method %v: %v", request.Method, err)
+				responses[i].Error = newJsonRpcServerError(err)
+				continue
+			}
+			calls = append(calls, batchCall{method: request.Method, payload: payload})
+			callIndexes = append(callIndexes, i)
+		}
+
+		if len(calls) > 0 {
+			results := pool.callBatch(r.Context(), info, sessionID, identity, calls, false)
+			for i, result := range results {
+				var response *JsonRpcResponse = responses[callIndexes[i]]
+				if result.err != nil {
+					recordCallError(r.Context(), result.err)
+					response.Error = newJsonRpcServerError(result.err)
+					continue
+				}
+				response.Result = formatResult(result.result, true)
+				info = result.info
+			}
+		}
+
+		if sessionID == "" && info.LocalKey != "" {
+			w.Header().Set(headerLocalKey, info.LocalKey)
+			w.Header().Set(headerRemoteKey, info.RemoteKey)
+		}
+
+		// notifications don't get a response, unless they are invalid
+		var output []*JsonRpcResponse
+		for i, request := range requests {
+			invalid := responses[i].Error != nil && responses[i].Error.Code == jsonRpcInvalidRequest
+			if !request.isNotification() || invalid {
+				output = append(output, responses[i])
+			}
+		}
+		if len(output) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if isBatch {
+			writeJsonRpc(w, output)
+		} else {
+			writeJsonRpc(w, output[0])
+		}
+	}
+}
+
+func writeJsonRpc(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+func TestJsonRpcHandler(t *testing.T) {
+	previousSessions := sessions
+	t.Cleanup(func() { sessions = previousSessions })
+	var err error
+	if sessions, err = NewSessionStore(""); err != nil {
+		t.Fatal(err)
+	}
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "jsonrpc test"}
+	pool := newTestPool(t, info, map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.GetInfo": func(_ context.Context, _ *grpc.ClientConn, _ string, cb func(string, error)) {
+			cb(`{"alias":"node"}`, nil)
+		},
+	})
+	connection := map[string]string{headerMailbox: info.Mailbox, headerPairingPhrase: info.PairingPhrase}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		// code of the error of each response, 0 for a result
+		codes []int
+		ids   []string
+	}{
+		{
+			name:    "call",
+			headers: connection,
+			body:    `{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo","id":1}`,
+			codes:   []int{0},
+			ids:     []string{"1"},
+		},
+		{
+			name:  "missing headers",
+			body:  `{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo","id":1}`,
+			codes: []int{jsonRpcInvalidParams},
+			ids:   []string{"1"},
+		},
+		{
+			name:    "unknown session",
+			headers: map[string]string{headerSession: "unknown"},
+			body:    `{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo","id":"a"}`,
+			codes:   []int{jsonRpcInvalidParams},
+			ids:     []string{`"a"`},
+		},
+		{
+			name:  "missing headers in a batch",
+			body:  `[{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo","id":1},{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo"},{"jsonrpc":"2.0","method":"lnrpc.Lightning.Unknown","id":2},1,{"jsonrpc":"2.0","method":"lnrpc.Lightning.GetInfo","id":3}]`,
+			codes: []int{jsonRpcInvalidParams, jsonRpcMethodNotFound, jsonRpcInvalidRequest, jsonRpcInvalidParams},
+			ids:   []string{"1", "2", "null", "3"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/jsonrpc", strings.NewReader(test.body))
+			for key, value := range test.headers {
+				r.Header.Set(key, value)
+			}
+			w := httptest.NewRecorder()
+			jsonRpcHandler(pool)(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d %s", w.Code, w.Body)
+			}
+
+			var responses []JsonRpcResponse
+			if strings.HasPrefix(test.body, "[") {
+				err = json.Unmarshal(w.Body.Bytes(), &responses)
+			} else {
+				responses = make([]JsonRpcResponse, 1)
+				err = json.Unmarshal(w.Body.Bytes(), &responses[0])
+			}
+			if err != nil {
+				t.Fatalf("invalid response %s: %v", w.Body, err)
+			}
+			if len(responses) != len(test.codes) {
+				t.Fatalf("expected %d responses, got %s", len(test.codes), w.Body)
+			}
+			for i, response := range responses {
+				if response.Jsonrpc != "2.0" || string(response.ID) != test.ids[i] {
+					t.Fatalf("unexpected response %d: %s", i, w.Body)
+				}
+				if test.codes[i] == 0 {
+					if response.Error != nil || len(response.Result) == 0 {
+						t.Fatalf("expected a result, got %s", w.Body)
+					}
+				} else if response.Error == nil || response.Error.Code != test.codes[i] || response.Error.Message == "" {
+					t.Fatalf("expected error %d for response %d, got %s", test.codes[i], i, w.Body)
+				}
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"encoding/json"
@@ -25,6 +28,9 @@ import (
 )
 
 func getEnv(key string, defaultValue string) string {
+	if value, exists := lookupConfigFile(key); exists {
+		return value
+	}
 	if value, exists := os.LookupEnv(key); exists {
 		return value
 	}
@@ -55,18 +61,65 @@ func getEnvAsBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+const (
+	defaultTimeout                = 5 * time.Minute
+	defaultLimitActiveConnections = 210
+	defaultAuthMaxFailures        = 10
+	defaultAuthLockout            = 5 * time.Minute
+	defaultIdempotencyTTL         = 24 * time.Hour
+	defaultJobRetention           = time.Hour
+	defaultWebhookMaxAttempts     = 8
+	defaultInvoiceWaitMaxTimeout  = 5 * time.Minute
+)
+
 var (
-	LNCD_TIMEOUT                  = getEnvAsDuration("LNCD_TIMEOUT", 5*time.Minute)
-	LNCD_LIMIT_ACTIVE_CONNECTIONS = getEnvAsInt("LNCD_LIMIT_ACTIVE_CONNECTIONS", 210)
-	LNCD_STATS_INTERVAL           = getEnvAsDuration("LNCD_STATS_INTERVAL", 1*time.Minute)
-	LNCD_DEBUG                    = getEnvAsBool("LNCD_DEBUG", false)
-	LNCD_PORT                     = getEnv("LNCD_PORT", "7167")
-	LNCD_HOST                     = getEnv("LNCD_HOST", "0.0.0.0")
-	LNCD_AUTH_TOKEN               = getEnv("LNCD_AUTH_TOKEN", "")
-	LNCD_TLS_CERT_PATH            = getEnv("LNCD_TLS_CERT_PATH", "")
-	LNCD_TLS_KEY_PATH             = getEnv("LNCD_TLS_KEY_PATH", "")
-	LNCD_HEALTHCHECK_SERVICE_PORT = getEnv("LNCD_HEALTHCHECK_SERVICE_PORT", "7168")
-	LNCD_HEALTHCHECK_SERVICE_HOST = getEnv("LNCD_HEALTHCHECK_SERVICE_HOST", "127.0.0.1")
+	LNCD_TIMEOUT                    = getEnvAsDuration("LNCD_TIMEOUT", defaultTimeout)
+	LNCD_LIMIT_ACTIVE_CONNECTIONS   = getEnvAsInt("LNCD_LIMIT_ACTIVE_CONNECTIONS", defaultLimitActiveConnections)
+	LNCD_STATS_INTERVAL             = getEnvAsDuration("LNCD_STATS_INTERVAL", 1*time.Minute)
+	LNCD_DEBUG                      = getEnvAsBool("LNCD_DEBUG", false)
+	LNCD_PORT                       = getEnv("LNCD_PORT", "7167")
+	LNCD_HOST                       = getEnv("LNCD_HOST", "0.0.0.0")
+	LNCD_GRPC_PORT                  = getEnv("LNCD_GRPC_PORT", "")
+	LNCD_GRPC_HOST                  = getEnv("LNCD_GRPC_HOST", "0.0.0.0")
+	LNCD_AUTH_TOKEN                 = getEnv("LNCD_AUTH_TOKEN", "")
+	LNCD_AUTH_TOKEN_HASH            = getEnv("LNCD_AUTH_TOKEN_HASH", "")
+	LNCD_AUTH_MAX_FAILURES          = getEnvAsInt("LNCD_AUTH_MAX_FAILURES", defaultAuthMaxFailures)
+	LNCD_AUTH_LOCKOUT               = getEnvAsDuration("LNCD_AUTH_LOCKOUT", defaultAuthLockout)
+	LNCD_TOKENS_PATH                = getEnv("LNCD_TOKENS_PATH", "")
+	LNCD_RATE_LIMIT_IDENTITY        = getEnv("LNCD_RATE_LIMIT_IDENTITY", "")
+	LNCD_RATE_LIMIT_IP              = getEnv("LNCD_RATE_LIMIT_IP", "")
+	LNCD_RATE_LIMIT_CONNECTION      = getEnv("LNCD_RATE_LIMIT_CONNECTION", "")
+	LNCD_RATE_LIMIT_METHODS         = getEnv("LNCD_RATE_LIMIT_METHODS", "")
+	LNCD_RATE_LIMIT_HANDSHAKE       = getEnv("LNCD_RATE_LIMIT_HANDSHAKE", "")
+	LNCD_ENFORCE_PERMISSIONS        = getEnvAsBool("LNCD_ENFORCE_PERMISSIONS", true)
+	LNCD_RECEIVE_ONLY               = getEnvAsBool("LNCD_RECEIVE_ONLY", false)
+	LNCD_NETWORK                    = getEnv("LNCD_NETWORK", "")
+	LNCD_VALIDATE_PAYMENT_REQUESTS  = getEnvAsBool("LNCD_VALIDATE_PAYMENT_REQUESTS", true)
+	LNCD_SPEND_MAX_PAYMENT_SAT      = int64(getEnvAsInt("LNCD_SPEND_MAX_PAYMENT_SAT", 0))
+	LNCD_SPEND_DAILY_BUDGET_SAT     = int64(getEnvAsInt("LNCD_SPEND_DAILY_BUDGET_SAT", 0))
+	LNCD_SPEND_ALLOWED_DESTINATIONS = getEnv("LNCD_SPEND_ALLOWED_DESTINATIONS", "")
+	LNCD_SPEND_STORE_PATH           = getEnv("LNCD_SPEND_STORE_PATH", "")
+	LNCD_SESSIONS_PATH              = getEnv("LNCD_SESSIONS_PATH", "")
+	LNCD_IDEMPOTENCY_TTL            = getEnvAsDuration("LNCD_IDEMPOTENCY_TTL", defaultIdempotencyTTL)
+	LNCD_JOB_RETENTION              = getEnvAsDuration("LNCD_JOB_RETENTION", defaultJobRetention)
+	LNCD_SUBSCRIPTIONS_PATH         = getEnv("LNCD_SUBSCRIPTIONS_PATH", "")
+	LNCD_WEBHOOK_MAX_ATTEMPTS       = getEnvAsInt("LNCD_WEBHOOK_MAX_ATTEMPTS", defaultWebhookMaxAttempts)
+	LNCD_WEBHOOK_DEAD_LETTER_PATH   = getEnv("LNCD_WEBHOOK_DEAD_LETTER_PATH", "")
+	LNCD_INVOICE_WAIT_MAX_TIMEOUT   = getEnvAsDuration("LNCD_INVOICE_WAIT_MAX_TIMEOUT", defaultInvoiceWaitMaxTimeout)
+	LNCD_CACHE_METHODS              = getEnv("LNCD_CACHE_METHODS", "")
+	LNCD_LNURL_DOMAIN               = getEnv("LNCD_LNURL_DOMAIN", "")
+	LNCD_LNURL_ADDRESSES_PATH       = getEnv("LNCD_LNURL_ADDRESSES_PATH", "")
+	LNCD_ZAP_PRIVATE_KEY            = getEnv("LNCD_ZAP_PRIVATE_KEY", "")
+	LNCD_ZAP_ALLOWED_RELAYS         = getEnv("LNCD_ZAP_ALLOWED_RELAYS", "")
+	LNCD_NWC_PATH                   = getEnv("LNCD_NWC_PATH", "")
+	LNCD_NWC_RELAY                  = getEnv("LNCD_NWC_RELAY", "")
+	LNCD_TLS_CERT_PATH              = getEnv("LNCD_TLS_CERT_PATH", "")
+	LNCD_TLS_KEY_PATH               = getEnv("LNCD_TLS_KEY_PATH", "")
+	LNCD_TLS_WATCH_INTERVAL         = getEnvAsDuration("LNCD_TLS_WATCH_INTERVAL", 1*time.Minute)
+	LNCD_TLS_CLIENT_CA_PATH         = getEnv("LNCD_TLS_CLIENT_CA_PATH", "")
+	LNCD_TLS_CLIENT_AUTH            = getEnv("LNCD_TLS_CLIENT_AUTH", "required")
+	LNCD_HEALTHCHECK_SERVICE_PORT   = getEnv("LNCD_HEALTHCHECK_SERVICE_PORT", "7168")
+	LNCD_HEALTHCHECK_SERVICE_HOST   = getEnv("LNCD_HEALTHCHECK_SERVICE_HOST", "127.0.0.1")
 )
 
 // //////////////////////////////
@@ -94,8 +147,23 @@ type ConnectionKey struct {
 type Action struct {
 	method     string
 	payload    string
+	identity   *Identity
 	onError    func(error)
 	onResponse func(ConnectionInfo, string)
+	// Set for calls that are forwarded by the caller over the gRPC
+	// connection instead of going through the JSON callbacks
+	onConnection func(*Connection)
+	// Actions executed by a single lookup of the connection, in order or
+	// concurrently
+	batch      []Action
+	concurrent bool
+	// Use of the response cache requested by the caller
+	cache cacheMode
+	// Intermediate results of built-ins, set for the calls of async jobs
+	onProgress func(string)
+	// Called when the call is sent to the node, once the checks of the
+	// daemon passed
+	onDispatch func()
 }
 
 type Connection struct {
@@ -106,6 +174,13 @@ type Connection struct {
 	pool         *ConnectionPool
 	timeoutTimer *time.Timer
 	perms        *PermissionManager
+	// Number of forwarded gRPC calls still running, the connection is not
+	// closed while they are active
+	inFlight int32
+	cache    responseCache
+	// Network of the node, from GetInfo when LNCD_NETWORK is not set
+	nodeNetwork     string
+	nodeNetworkOnce sync.Once
 }
 
 type ConnectionPool struct {
@@ -113,17 +188,108 @@ type ConnectionPool struct {
 	mutex       sync.Mutex
 }
 
+// RpcRequest is the body of a /rpc call. Payload can be either a JSON object
+// or, for backward compatibility, a string containing JSON.
+// Session can be used instead of Connection to refer to a stored session.
+// Calls can be used instead of Method and Payload to execute several methods
+// on the same connection, in order or concurrently.
+// With Async the call runs in the background and a Job is returned, that is
+// also POSTed to Webhook when it finishes, signed with WebhookSecret or with
+// a random secret returned with the job.
 type RpcRequest struct {
-	Connection ConnectionInfo
-	Method     string
-	Payload    string
+	Connection    ConnectionInfo
+	Session       string
+	Method        string
+	Payload       json.RawMessage
+	Calls         []RpcCall
+	Concurrent    bool
+	Async         bool
+	Webhook       string
+	WebhookSecret string
+}
+
+// RpcCall is a method call of a batch request.
+type RpcCall struct {
+	Method  string
+	Payload json.RawMessage
 }
 
+// RpcResponse is the response to a /rpc call. Result is a JSON object when
+// the request payload was an object or the API version header is 2, or a
+// string containing JSON otherwise.
 type RpcResponse struct {
 	Connection ConnectionInfo
-	Result     string
-	err        error
-	errCode    int
+	Result     json.RawMessage
+}
+
+// RpcBatchResponse is the response to a /rpc call with Calls, with one
+// result for each call in the same order.
+type RpcBatchResponse struct {
+	Connection ConnectionInfo
+	Results    []RpcCallResult
+}
+
+// RpcCallResult is the result of a call of a batch. Error and Code (the
+// HTTP status that the call would have returned alone) are set if the call
+// failed.
+type RpcCallResult struct {
+	Method string
+	Result json.RawMessage `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+	Code   int             `json:",omitempty"`
+}
+
+func newRpcCallError(method string, err error) RpcCallResult {
+	var code int = http.StatusInternalServerError
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		code = statusErr.Code
+	}
+	return RpcCallResult{Method: method, Error: err.Error(), Code: code}
+}
+
+// Header to choose the format of the result: "1" for a string containing
+// JSON, "2" for a JSON object.
+const apiVersionHeader = "LNCD-API-Version"
+
+// parsePayload returns the payload as a JSON string and whether it was sent
+// as an object rather than as a string.
+func parsePayload(raw json.RawMessage) (string, bool, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return "", false, nil
+	}
+	if trimmed[0] == '"' {
+		var payload string
+		if err := json.Unmarshal(trimmed, &payload); err != nil {
+			return "", false, err
+		}
+		return payload, false, nil
+	}
+	return string(trimmed), true, nil
+}
+
+// formatResult encodes the JSON result as an object, or as a string for
+// legacy clients.
+func formatResult(result string, typed bool) json.RawMessage {
+	if typed && json.Valid([]byte(result)) {
+		return json.RawMessage(result)
+	}
+	encoded, _ := json.Marshal(result)
+	return encoded
+}
+
+// wantsTypedResult decides the result format from the version header, or
+// from the payload format if the header is not set.
+func wantsTypedResult(r *http.Request, typedPayload bool) bool {
+	switch r.Header.Get(apiVersionHeader) {
+	case "1":
+		return false
+	case "2":
+		return true
+	default:
+		return typedPayload
+	}
 }
 
 func NewConnectionPool() *ConnectionPool {
@@ -204,111 +370,280 @@ func NewConnection(pool *ConnectionPool, info ConnectionInfo) (*Connection, erro
 
 func (conn *Connection) runLoop() {
 	for req := range conn.actions {
-		if req.method == "checkPerms" {
-			log.Debugf("Checking permissions for: %v", req.payload)
-			perms := []string{}
-			err := json.Unmarshal([]byte(req.payload), &perms)
-			if err != nil {
+		if len(req.batch) > 0 && req.concurrent {
+			var wg sync.WaitGroup
+			for _, batchReq := range req.batch {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					conn.handle(batchReq)
+				}()
+			}
+			wg.Wait()
+		} else if len(req.batch) > 0 {
+			for _, batchReq := range req.batch {
+				conn.handle(batchReq)
+			}
+		} else {
+			conn.handle(req)
+		}
+	}
+}
+
+// handle executes a single action on the connection.
+func (conn *Connection) handle(req Action) {
+	if req.onConnection != nil {
+		configMutex.RLock()
+		enforcePermissions := LNCD_ENFORCE_PERMISSIONS
+		configMutex.RUnlock()
+		if enforcePermissions {
+			if err := conn.perms.enforce(req.method); err != nil {
+				log.Infof("Refusing method %v: %v", req.method, err)
+				conn.release()
 				req.onError(err)
-			} else {
-				var valid []bool = make([]bool, len(perms))
-				for i, perm := range perms {
-					allowed, err := conn.perms.check(perm)
-					if err != nil {
-						log.Errorf("Error checking permission: %v", err)
-						valid[i] = false
-					} else {
-						valid[i] = allowed
-					}
+				return
+			}
+		}
+		req.onConnection(conn)
+		return
+	}
+
+	req, hit := conn.cached(req)
+	if hit {
+		return
+	}
+	if builtin, ok := builtins[req.method]; ok {
+		conn.runBuiltin(req, builtin)
+	} else {
+		var methodFunc, ok = conn.registry[req.method]
+		if ok {
+			configMutex.RLock()
+			enforcePermissions := LNCD_ENFORCE_PERMISSIONS
+			configMutex.RUnlock()
+			if enforcePermissions {
+				if err := conn.perms.enforce(req.method); err != nil {
+					log.Infof("Refusing method %v: %v", req.method, err)
+					req.onError(err)
+					return
 				}
+			}
 
-				result, err := json.Marshal(valid)
+			release, err := authorizeSpend(conn, req.identity, req.method, req.payload)
+			if err != nil {
+				log.Infof("Refusing method %v: %v", req.method, err)
+				req.onError(err)
+				return
+			}
+
+			if req.onDispatch != nil {
+				req.onDispatch()
+			}
+			log.Infof("Executing method: %v", req.method)
+			if UNSAFE_LOGS {
+				log.Debugf("Execution: %v %v %v", conn.connInfo, req.method, req.payload)
+			}
+			methodFunc(context.Background(), conn.grpcClient, req.payload, func(resultJSON string, err error) {
 				if err != nil {
+					release()
 					req.onError(err)
 				} else {
-					req.onResponse(conn.connInfo, string(result))
+					if spendFailed(resultJSON) {
+						release()
+					}
+					req.onResponse(conn.connInfo, resultJSON)
 				}
-
-			}
+			})
 		} else {
-			var methodFunc, ok = conn.registry[req.method]
-			if ok {
-				log.Infof("Executing method: %v", req.method)
-				if UNSAFE_LOGS {
-					log.Debugf("Execution: %v %v %v", conn.connInfo, req.method, req.payload)
-				}
-				methodFunc(context.Background(), conn.grpcClient, req.payload, func(resultJSON string, err error) {
-					if err != nil {
-						req.onError(err)
-					} else {
-						req.onResponse(conn.connInfo, resultJSON)
-					}
-				})
-			}
+			req.onError(&StatusError{
+				Code:    http.StatusNotFound,
+				Message: fmt.Sprintf("unknown method %v", req.method),
+			})
 		}
 	}
 }
 
+// release marks a forwarded gRPC call as completed.
+func (conn *Connection) release() {
+	atomic.AddInt32(&conn.inFlight, -1)
+}
+
 func (conn *Connection) Close() {
 	close(conn.actions)
 	conn.grpcClient.Close()
+	conn.cache.clear()
 }
 
 func (pool *ConnectionPool) execute(info ConnectionInfo, req Action) {
-	try := func() bool {
-		var key ConnectionKey = ConnectionKey{info.Mailbox, info.PairingPhrase}
-		var err error
-		connection, ok := pool.connections[key]
-		if !ok {
-			log.Infof("Creating new connection")
-			if UNSAFE_LOGS {
-				log.Debugf("Connection: %v", info)
-			}
-			if len(pool.connections) >= LNCD_LIMIT_ACTIVE_CONNECTIONS {
-				req.onError(fmt.Errorf("too many active connections"))
-				return true
-			}
-			connection, err = NewConnection(pool, info)
-			if err != nil {
-				req.onError(err)
-			} else {
-				connection.timeoutTimer = time.AfterFunc(LNCD_TIMEOUT, func() {
-					pool.mutex.Lock()
-					if len(connection.actions) == 0 {
-						log.Infof("Closing idle connection %v", info.RemoteKey)
-						if UNSAFE_LOGS {
-							log.Debugf("Connection: %v", info)
-						}
-						connection.Close()
-						delete(pool.connections, ConnectionKey{info.Mailbox, info.PairingPhrase})
-					} else {
-						connection.timeoutTimer.Reset(LNCD_TIMEOUT)
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var key ConnectionKey = ConnectionKey{info.Mailbox, info.PairingPhrase}
+	var err error
+	connection, ok := pool.connections[key]
+	if !ok {
+		log.Infof("Creating new connection")
+		if UNSAFE_LOGS {
+			log.Debugf("Connection: %v", info)
+		}
+		configMutex.RLock()
+		limit, timeout := LNCD_LIMIT_ACTIVE_CONNECTIONS, LNCD_TIMEOUT
+		configMutex.RUnlock()
+		if len(pool.connections) >= limit {
+			log.Infof("Too many active connections")
+			incMetric("connection_limit")
+			req.onError(&StatusError{
+				Code:       http.StatusServiceUnavailable,
+				Message:    "too many active connections",
+				RetryAfter: time.Second,
+			})
+			return
+		}
+		if ok, retryAfter := getRateLimits().allowHandshake(); !ok {
+			log.Infof("Handshake rate limit exceeded")
+			incMetric("ratelimit_handshake")
+			req.onError(newRateLimitedError(retryAfter))
+			return
+		}
+		connection, err = NewConnection(pool, info)
+		if err != nil {
+			req.onError(err)
+			return
+		} else {
+			connection.timeoutTimer = time.AfterFunc(timeout, func() {
+				pool.mutex.Lock()
+				if len(connection.actions) == 0 && atomic.LoadInt32(&connection.inFlight) == 0 {
+					log.Infof("Closing idle connection %v", info.RemoteKey)
+					if UNSAFE_LOGS {
+						log.Debugf("Connection: %v", info)
 					}
-					pool.mutex.Unlock()
+					connection.Close()
+					delete(pool.connections, ConnectionKey{info.Mailbox, info.PairingPhrase})
+				} else {
+					configMutex.RLock()
+					connection.timeoutTimer.Reset(LNCD_TIMEOUT)
+					configMutex.RUnlock()
+				}
+				pool.mutex.Unlock()
+			})
+			pool.connections[key] = connection
+			go connection.runLoop()
+		}
+	} else {
+		log.Infof("Reusing existing connection")
+		if UNSAFE_LOGS {
+			log.Debugf("Connection: %v", info)
+		}
+	}
+	if req.onConnection != nil {
+		atomic.AddInt32(&connection.inFlight, 1)
+	}
+	connection.actions <- req
+}
+
+// callResult is the outcome of a method call.
+type callResult struct {
+	info   ConnectionInfo
+	result string
+	err    error
+}
+
+// batchCall is a method call of a batch.
+type batchCall struct {
+	method  string
+	payload string
+}
+
+// call executes the method on the pooled connection and waits for the first
+// response. For streaming methods the following messages are discarded.
+// If a session ID is given, the keys negotiated by the connection are saved
+// in the session.
+func (pool *ConnectionPool) call(ctx context.Context, info ConnectionInfo, sessionID string, identity *Identity, method string, payload string) (ConnectionInfo, string, error) {
+	var waitResponse chan callResult = make(chan callResult, 1)
+	var respondOnce sync.Once
+
+	pool.execute(info, Action{
+		method:     method,
+		payload:    payload,
+		identity:   identity,
+		cache:      cacheModeFromContext(ctx),
+		onProgress: progressFromContext(ctx),
+		onDispatch: func() { markDispatched(ctx, method) },
+		onError: func(err error) {
+			respondOnce.Do(func() {
+				waitResponse <- callResult{err: err}
+			})
+		},
+		onResponse: func(info ConnectionInfo, result string) {
+			respondOnce.Do(func() {
+				waitResponse <- callResult{info: info, result: result}
+			})
+		},
+	})
+
+	select {
+	case resp := <-waitResponse:
+		if resp.err == nil && sessionID != "" {
+			sessions.updateKeys(sessionID, resp.info)
+		}
+		return resp.info, resp.result, resp.err
+	case <-ctx.Done():
+		// the action is still queued and may be executed
+		markDispatched(ctx, method)
+		return info, "", ctx.Err()
+	}
+}
+
+// callBatch executes the calls on the pooled connection, looking it up only
+// once, and waits for all the responses. Calls are executed in order unless
+// concurrent is set.
+func (pool *ConnectionPool) callBatch(ctx context.Context, info ConnectionInfo, sessionID string, identity *Identity, calls []batchCall, concurrent bool) []callResult {
+	var waits []chan callResult = make([]chan callResult, len(calls))
+	var actions []Action = make([]Action, len(calls))
+	for i, call := range calls {
+		var waitResponse chan callResult = make(chan callResult, 1)
+		var respondOnce sync.Once
+		waits[i] = waitResponse
+		actions[i] = Action{
+			method:     call.method,
+			payload:    call.payload,
+			identity:   identity,
+			cache:      cacheModeFromContext(ctx),
+			onDispatch: func() { markDispatched(ctx, call.method) },
+			onError: func(err error) {
+				respondOnce.Do(func() {
+					waitResponse <- callResult{err: err}
 				})
-				pool.connections[key] = connection
-				go connection.runLoop()
-			}
-		} else {
-			log.Infof("Reusing existing connection")
-			if UNSAFE_LOGS {
-				log.Debugf("Connection: %v", info)
-			}
+			},
+			onResponse: func(info ConnectionInfo, result string) {
+				respondOnce.Do(func() {
+					waitResponse <- callResult{info: info, result: result}
+				})
+			},
 		}
-		connection.actions <- req
-		return false
 	}
 
-	retry := true
-	for retry {
-		pool.mutex.Lock()
-		retry = try()
-		pool.mutex.Unlock()
-		if retry {
-			log.Infof("Retrying connection")
-			time.Sleep(1 * time.Second)
+	pool.execute(info, Action{
+		batch:      actions,
+		concurrent: concurrent,
+		onError: func(err error) {
+			for _, action := range actions {
+				action.onError(err)
+			}
+		},
+	})
+
+	var results []callResult = make([]callResult, len(calls))
+	for i, waitResponse := range waits {
+		select {
+		case results[i] = <-waitResponse:
+			if results[i].err == nil && sessionID != "" {
+				sessions.updateKeys(sessionID, results[i].info)
+			}
+		case <-ctx.Done():
+			markDispatched(ctx, calls[i].method)
+			results[i] = callResult{info: info, err: ctx.Err()}
 		}
 	}
+	return results
 }
 
 func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
@@ -317,6 +652,44 @@ func writeJSONError(w http.ResponseWriter, message string, statusCode int) {
 	json.NewEncoder(w).Encode(map[string]string{"error": message})
 }
 
+// StatusError is an error that is reported with a specific http status code.
+// Details are added to the error response.
+type StatusError struct {
+	Code       int
+	Message    string
+	RetryAfter time.Duration
+	Details    map[string]interface{}
+}
+
+func (e *StatusError) Error() string {
+	return e.Message
+}
+
+// writeError writes err with its status code, or as an internal server error
+// if it is not a StatusError.
+func writeError(w http.ResponseWriter, err error) {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		writeJSONError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if statusErr.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(statusErr.RetryAfter.Seconds()))))
+	}
+	if len(statusErr.Details) == 0 {
+		writeJSONError(w, statusErr.Message, statusErr.Code)
+		return
+	}
+
+	var body map[string]interface{} = map[string]interface{}{"error": statusErr.Message}
+	for key, value := range statusErr.Details {
+		body[key] = value
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusErr.Code)
+	json.NewEncoder(w).Encode(body)
+}
+
 func rpcHandler(pool *ConnectionPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var request RpcRequest
@@ -331,49 +704,141 @@ func rpcHandler(pool *ConnectionPool) http.HandlerFunc {
 			writeJSONError(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		if request.Webhook != "" && !request.Async {
+			writeJSONError(w, "Webhook requires Async", http.StatusBadRequest)
+			return
+		}
+		if len(request.Calls) > 0 {
+			if request.Async {
+				writeJSONError(w, "Async is not supported with Calls", http.StatusBadRequest)
+				return
+			}
+			rpcBatch(w, r, pool, &request)
+			return
+		}
+
+		payload, typedPayload, err := parsePayload(request.Payload)
+		if err != nil {
+			writeJSONError(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var typedResult bool = wantsTypedResult(r, typedPayload)
 
-		log.Infof("Incoming RPC request: %v", request.Method)
+		var identity *Identity = identityFromContext(r.Context())
+		log.Infof("Incoming RPC request: %v from %v (%v)", request.Method, identity.Name, r.RemoteAddr)
 		if UNSAFE_LOGS {
-			log.Debugf("Full request: %v", request)
+			log.Debugf("Full request: %v %v %v", request.Connection, request.Method, payload)
 		}
 
-		var waitResponse chan RpcResponse = make(chan RpcResponse)
+		info, err := resolveConnection(identity, request.Session, request.Connection)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := authorizeCall(identity, info, request.Method); err != nil {
+			log.Infof("Refusing method %v: %v", request.Method, err)
+			writeError(w, err)
+			return
+		}
 
-		pool.execute(request.Connection, Action{
-			method:  request.Method,
-			payload: request.Payload,
-			onError: func(err error) {
-				waitResponse <- RpcResponse{err: err, errCode: http.StatusInternalServerError}
-				close(waitResponse)
-			},
-			onResponse: func(info ConnectionInfo, result string) {
-				log.Debugf("RPC response: %v", result)
-				if UNSAFE_LOGS {
-					log.Debugf("Connection: %v", info)
-				}
-				waitResponse <- RpcResponse{
-					Connection: info,
-					Result:     result,
-					err:        nil,
-					errCode:    http.StatusOK,
+		if request.Async {
+			if !isKnownMethod(request.Method) {
+				writeJSONError(w, "Method not found", http.StatusNotFound)
+				return
+			}
+			if request.Webhook != "" {
+				if err := validateWebhookURL(request.Webhook); err != nil {
+					writeError(w, err)
+					return
 				}
-				close(waitResponse)
-			},
+			}
+			job, err := startJob(pool, identity, info, request.Session, request.Method, payload, typedResult, request.Webhook, request.WebhookSecret)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Location", "/jobs/"+job.ID)
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(job)
+			return
+		}
+
+		info, result, err := pool.call(r.Context(), info, request.Session, identity, request.Method, payload)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		log.Debugf("RPC response: %v", result)
+		if UNSAFE_LOGS {
+			log.Debugf("Connection: %v", info)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(RpcResponse{
+			Connection: responseConnection(info, request.Session),
+			Result:     formatResult(result, typedResult),
 		})
+	}
+}
 
-		var resp RpcResponse = <-waitResponse
-		if resp.err == nil {
-			w.Header().Set("Content-Type", "application/json")
-			if err := json.NewEncoder(w).Encode(resp); err != nil {
-				resp.err = err
-				resp.errCode = http.StatusInternalServerError
-			}
+// rpcBatch executes the calls of a /rpc request on its connection and
+// responds with the result of each call.
+func rpcBatch(w http.ResponseWriter, r *http.Request, pool *ConnectionPool, request *RpcRequest) {
+	var identity *Identity = identityFromContext(r.Context())
+	log.Infof("Incoming RPC batch: %d calls from %v (%v)", len(request.Calls), identity.Name, r.RemoteAddr)
+
+	info, err := resolveConnection(identity, request.Session, request.Connection)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var results []RpcCallResult = make([]RpcCallResult, len(request.Calls))
+	var typedResults []bool = make([]bool, len(request.Calls))
+	var calls []batchCall
+	var callIndexes []int
+	for i, call := range request.Calls {
+		payload, typedPayload, err := parsePayload(call.Payload)
+		if err != nil {
+			results[i] = newRpcCallError(call.Method, &StatusError{Code: http.StatusBadRequest, Message: "invalid payload: " + err.Error()})
+			continue
+		}
+		if !isKnownMethod(call.Method) {
+			results[i] = newRpcCallError(call.Method, &StatusError{Code: http.StatusNotFound, Message: "Method not found"})
+			continue
 		}
+		if err := authorizeCall(identity, info, call.Method); err != nil {
+			log.Infof("Refusing method %v: %v", call.Method, err)
+			results[i] = newRpcCallError(call.Method, err)
+			continue
+		}
+		typedResults[i] = wantsTypedResult(r, typedPayload)
+		calls = append(calls, batchCall{method: call.Method, payload: payload})
+		callIndexes = append(callIndexes, i)
+	}
 
-		if resp.err != nil {
-			writeJSONError(w, resp.err.Error(), resp.errCode)
+	if len(calls) > 0 {
+		for i, result := range pool.callBatch(r.Context(), info, request.Session, identity, calls, request.Concurrent) {
+			var index int = callIndexes[i]
+			if result.err != nil {
+				recordCallError(r.Context(), result.err)
+				results[index] = newRpcCallError(calls[i].method, result.err)
+				continue
+			}
+			results[index] = RpcCallResult{
+				Method: calls[i].method,
+				Result: formatResult(result.result, typedResults[index]),
+			}
+			info = result.info
 		}
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RpcBatchResponse{
+		Connection: responseConnection(info, request.Session),
+		Results:    results,
+	})
 }
 
 func parseKeys(localPrivKey, remotePubKey string) (
@@ -439,24 +904,6 @@ func parseKeys(localPrivKey, remotePubKey string) (
 	return localStaticKey, remoteStaticKey, nil
 }
 
-func authMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if LNCD_AUTH_TOKEN != "" {
-			authHeader := r.Header.Get("Authorization")
-			if !strings.HasPrefix(authHeader, "Bearer ") {
-				writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-			token := strings.TrimPrefix(authHeader, "Bearer ")
-			if token != LNCD_AUTH_TOKEN {
-				writeJSONError(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-		}
-		next.ServeHTTP(w, r)
-	}
-}
-
 func main() {
 	shutdownInterceptor, err := signal.Intercept()
 	if err != nil {
@@ -472,30 +919,179 @@ func main() {
 	log.Infof("LNCD_DEBUG: %v", LNCD_DEBUG)
 	log.Infof("LNCD_PORT: %v", LNCD_PORT)
 	log.Infof("LNCD_HOST: %v", LNCD_HOST)
+	log.Infof("LNCD_GRPC_PORT: %v", LNCD_GRPC_PORT)
+	log.Infof("LNCD_GRPC_HOST: %v", LNCD_GRPC_HOST)
 	log.Infof("LNCD_TLS_CERT_PATH: %v", LNCD_TLS_CERT_PATH)
 	log.Infof("LNCD_TLS_KEY_PATH: %v", LNCD_TLS_KEY_PATH)
+	log.Infof("LNCD_TLS_WATCH_INTERVAL: %v", LNCD_TLS_WATCH_INTERVAL)
+	log.Infof("LNCD_TLS_CLIENT_CA_PATH: %v", LNCD_TLS_CLIENT_CA_PATH)
+	log.Infof("LNCD_TLS_CLIENT_AUTH: %v", LNCD_TLS_CLIENT_AUTH)
+	log.Infof("LNCD_CONFIG_PATH: %v", LNCD_CONFIG_PATH)
+	log.Infof("LNCD_TOKENS_PATH: %v", LNCD_TOKENS_PATH)
+	log.Infof("LNCD_AUTH_TOKEN_HASH: %v", LNCD_AUTH_TOKEN_HASH)
+	log.Infof("LNCD_AUTH_MAX_FAILURES: %v", LNCD_AUTH_MAX_FAILURES)
+	log.Infof("LNCD_AUTH_LOCKOUT: %v", LNCD_AUTH_LOCKOUT)
+	log.Infof("LNCD_RATE_LIMIT_IDENTITY: %v", LNCD_RATE_LIMIT_IDENTITY)
+	log.Infof("LNCD_RATE_LIMIT_IP: %v", LNCD_RATE_LIMIT_IP)
+	log.Infof("LNCD_RATE_LIMIT_CONNECTION: %v", LNCD_RATE_LIMIT_CONNECTION)
+	log.Infof("LNCD_RATE_LIMIT_METHODS: %v", LNCD_RATE_LIMIT_METHODS)
+	log.Infof("LNCD_RATE_LIMIT_HANDSHAKE: %v", LNCD_RATE_LIMIT_HANDSHAKE)
+	log.Infof("LNCD_ENFORCE_PERMISSIONS: %v", LNCD_ENFORCE_PERMISSIONS)
+	log.Infof("LNCD_RECEIVE_ONLY: %v", LNCD_RECEIVE_ONLY)
+	log.Infof("LNCD_NETWORK: %v", LNCD_NETWORK)
+	log.Infof("LNCD_VALIDATE_PAYMENT_REQUESTS: %v", LNCD_VALIDATE_PAYMENT_REQUESTS)
+	log.Infof("LNCD_SPEND_MAX_PAYMENT_SAT: %v", LNCD_SPEND_MAX_PAYMENT_SAT)
+	log.Infof("LNCD_SPEND_DAILY_BUDGET_SAT: %v", LNCD_SPEND_DAILY_BUDGET_SAT)
+	log.Infof("LNCD_SPEND_ALLOWED_DESTINATIONS: %v", LNCD_SPEND_ALLOWED_DESTINATIONS)
+	log.Infof("LNCD_SPEND_STORE_PATH: %v", LNCD_SPEND_STORE_PATH)
+	log.Infof("LNCD_SESSIONS_PATH: %v", LNCD_SESSIONS_PATH)
+	log.Infof("LNCD_IDEMPOTENCY_TTL: %v", LNCD_IDEMPOTENCY_TTL)
+	log.Infof("LNCD_JOB_RETENTION: %v", LNCD_JOB_RETENTION)
+	log.Infof("LNCD_SUBSCRIPTIONS_PATH: %v", LNCD_SUBSCRIPTIONS_PATH)
+	log.Infof("LNCD_INVOICE_WAIT_MAX_TIMEOUT: %v", LNCD_INVOICE_WAIT_MAX_TIMEOUT)
+	log.Infof("LNCD_CACHE_METHODS: %v", LNCD_CACHE_METHODS)
+	log.Infof("LNCD_LNURL_DOMAIN: %v", LNCD_LNURL_DOMAIN)
+	log.Infof("LNCD_LNURL_ADDRESSES_PATH: %v", LNCD_LNURL_ADDRESSES_PATH)
+	log.Infof("LNCD_NWC_PATH: %v", LNCD_NWC_PATH)
+	log.Infof("LNCD_ZAP_ALLOWED_RELAYS: %v", LNCD_ZAP_ALLOWED_RELAYS)
+	log.Infof("LNCD_NWC_RELAY: %v", LNCD_NWC_RELAY)
+	log.Infof("LNCD_WEBHOOK_MAX_ATTEMPTS: %v", LNCD_WEBHOOK_MAX_ATTEMPTS)
+	log.Infof("LNCD_WEBHOOK_DEAD_LETTER_PATH: %v", LNCD_WEBHOOK_DEAD_LETTER_PATH)
 	log.Infof("LNCD_HEALTHCHECK_SERVICE_PORT: %v", LNCD_HEALTHCHECK_SERVICE_PORT)
 	log.Infof("LNCD_HEALTHCHECK_SERVICE_HOST: %v", LNCD_HEALTHCHECK_SERVICE_HOST)
 
 	if UNSAFE_LOGS {
 		log.Infof("LNCD_AUTH_TOKEN: %v", LNCD_AUTH_TOKEN)
+		log.Infof("LNCD_ZAP_PRIVATE_KEY: %v", LNCD_ZAP_PRIVATE_KEY)
 		log.Infof("!!! UNSAFE LOGGING ENABLED !!!")
 	}
 	log.Debugf("debug enabled")
 
+	if err := loadTokens(LNCD_TOKENS_PATH); err != nil {
+		log.Errorf("Error loading API tokens: %v", err)
+		exit(err)
+	}
+
+	if err := loadRateLimits(); err != nil {
+		log.Errorf("Error loading rate limits: %v", err)
+		exit(err)
+	}
+	if err := loadCacheRules(); err != nil {
+		log.Errorf("Error loading cached methods: %v", err)
+		exit(err)
+	}
+
+	checkMethodClasses()
+
+	if _, err := chainParams(); err != nil {
+		log.Errorf("Invalid LNCD_NETWORK: %v", err)
+		exit(err)
+	}
+
+	spendStore, err = newSpendingStore(LNCD_SPEND_STORE_PATH)
+	if err != nil {
+		log.Errorf("Error loading spending store: %v", err)
+		exit(err)
+	}
+
+	sessions, err = NewSessionStore(LNCD_SESSIONS_PATH)
+	if err != nil {
+		log.Errorf("Error loading sessions: %v", err)
+		exit(err)
+	}
+
 	var pool *ConnectionPool = NewConnectionPool()
 	startStatsLoop(pool)
 
-	http.HandleFunc("/rpc", authMiddleware(rpcHandler(pool)))
+	invoiceStreams = NewInvoiceStreams(pool)
+	subscriptions, err = NewSubscriptionStore(LNCD_SUBSCRIPTIONS_PATH)
+	if err != nil {
+		log.Errorf("Error loading subscriptions: %v", err)
+		exit(err)
+	}
+	subscriptions.start()
+
+	if LNCD_ZAP_PRIVATE_KEY != "" {
+		zapKey, err = parseNostrPrivateKey(LNCD_ZAP_PRIVATE_KEY)
+		if err != nil {
+			log.Errorf("Invalid LNCD_ZAP_PRIVATE_KEY: %v", err)
+			exit(err)
+		}
+		log.Infof("Zaps enabled with public key %v", nostrPublicKey(zapKey))
+	}
+	lightningAddresses, err = NewLightningAddressStore(LNCD_LNURL_ADDRESSES_PATH)
+	if err != nil {
+		log.Errorf("Error loading lightning addresses: %v", err)
+		exit(err)
+	}
+
+	nwcConnections, err = NewNWCStore(pool, LNCD_NWC_PATH)
+	if err != nil {
+		log.Errorf("Error loading NWC connections: %v", err)
+		exit(err)
+	}
+	nwcConnections.start()
+
+	rest, err := restHandler(pool)
+	if err != nil {
+		log.Errorf("Error setting up REST routes: %v", err)
+		exit(err)
+	}
+
+	http.HandleFunc("/rpc", authMiddleware(idempotencyMiddleware(cacheControlMiddleware(rpcHandler(pool)))))
+	http.HandleFunc("/jsonrpc", authMiddleware(idempotencyMiddleware(cacheControlMiddleware(jsonRpcHandler(pool)))))
+	http.HandleFunc("/v1/", authMiddleware(idempotencyMiddleware(cacheControlMiddleware(rest))))
+	http.HandleFunc("GET /jobs/{id}", authMiddleware(jobHandler))
+	http.HandleFunc("POST /subscriptions", authMiddleware(createSubscriptionHandler))
+	http.HandleFunc("GET /subscriptions", authMiddleware(listSubscriptionsHandler))
+	http.HandleFunc("DELETE /subscriptions/{id}", authMiddleware(deleteSubscriptionHandler))
+	http.HandleFunc("GET /invoices/{hash}/wait", authMiddleware(invoiceWaitHandler(pool)))
+	http.HandleFunc("POST /nwc", authMiddleware(createNWCHandler))
+	http.HandleFunc("GET /nwc", authMiddleware(listNWCHandler))
+	http.HandleFunc("DELETE /nwc/{id}", authMiddleware(deleteNWCHandler))
+	http.HandleFunc("POST /sessions", authMiddleware(createSessionHandler))
+	http.HandleFunc("GET /sessions", authMiddleware(listSessionsHandler))
+	http.HandleFunc("DELETE /sessions/{id}", authMiddleware(deleteSessionHandler))
+	if LNCD_LNURL_DOMAIN != "" {
+		http.HandleFunc("POST /lnurl/addresses", authMiddleware(createLightningAddressHandler))
+		http.HandleFunc("GET /lnurl/addresses", authMiddleware(listLightningAddressesHandler))
+		http.HandleFunc("DELETE /lnurl/addresses/{username}", authMiddleware(deleteLightningAddressHandler))
+		http.HandleFunc("GET /.well-known/lnurlp/{username}", lnurlMiddleware(lnurlPayHandler))
+		http.HandleFunc("GET /lnurlp/{username}/callback", lnurlMiddleware(lnurlCallbackHandler(pool)))
+	}
 	http.HandleFunc("/health", authMiddleware(healthCheckHandler))
 	http.HandleFunc("/", formHandler)
 
+	var certs *certReloader
+	var isTLS = LNCD_TLS_CERT_PATH != "" && LNCD_TLS_KEY_PATH != ""
+	if isTLS {
+		certs, err = newCertReloader(LNCD_TLS_CERT_PATH, LNCD_TLS_KEY_PATH, LNCD_TLS_CLIENT_CA_PATH, LNCD_TLS_CLIENT_AUTH)
+		if err != nil {
+			log.Errorf("Error loading TLS certificate: %v", err)
+			exit(err)
+		}
+		certs.watch(LNCD_TLS_WATCH_INTERVAL)
+	}
+	startReloadLoop(certs)
+
+	var grpcServer *grpc.Server
+	if LNCD_GRPC_PORT != "" {
+		grpcServer, err = startGRPCServer(pool, certs, LNCD_GRPC_HOST+":"+LNCD_GRPC_PORT)
+		if err != nil {
+			log.Errorf("Error starting gRPC server: %v", err)
+			exit(err)
+		}
+	}
+
 	go func() {
 		log.Infof("Server starting at " + LNCD_HOST + ":" + LNCD_PORT)
-		var isTLS = LNCD_TLS_CERT_PATH != "" && LNCD_TLS_KEY_PATH != ""
 		if isTLS {
 			log.Infof("TLS enabled")
-			if err := http.ListenAndServeTLS(LNCD_HOST+":"+LNCD_PORT, LNCD_TLS_CERT_PATH, LNCD_TLS_KEY_PATH, nil); err != nil {
+			server := &http.Server{
+				Addr:      LNCD_HOST + ":" + LNCD_PORT,
+				TLSConfig: certs.tlsConfig(),
+			}
+			if err := server.ListenAndServeTLS("", ""); err != nil {
 				log.Errorf("Error starting server: %v", err)
 				exit(err)
 			}
@@ -521,6 +1117,9 @@ func main() {
 
 	<-shutdownInterceptor.ShutdownChannel()
 	log.Infof("Shutting down daemon")
+	if grpcServer != nil {
+		grpcServer.Stop()
+	}
 	for _, conn := range pool.connections {
 		conn.Close()
 	}
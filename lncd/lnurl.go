@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLnurlMinSendable = 1000
+	defaultLnurlMaxSendable = 1000000000
+)
+
+// Identity used to create the invoices of the Lightning Addresses, the
+// callbacks are public so it can only add invoices.
+var lnurlIdentity = &Identity{
+	Name:        "lnurl",
+	Methods:     []string{"lnrpc.Lightning.AddInvoice"},
+	ReceiveOnly: true,
+}
+
+var lightningAddressUsername = regexp.MustCompile(`^[a-z0-9\-_.]+$`)
+
+// LightningAddress maps the user part of a Lightning Address on
+// LNCD_LNURL_DOMAIN to a session. Amounts are in millisatoshis.
+type LightningAddress struct {
+	Username    string
+	Owner       string
+	Session     string
+	Description string
+	MinSendable int64
+	MaxSendable int64
+	Created     time.Time
+}
+
+// LightningAddressStore keeps the Lightning Addresses in memory and
+// optionally in a JSON file.
+type LightningAddressStore struct {
+	path      string
+	addresses map[string]*LightningAddress
+	mutex     sync.RWMutex
+}
+
+var lightningAddresses *LightningAddressStore
+
+func NewLightningAddressStore(path string) (*LightningAddressStore, error) {
+	store := &LightningAddressStore{
+		path:      path,
+		addresses: make(map[string]*LightningAddress),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.addresses); err != nil {
+		return nil, fmt.Errorf("invalid lightning addresses file %v: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes the addresses to disk, must be called with the mutex held.
+func (store *LightningAddressStore) save() {
+	if store.path == "" {
+		return
+	}
+	if err := saveJSONFile(store.path, store.addresses); err != nil {
+		log.Errorf("Unable to save lightning addresses: %v", err)
+	}
+}
+
+func (store *LightningAddressStore) create(owner *Identity, address LightningAddress) (*LightningAddress, error) {
+	address.Username = strings.ToLower(address.Username)
+	if !lightningAddressUsername.MatchString(address.Username) {
+		return nil, &StatusError{Code: http.StatusBadRequest, Message: "invalid username"}
+	}
+	// the session must belong to the identity that creates the address
+	if _, err := sessions.get(address.Session, owner); err != nil {
+		return nil, err
+	}
+	if address.MinSendable == 0 {
+		address.MinSendable = defaultLnurlMinSendable
+	}
+	if address.MaxSendable == 0 {
+		address.MaxSendable = defaultLnurlMaxSendable
+	}
+	if address.MinSendable < 1 || address.MaxSendable < address.MinSendable {
+		return nil, &StatusError{Code: http.StatusBadRequest, Message: "invalid MinSendable or MaxSendable"}
+	}
+	if address.Description == "" {
+		address.Description = "Payment to " + address.Username
+	}
+	address.Owner = owner.Name
+	address.Created = time.Now()
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if _, ok := store.addresses[address.Username]; ok {
+		return nil, &StatusError{Code: http.StatusConflict, Message: "username already taken"}
+	}
+	store.addresses[address.Username] = &address
+	store.save()
+	addressCopy := address
+	return &addressCopy, nil
+}
+
+// get returns a copy of the address of username.
+func (store *LightningAddressStore) get(username string) (*LightningAddress, bool) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	address, ok := store.addresses[strings.ToLower(username)]
+	if !ok {
+		return nil, false
+	}
+	addressCopy := *address
+	return &addressCopy, true
+}
+
+func (store *LightningAddressStore) list(identity *Identity) []*LightningAddress {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var owned []*LightningAddress = []*LightningAddress{}
+	for _, address := range store.addresses {
+		if address.Owner == identity.Name {
+			addressCopy := *address
+			owned = append(owned, &addressCopy)
+		}
+	}
+	return owned
+}
+
+func (store *LightningAddressStore) delete(username string, identity *Identity) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	address, ok := store.addresses[strings.ToLower(username)]
+	if !ok || address.Owner != identity.Name {
+		return &StatusError{Code: http.StatusNotFound, Message: "Lightning address not found"}
+	}
+	delete(store.addresses, address.Username)
+	store.save()
+	return nil
+}
+
+// lnurlMetadata returns the LUD-06 metadata of the address, the invoices
+// commit to its SHA-256 with their description hash.
+func lnurlMetadata(address *LightningAddress, domain string) string {
+	metadata, _ := json.Marshal([][]string{
+		{"text/plain", address.Description},
+		{"text/identifier", address.Username + "@" + domain},
+	})
+	return string(metadata)
+}
+
+// writeLnurlError writes an error in the format of LUD-06.
+func writeLnurlError(w http.ResponseWriter, reason string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"status": "ERROR", "reason": reason})
+}
+
+// lnurlMiddleware applies the IP rate limits to the public LNURL routes and
+// allows them to be called by web wallets.
+func lnurlMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if ok, retryAfter := getRateLimits().allowIP(clientIP(r)); !ok {
+			incMetric("ratelimit_ip")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeLnurlError(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// LnurlPayResponse is the first step of LUD-06.
+type LnurlPayResponse struct {
+	Tag         string `json:"tag"`
+	Callback    string `json:"callback"`
+	MinSendable int64  `json:"minSendable"`
+	MaxSendable int64  `json:"maxSendable"`
+	Metadata    string `json:"metadata"`
+	// Set when zaps are enabled (NIP-57)
+	AllowsNostr bool   `json:"allowsNostr,omitempty"`
+	NostrPubkey string `json:"nostrPubkey,omitempty"`
+}
+
+// LnurlInvoiceResponse is the response of the callback of LUD-06.
+type LnurlInvoiceResponse struct {
+	PR     string   `json:"pr"`
+	Routes []string `json:"routes"`
+}
+
+// lnurlPayHandler serves /.well-known/lnurlp/{username} (LUD-16).
+func lnurlPayHandler(w http.ResponseWriter, r *http.Request) {
+	address, ok := lightningAddresses.get(r.PathValue("username"))
+	if !ok {
+		writeLnurlError(w, "Unknown user", http.StatusNotFound)
+		return
+	}
+	response := LnurlPayResponse{
+		Tag:         "payRequest",
+		Callback:    "https://" + LNCD_LNURL_DOMAIN + "/lnurlp/" + address.Username + "/callback",
+		MinSendable: address.MinSendable,
+		MaxSendable: address.MaxSendable,
+		Metadata:    lnurlMetadata(address, LNCD_LNURL_DOMAIN),
+	}
+	if zapKey != nil {
+		response.AllowsNostr = true
+		response.NostrPubkey = nostrPublicKey(zapKey)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// lnurlCallbackHandler creates an invoice for ?amount= millisatoshis on the
+// node of the session of the address. If a zap request is sent in ?nostr=,
+// the invoice commits to it instead of the metadata and a zap receipt is
+// published when it is paid.
+func lnurlCallbackHandler(pool *ConnectionPool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		address, ok := lightningAddresses.get(r.PathValue("username"))
+		if !ok {
+			writeLnurlError(w, "Unknown user", http.StatusNotFound)
+			return
+		}
+		amount, err := strconv.ParseInt(r.URL.Query().Get("amount"), 10, 64)
+		if err != nil {
+			writeLnurlError(w, "Invalid amount", http.StatusBadRequest)
+			return
+		}
+		if amount < address.MinSendable || amount > address.MaxSendable {
+			writeLnurlError(w, fmt.Sprintf("Amount must be between %d and %d msat", address.MinSendable, address.MaxSendable), http.StatusBadRequest)
+			return
+		}
+
+		info, err := sessions.connection(address.Session)
+		if err != nil {
+			writeLnurlError(w, "Unknown user", http.StatusNotFound)
+			return
+		}
+		if err := authorizeCall(lnurlIdentity, info, "lnrpc.Lightning.AddInvoice"); err != nil {
+			var statusErr *StatusError
+			if errors.As(err, &statusErr) {
+				writeLnurlError(w, statusErr.Message, statusErr.Code)
+			} else {
+				writeLnurlError(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		descriptionHash := sha256.Sum256([]byte(lnurlMetadata(address, LNCD_LNURL_DOMAIN)))
+		var stopZap func() = func() {}
+		var zap bool
+		if zapRequest := r.URL.Query().Get("nostr"); zapRequest != "" && zapKey != nil {
+			request, relays, err := parseZapRequest(zapRequest, amount)
+			if err != nil {
+				writeLnurlError(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			descriptionHash = sha256.Sum256([]byte(zapRequest))
+			stopZap, err = watchZap(info, descriptionHash[:], zapRequest, request, relays)
+			if errors.Is(err, errTooManyZaps) {
+				writeLnurlError(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			} else if err != nil {
+				writeLnurlError(w, err.Error(), http.StatusConflict)
+				return
+			}
+			zap = true
+			log.Infof("Zap request %v for %v", request.ID, address.Username)
+		}
+		var invoiceRequest map[string]string = map[string]string{
+			"value_msat":       strconv.FormatInt(amount, 10),
+			"description_hash": base64.StdEncoding.EncodeToString(descriptionHash[:]),
+		}
+		if zap {
+			// the zap is only watched until the invoice expires
+			invoiceRequest["expiry"] = strconv.Itoa(int(zapInvoiceExpiry.Seconds()))
+		}
+		payload, _ := json.Marshal(invoiceRequest)
+		_, result, err := pool.call(r.Context(), info, address.Session, lnurlIdentity, "lnrpc.Lightning.AddInvoice", string(payload))
+		if err != nil {
+			stopZap()
+			log.Errorf("Unable to create invoice for %v: %v", address.Username, err)
+			writeLnurlError(w, "Unable to create invoice", http.StatusBadGateway)
+			return
+		}
+		var invoice struct {
+			PaymentRequest string `json:"payment_request"`
+		}
+		if err := json.Unmarshal([]byte(result), &invoice); err != nil {
+			stopZap()
+			writeLnurlError(w, "Unable to create invoice", http.StatusBadGateway)
+			return
+		}
+		log.Infof("Created invoice of %d msat for %v", amount, address.Username)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(LnurlInvoiceResponse{PR: invoice.PaymentRequest, Routes: []string{}})
+	}
+}
+
+func createLightningAddressHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var request LightningAddress
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := identityFromContext(r.Context())
+	if err := authorizeMethod(identity, "lnrpc.Lightning.AddInvoice"); err != nil {
+		writeError(w, err)
+		return
+	}
+	address, err := lightningAddresses.create(identity, request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Lightning address %v created by %v", address.Username, identity.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(address)
+}
+
+func listLightningAddressesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lightningAddresses.list(identityFromContext(r.Context())))
+}
+
+func deleteLightningAddressHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromContext(r.Context())
+	if err := lightningAddresses.delete(r.PathValue("username"), identity); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Lightning address %v deleted by %v", r.PathValue("username"), identity.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btclog"
+)
+
+func TestMain(m *testing.M) {
+	log = btclog.Disabled
+	os.Exit(m.Run())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+// Method classes, from the least to the most dangerous.
+const (
+	// Reads the state of the node
+	MethodClassRead = "read"
+	// Creates invoices or addresses to receive funds
+	MethodClassReceive = "receive"
+	// Moves funds out of the node or into channels
+	MethodClassSend = "send"
+	// Changes the configuration or the state of the node, or exposes
+	// sensitive data
+	MethodClassAdmin = "admin"
+)
+
+// methodClasses classifies every method that can be called through the
+// daemon. Methods missing from this list are treated as admin, so new
+// methods must be added here when they are registered.
+var methodClasses = map[string]string{
+	// Built-in methods
+	"canReceive":           MethodClassRead,
+	"checkPerms":           MethodClassRead,
+	"createInvoiceAndWait": MethodClassReceive,
+	"decodeInvoice":        MethodClassRead,
+	"explainPerms":         MethodClassRead,
+	"macaroonInfo":         MethodClassRead,
+	"nodeSummary":          MethodClassRead,
+
+	// lnrpc.Lightning
+	"lnrpc.Lightning.WalletBalance":            MethodClassRead,
+	"lnrpc.Lightning.ChannelBalance":           MethodClassRead,
+	"lnrpc.Lightning.GetTransactions":          MethodClassRead,
+	"lnrpc.Lightning.EstimateFee":              MethodClassRead,
+	"lnrpc.Lightning.SendCoins":                MethodClassSend,
+	"lnrpc.Lightning.ListUnspent":              MethodClassRead,
+	"lnrpc.Lightning.SubscribeTransactions":    MethodClassRead,
+	"lnrpc.Lightning.SendMany":                 MethodClassSend,
+	"lnrpc.Lightning.NewAddress":               MethodClassReceive,
+	"lnrpc.Lightning.SignMessage":              MethodClassAdmin,
+	"lnrpc.Lightning.VerifyMessage":            MethodClassRead,
+	"lnrpc.Lightning.ConnectPeer":              MethodClassAdmin,
+	"lnrpc.Lightning.DisconnectPeer":           MethodClassAdmin,
+	"lnrpc.Lightning.ListPeers":                MethodClassRead,
+	"lnrpc.Lightning.SubscribePeerEvents":      MethodClassRead,
+	"lnrpc.Lightning.GetInfo":                  MethodClassRead,
+	"lnrpc.Lightning.GetDebugInfo":             MethodClassAdmin,
+	"lnrpc.Lightning.GetRecoveryInfo":          MethodClassRead,
+	"lnrpc.Lightning.PendingChannels":          MethodClassRead,
+	"lnrpc.Lightning.ListChannels":             MethodClassRead,
+	"lnrpc.Lightning.SubscribeChannelEvents":   MethodClassRead,
+	"lnrpc.Lightning.ClosedChannels":           MethodClassRead,
+	"lnrpc.Lightning.OpenChannelSync":          MethodClassSend,
+	"lnrpc.Lightning.OpenChannel":              MethodClassSend,
+	"lnrpc.Lightning.BatchOpenChannel":         MethodClassSend,
+	"lnrpc.Lightning.FundingStateStep":         MethodClassSend,
+	"lnrpc.Lightning.CloseChannel":             MethodClassSend,
+	"lnrpc.Lightning.AbandonChannel":           MethodClassAdmin,
+	"lnrpc.Lightning.SendPayment":              MethodClassSend,
+	"lnrpc.Lightning.SendPaymentSync":          MethodClassSend,
+	"lnrpc.Lightning.SendToRoute":              MethodClassSend,
+	"lnrpc.Lightning.SendToRouteSync":          MethodClassSend,
+	"lnrpc.Lightning.AddInvoice":               MethodClassReceive,
+	"lnrpc.Lightning.ListInvoices":             MethodClassRead,
+	"lnrpc.Lightning.LookupInvoice":            MethodClassRead,
+	"lnrpc.Lightning.SubscribeInvoices":        MethodClassRead,
+	"lnrpc.Lightning.DecodePayReq":             MethodClassRead,
+	"lnrpc.Lightning.ListPayments":             MethodClassRead,
+	"lnrpc.Lightning.DeletePayment":            MethodClassAdmin,
+	"lnrpc.Lightning.DeleteAllPayments":        MethodClassAdmin,
+	"lnrpc.Lightning.DescribeGraph":            MethodClassRead,
+	"lnrpc.Lightning.GetNodeMetrics":           MethodClassRead,
+	"lnrpc.Lightning.GetChanInfo":              MethodClassRead,
+	"lnrpc.Lightning.GetNodeInfo":              MethodClassRead,
+	"lnrpc.Lightning.QueryRoutes":              MethodClassRead,
+	"lnrpc.Lightning.GetNetworkInfo":           MethodClassRead,
+	"lnrpc.Lightning.StopDaemon":               MethodClassAdmin,
+	"lnrpc.Lightning.SubscribeChannelGraph":    MethodClassRead,
+	"lnrpc.Lightning.DebugLevel":               MethodClassAdmin,
+	"lnrpc.Lightning.FeeReport":                MethodClassRead,
+	"lnrpc.Lightning.UpdateChannelPolicy":      MethodClassAdmin,
+	"lnrpc.Lightning.ForwardingHistory":        MethodClassRead,
+	"lnrpc.Lightning.ExportChannelBackup":      MethodClassAdmin,
+	"lnrpc.Lightning.ExportAllChannelBackups":  MethodClassAdmin,
+	"lnrpc.Lightning.VerifyChanBackup":         MethodClassRead,
+	"lnrpc.Lightning.RestoreChannelBackups":    MethodClassAdmin,
+	"lnrpc.Lightning.SubscribeChannelBackups":  MethodClassAdmin,
+	"lnrpc.Lightning.BakeMacaroon":             MethodClassAdmin,
+	"lnrpc.Lightning.ListMacaroonIDs":          MethodClassRead,
+	"lnrpc.Lightning.DeleteMacaroonID":         MethodClassAdmin,
+	"lnrpc.Lightning.ListPermissions":          MethodClassRead,
+	"lnrpc.Lightning.CheckMacaroonPermissions": MethodClassRead,
+	"lnrpc.Lightning.SendCustomMessage":        MethodClassAdmin,
+	"lnrpc.Lightning.SubscribeCustomMessages":  MethodClassRead,
+	"lnrpc.Lightning.ListAliases":              MethodClassRead,
+	"lnrpc.Lightning.LookupHtlcResolution":     MethodClassRead,
+
+	// routerrpc.Router
+	"routerrpc.Router.SendPaymentV2":           MethodClassSend,
+	"routerrpc.Router.TrackPaymentV2":          MethodClassRead,
+	"routerrpc.Router.TrackPayments":           MethodClassRead,
+	"routerrpc.Router.EstimateRouteFee":        MethodClassRead,
+	"routerrpc.Router.SendToRoute":             MethodClassSend,
+	"routerrpc.Router.SendToRouteV2":           MethodClassSend,
+	"routerrpc.Router.ResetMissionControl":     MethodClassAdmin,
+	"routerrpc.Router.QueryMissionControl":     MethodClassRead,
+	"routerrpc.Router.XImportMissionControl":   MethodClassAdmin,
+	"routerrpc.Router.GetMissionControlConfig": MethodClassRead,
+	"routerrpc.Router.SetMissionControlConfig": MethodClassAdmin,
+	"routerrpc.Router.QueryProbability":        MethodClassRead,
+	"routerrpc.Router.BuildRoute":              MethodClassRead,
+	"routerrpc.Router.SubscribeHtlcEvents":     MethodClassRead,
+	"routerrpc.Router.SendPayment":             MethodClassSend,
+	"routerrpc.Router.TrackPayment":            MethodClassRead,
+	"routerrpc.Router.UpdateChanStatus":        MethodClassAdmin,
+
+	// invoicesrpc.Invoices
+	"invoicesrpc.Invoices.SubscribeSingleInvoice": MethodClassRead,
+	"invoicesrpc.Invoices.CancelInvoice":          MethodClassReceive,
+	"invoicesrpc.Invoices.AddHoldInvoice":         MethodClassReceive,
+	"invoicesrpc.Invoices.SettleInvoice":          MethodClassReceive,
+	"invoicesrpc.Invoices.LookupInvoiceV2":        MethodClassRead,
+}
+
+// methodClass returns the class of the method, unknown methods are admin.
+func methodClass(method string) string {
+	if class, ok := methodClasses[method]; ok {
+		return class
+	}
+	return MethodClassAdmin
+}
+
+// checkMethodClasses logs the registered methods that are missing from the
+// classification, so they don't go unnoticed when lnd is updated.
+func checkMethodClasses() {
+	registry := make(map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)))
+	lnrpc.RegisterLightningJSONCallbacks(registry)
+	for method := range registry {
+		if _, ok := methodClasses[method]; !ok {
+			log.Warnf("Method %v is not classified, it will be treated as %v", method, MethodClassAdmin)
+		}
+	}
+}
+
+var (
+	knownMethodsOnce sync.Once
+	knownMethods     map[string]bool
+)
+
+// isKnownMethod returns true if the method is a built-in or is registered
+// on the connections.
+func isKnownMethod(method string) bool {
+	knownMethodsOnce.Do(func() {
+		registry := make(map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)))
+		lnrpc.RegisterLightningJSONCallbacks(registry)
+		knownMethods = make(map[string]bool, len(registry)+len(builtins))
+		for method := range registry {
+			knownMethods[method] = true
+		}
+		for method := range builtins {
+			knownMethods[method] = true
+		}
+	})
+	return knownMethods[method]
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"sync"
+)
+
+// Counters of notable events, exposed in the stats.
+var (
+	metricsMutex sync.Mutex
+	metrics      = map[string]uint64{}
+)
+
+func incMetric(name string) {
+	metricsMutex.Lock()
+	metrics[name]++
+	metricsMutex.Unlock()
+}
+
+func getMetrics() map[string]uint64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	snapshot := make(map[string]uint64, len(metrics))
+	for name, value := range metrics {
+		snapshot[name] = value
+	}
+	return snapshot
+}
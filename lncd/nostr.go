@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"github.com/gorilla/websocket"
+)
+
+const nostrRelayTimeout = 10 * time.Second
+
+// NostrEvent is a NIP-01 event.
+type NostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// hash returns the SHA-256 of the serialized event, that is its ID.
+func (event *NostrEvent) hash() ([]byte, error) {
+	var tags [][]string = event.Tags
+	if tags == nil {
+		tags = [][]string{}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode([]interface{}{0, event.PubKey, event.CreatedAt, event.Kind, tags, event.Content}); err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return hash[:], nil
+}
+
+// sign sets the public key, the ID and the signature of the event.
+func (event *NostrEvent) sign(key *btcec.PrivateKey) error {
+	if event.Tags == nil {
+		event.Tags = [][]string{}
+	}
+	event.PubKey = nostrPublicKey(key)
+	hash, err := event.hash()
+	if err != nil {
+		return err
+	}
+	sig, err := schnorr.Sign(key, hash)
+	if err != nil {
+		return err
+	}
+	event.ID = hex.EncodeToString(hash)
+	event.Sig = hex.EncodeToString(sig.Serialize())
+	return nil
+}
+
+// verify checks the ID and the signature of the event.
+func (event *NostrEvent) verify() error {
+	hash, err := event.hash()
+	if err != nil {
+		return err
+	}
+	if event.ID != hex.EncodeToString(hash) {
+		return errors.New("invalid event id")
+	}
+	pubKey, err := parseNostrPublicKey(event.PubKey)
+	if err != nil {
+		return err
+	}
+	sigBytes, err := hex.DecodeString(event.Sig)
+	if err != nil {
+		return errors.New("invalid event signature")
+	}
+	sig, err := schnorr.ParseSignature(sigBytes)
+	if err != nil || !sig.Verify(hash, pubKey) {
+		return errors.New("invalid event signature")
+	}
+	return nil
+}
+
+// tag returns the first value of the tag with the given name.
+func (event *NostrEvent) tag(name string) string {
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == name {
+			return tag[1]
+		}
+	}
+	return ""
+}
+
+// nostrPublicKey returns the hex encoded x-only public key of a private key.
+func nostrPublicKey(key *btcec.PrivateKey) string {
+	return hex.EncodeToString(schnorr.SerializePubKey(key.PubKey()))
+}
+
+func parseNostrPublicKey(pubKey string) (*btcec.PublicKey, error) {
+	data, err := hex.DecodeString(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q", pubKey)
+	}
+	return schnorr.ParsePubKey(data)
+}
+
+func parseNostrPrivateKey(key string) (*btcec.PrivateKey, error) {
+	data, err := hex.DecodeString(key)
+	if err != nil || len(data) != 32 {
+		return nil, errors.New("invalid private key")
+	}
+	privKey, _ := btcec.PrivKeyFromBytes(data)
+	return privKey, nil
+}
+
+// newNostrPrivateKey returns a random private key, hex encoded.
+func newNostrPrivateKey() (string, error) {
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key.Serialize()), nil
+}
+
+// nip04Key returns the AES key shared by key and the owner of pubKey.
+func nip04Key(key *btcec.PrivateKey, pubKey string) ([]byte, error) {
+	pub, err := parseNostrPublicKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
+	return btcec.GenerateSharedSecret(key, pub), nil
+}
+
+// nip04Encrypt encrypts a direct message for pubKey (NIP-04).
+func nip04Encrypt(key *btcec.PrivateKey, pubKey string, plaintext string) (string, error) {
+	sharedKey, err := nip04Key(key, pubKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+
+	padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+	data := append([]byte(plaintext), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return base64.StdEncoding.EncodeToString(data) + "?iv=" + base64.StdEncoding.EncodeToString(iv), nil
+}
+
+// nip04Decrypt decrypts a direct message from pubKey (NIP-04).
+func nip04Decrypt(key *btcec.PrivateKey, pubKey string, content string) (string, error) {
+	ciphertext, ivText, ok := strings.Cut(content, "?iv=")
+	if !ok {
+		return "", errors.New("invalid encrypted content")
+	}
+	data, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", errors.New("invalid encrypted content")
+	}
+	iv, err := base64.StdEncoding.DecodeString(ivText)
+	if err != nil || len(iv) != aes.BlockSize || len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return "", errors.New("invalid encrypted content")
+	}
+
+	sharedKey, err := nip04Key(key, pubKey)
+	if err != nil {
+		return "", err
+	}
+	block, err := aes.NewCipher(sharedKey)
+	if err != nil {
+		return "", err
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	padding := int(data[len(data)-1])
+	if padding < 1 || padding > aes.BlockSize {
+		return "", errors.New("invalid padding")
+	}
+	return string(data[:len(data)-padding]), nil
+}
+
+// validateRelayURL checks that a relay URL can be used.
+func validateRelayURL(relayURL string) error {
+	parsed, err := url.Parse(relayURL)
+	if err != nil || (parsed.Scheme != "ws" && parsed.Scheme != "wss") || parsed.Host == "" {
+		return fmt.Errorf("invalid relay URL %q", relayURL)
+	}
+	return nil
+}
+
+// nostrRelay is a websocket connection to a relay (NIP-01).
+type nostrRelay struct {
+	url        string
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+}
+
+func dialNostrRelay(ctx context.Context, dialer *websocket.Dialer, relayURL string) (*nostrRelay, error) {
+	ctx, cancel := context.WithTimeout(ctx, nostrRelayTimeout)
+	defer cancel()
+	conn, _, err := dialer.DialContext(ctx, relayURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &nostrRelay{url: relayURL, conn: conn}, nil
+}
+
+// send writes a message, messages are JSON arrays.
+func (relay *nostrRelay) send(message ...interface{}) error {
+	relay.writeMutex.Lock()
+	defer relay.writeMutex.Unlock()
+	relay.conn.SetWriteDeadline(time.Now().Add(nostrRelayTimeout))
+	return relay.conn.WriteJSON(message)
+}
+
+func (relay *nostrRelay) publish(event *NostrEvent) error {
+	return relay.send("EVENT", event)
+}
+
+// read returns the next message, split in its type and arguments.
+func (relay *nostrRelay) read() (string, []json.RawMessage, error) {
+	var message []json.RawMessage
+	if err := relay.conn.ReadJSON(&message); err != nil {
+		return "", nil, err
+	}
+	var messageType string
+	if len(message) == 0 || json.Unmarshal(message[0], &messageType) != nil {
+		return "", nil, errors.New("invalid relay message")
+	}
+	return messageType, message[1:], nil
+}
+
+func (relay *nostrRelay) Close() {
+	relay.conn.Close()
+}
+
+// publishNostrEvent publishes an event to a relay and waits for the relay
+// to accept it.
+func publishNostrEvent(ctx context.Context, dialer *websocket.Dialer, relayURL string, event *NostrEvent) error {
+	relay, err := dialNostrRelay(ctx, dialer, relayURL)
+	if err != nil {
+		return err
+	}
+	defer relay.Close()
+	if err := relay.publish(event); err != nil {
+		return err
+	}
+
+	relay.conn.SetReadDeadline(time.Now().Add(nostrRelayTimeout))
+	for {
+		messageType, args, err := relay.read()
+		if err != nil {
+			return err
+		}
+		if messageType != "OK" || len(args) < 2 {
+			continue
+		}
+		var id, reason string
+		var accepted bool
+		json.Unmarshal(args[0], &id)
+		json.Unmarshal(args[1], &accepted)
+		if len(args) > 2 {
+			json.Unmarshal(args[2], &reason)
+		}
+		if id != event.ID {
+			continue
+		}
+		if !accepted {
+			return fmt.Errorf("event rejected by %v: %v", relayURL, reason)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/gorilla/websocket"
+)
+
+// testRelay is a minimal NIP-01 relay that stores every event and sends it
+// to the matching subscriptions.
+type testRelay struct {
+	server        *httptest.Server
+	url           string
+	events        []*NostrEvent
+	subscriptions map[*testRelayClient]map[string]testFilter
+	mutex         sync.Mutex
+}
+
+type testRelayClient struct {
+	conn  *websocket.Conn
+	mutex sync.Mutex
+}
+
+func (client *testRelayClient) send(message ...interface{}) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.conn.WriteJSON(message)
+}
+
+// testFilter is the part of the NIP-01 filters used by the daemon.
+type testFilter struct {
+	Kinds   []int    `json:"kinds"`
+	Authors []string `json:"authors"`
+	P       []string `json:"#p"`
+	Since   int64    `json:"since"`
+}
+
+func (filter testFilter) matches(event *NostrEvent) bool {
+	contains := func(values []string, value string) bool {
+		for _, v := range values {
+			if v == value {
+				return true
+			}
+		}
+		return len(values) == 0
+	}
+	kindMatches := len(filter.Kinds) == 0
+	for _, kind := range filter.Kinds {
+		kindMatches = kindMatches || kind == event.Kind
+	}
+	return kindMatches && contains(filter.Authors, event.PubKey) && contains(filter.P, event.tag("p")) && event.CreatedAt >= filter.Since
+}
+
+func newTestRelay(t *testing.T) *testRelay {
+	relay := &testRelay{subscriptions: make(map[*testRelayClient]map[string]testFilter)}
+	upgrader := websocket.Upgrader{}
+	relay.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		client := &testRelayClient{conn: conn}
+		defer func() {
+			relay.mutex.Lock()
+			delete(relay.subscriptions, client)
+			relay.mutex.Unlock()
+		}()
+		for {
+			var message []json.RawMessage
+			if err := conn.ReadJSON(&message); err != nil {
+				return
+			}
+			var messageType string
+			if len(message) < 2 || json.Unmarshal(message[0], &messageType) != nil {
+				continue
+			}
+			switch messageType {
+			case "EVENT":
+				relay.publish(client, message[1])
+			case "REQ":
+				relay.subscribe(client, message[1:])
+			case "CLOSE":
+				var id string
+				json.Unmarshal(message[1], &id)
+				relay.mutex.Lock()
+				delete(relay.subscriptions[client], id)
+				relay.mutex.Unlock()
+			}
+		}
+	}))
+	relay.url = "ws" + strings.TrimPrefix(relay.server.URL, "http")
+	t.Cleanup(relay.server.Close)
+	return relay
+}
+
+// publish stores an event and sends it to the subscriptions it matches.
+func (relay *testRelay) publish(client *testRelayClient, data json.RawMessage) {
+	var event NostrEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	type delivery struct {
+		client *testRelayClient
+		id     string
+	}
+	var deliveries []delivery
+	relay.mutex.Lock()
+	relay.events = append(relay.events, &event)
+	for subscriber, filters := range relay.subscriptions {
+		for id, filter := range filters {
+			if filter.matches(&event) {
+				deliveries = append(deliveries, delivery{subscriber, id})
+			}
+		}
+	}
+	relay.mutex.Unlock()
+
+	client.send("OK", event.ID, true, "")
+	for _, delivery := range deliveries {
+		delivery.client.send("EVENT", delivery.id, &event)
+	}
+}
+
+// subscribe adds a subscription and sends the stored events it matches.
+func (relay *testRelay) subscribe(client *testRelayClient, args []json.RawMessage) {
+	var id string
+	var filter testFilter
+	if len(args) < 2 || json.Unmarshal(args[0], &id) != nil || json.Unmarshal(args[1], &filter) != nil {
+		return
+	}
+	var stored []*NostrEvent
+	relay.mutex.Lock()
+	if relay.subscriptions[client] == nil {
+		relay.subscriptions[client] = make(map[string]testFilter)
+	}
+	relay.subscriptions[client][id] = filter
+	for _, event := range relay.events {
+		if filter.matches(event) {
+			stored = append(stored, event)
+		}
+	}
+	relay.mutex.Unlock()
+
+	for _, event := range stored {
+		client.send("EVENT", id, event)
+	}
+	client.send("EOSE", id)
+}
+
+// waitEvents waits until the relay received count events and returns them.
+func (relay *testRelay) waitEvents(t *testing.T, count int) []*NostrEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		relay.mutex.Lock()
+		events := append([]*NostrEvent{}, relay.events...)
+		relay.mutex.Unlock()
+		if len(events) >= count {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("relay didn't receive %d events", count)
+	return nil
+}
+
+// waitEvent waits until the relay received an event that matches and
+// returns it.
+func (relay *testRelay) waitEvent(t *testing.T, match func(*NostrEvent) bool) *NostrEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		relay.mutex.Lock()
+		for _, event := range relay.events {
+			if match(event) {
+				relay.mutex.Unlock()
+				return event
+			}
+		}
+		relay.mutex.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("relay didn't receive the expected event")
+	return nil
+}
+
+func newTestNostrKey(t *testing.T) *btcec.PrivateKey {
+	t.Helper()
+	key, err := btcec.NewPrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNostrEventHashDoesNotEscapeHTML(t *testing.T) {
+	event := &NostrEvent{
+		PubKey:    "aa",
+		CreatedAt: 1700000000,
+		Kind:      1,
+		Tags:      [][]string{{"r", "https://example.com/?a=1&b=2"}},
+		Content:   "<b>zap</b> & more",
+	}
+	hash, err := event.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serialized := `[0,"aa",1700000000,1,[["r","https://example.com/?a=1&b=2"]],"<b>zap</b> & more"]`
+	expected := sha256.Sum256([]byte(serialized))
+	if hex.EncodeToString(hash) != hex.EncodeToString(expected[:]) {
+		t.Fatalf("hash is not computed on the NIP-01 serialization %s", serialized)
+	}
+}
+
+func TestNostrEventSignAndVerify(t *testing.T) {
+	key := newTestNostrKey(t)
+	event := &NostrEvent{CreatedAt: time.Now().Unix(), Kind: 1, Content: "<hello>"}
+	if err := event.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if event.PubKey != nostrPublicKey(key) {
+		t.Fatalf("unexpected public key %v", event.PubKey)
+	}
+	if err := event.verify(); err != nil {
+		t.Fatalf("signed event doesn't verify: %v", err)
+	}
+
+	event.Content = "tampered"
+	if err := event.verify(); err == nil {
+		t.Fatal("tampered event verifies")
+	}
+}
+
+func TestNip04RoundTrip(t *testing.T) {
+	alice, bob := newTestNostrKey(t), newTestNostrKey(t)
+	encrypted, err := nip04Encrypt(alice, nostrPublicKey(bob), `{"method":"get_balance"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := nip04Decrypt(bob, nostrPublicKey(alice), encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != `{"method":"get_balance"}` {
+		t.Fatalf("unexpected plaintext %q", decrypted)
+	}
+}
@@ -0,0 +1,840 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/gorilla/websocket"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Event kinds of NIP-47
+const (
+	nwcInfoKind     = 13194
+	nwcRequestKind  = 23194
+	nwcResponseKind = 23195
+)
+
+const (
+	nwcMinBackoff = time.Second
+	nwcMaxBackoff = time.Minute
+)
+
+// Error codes of NIP-47
+const (
+	nwcRateLimited         = "RATE_LIMITED"
+	nwcNotImplemented      = "NOT_IMPLEMENTED"
+	nwcInsufficientBalance = "INSUFFICIENT_BALANCE"
+	nwcQuotaExceeded       = "QUOTA_EXCEEDED"
+	nwcRestricted          = "RESTRICTED"
+	nwcInternal            = "INTERNAL"
+	nwcPaymentFailed       = "PAYMENT_FAILED"
+	nwcNotFound            = "NOT_FOUND"
+	nwcOther               = "OTHER"
+)
+
+// Commands supported by the bridge, published in the info event
+var nwcCommands = []string{"pay_invoice", "make_invoice", "get_balance", "lookup_invoice", "list_transactions"}
+
+// Methods called by the commands, the identity of each connection is
+// restricted to them
+var nwcMethods = []string{
+	"lnrpc.Lightning.SendPaymentSync",
+	"lnrpc.Lightning.AddInvoice",
+	"lnrpc.Lightning.ChannelBalance",
+	"lnrpc.Lightning.LookupInvoice",
+	"lnrpc.Lightning.ListInvoices",
+	"lnrpc.Lightning.ListPayments",
+}
+
+// NWCConnection is a Nostr Wallet Connect (NIP-47) connection to the node
+// of a session. The payments of each connection are limited by its own
+// budget, on top of the spending limits of the daemon.
+type NWCConnection struct {
+	ID      string
+	Owner   string
+	Session string
+	Relay   string
+	// Secret key of the wallet service
+	WalletKey string
+	// Public key of the client, its secret is only returned in the
+	// connection URI when the connection is created
+	ClientPubKey   string
+	MaxPaymentSat  int64
+	DailyBudgetSat int64
+	Created        time.Time
+}
+
+// NWCStore keeps the NWC connections in memory and optionally in a JSON
+// file, and runs their services.
+type NWCStore struct {
+	pool        *ConnectionPool
+	path        string
+	connections map[string]*NWCConnection
+	cancel      map[string]context.CancelFunc
+	mutex       sync.Mutex
+}
+
+var nwcConnections *NWCStore
+
+func NewNWCStore(pool *ConnectionPool, path string) (*NWCStore, error) {
+	store := &NWCStore{
+		pool:        pool,
+		path:        path,
+		connections: make(map[string]*NWCConnection),
+		cancel:      make(map[string]context.CancelFunc),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.connections); err != nil {
+		return nil, fmt.Errorf("invalid NWC file %v: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes the connections to disk, must be called with the mutex held.
+func (store *NWCStore) save() {
+	if store.path == "" {
+		return
+	}
+	if err := saveJSONFile(store.path, store.connections); err != nil {
+		log.Errorf("Unable to save NWC connections: %v", err)
+	}
+}
+
+// start runs the services of the stored connections.
+func (store *NWCStore) start() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	for _, connection := range store.connections {
+		if err := store.serve(connection); err != nil {
+			log.Errorf("Unable to start NWC connection %v: %v", connection.ID, err)
+		}
+	}
+}
+
+// serve starts the service of a connection, must be called with the mutex
+// held.
+func (store *NWCStore) serve(connection *NWCConnection) error {
+	walletKey, err := parseNostrPrivateKey(connection.WalletKey)
+	if err != nil {
+		return err
+	}
+	service := &nwcService{
+		pool:       store.pool,
+		connection: *connection,
+		walletKey:  walletKey,
+		identity: &Identity{
+			Name:    "nwc:" + connection.ID,
+			Methods: nwcMethods,
+			owner:   connection.Owner,
+			spending: &SpendingLimits{
+				MaxPaymentSat:  connection.MaxPaymentSat,
+				DailyBudgetSat: connection.DailyBudgetSat,
+			},
+		},
+		handled: make(map[string]int64),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	store.cancel[connection.ID] = cancel
+	go service.run(ctx)
+	return nil
+}
+
+// NWCRequest is the body of POST /nwc. If Relay is not set, LNCD_NWC_RELAY
+// is used.
+type NWCRequest struct {
+	Session        string
+	Relay          string
+	MaxPaymentSat  int64
+	DailyBudgetSat int64
+}
+
+// create adds a connection and returns it with its connection URI.
+func (store *NWCStore) create(owner *Identity, request NWCRequest) (*NWCConnection, string, error) {
+	if request.Relay == "" {
+		request.Relay = LNCD_NWC_RELAY
+	}
+	if err := validateRelayURL(request.Relay); err != nil {
+		return nil, "", &StatusError{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	if request.MaxPaymentSat < 0 || request.DailyBudgetSat < 0 {
+		return nil, "", &StatusError{Code: http.StatusBadRequest, Message: "invalid MaxPaymentSat or DailyBudgetSat"}
+	}
+	// the connection can't spend more than its owner
+	if limits := owner.spending; limits.isSet() {
+		if limits.MaxPaymentSat > 0 && (request.MaxPaymentSat == 0 || request.MaxPaymentSat > limits.MaxPaymentSat) {
+			request.MaxPaymentSat = limits.MaxPaymentSat
+		}
+		if limits.DailyBudgetSat > 0 {
+			if request.DailyBudgetSat == 0 {
+				return nil, "", &StatusError{Code: http.StatusBadRequest, Message: "DailyBudgetSat is required, the token has a daily budget"}
+			}
+			request.DailyBudgetSat = min(request.DailyBudgetSat, limits.DailyBudgetSat)
+		}
+	}
+	// the session must belong to the identity that creates the connection
+	if _, err := sessions.get(request.Session, owner); err != nil {
+		return nil, "", err
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		return nil, "", err
+	}
+	walletKey, err := newNostrPrivateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	clientSecret, err := newNostrPrivateKey()
+	if err != nil {
+		return nil, "", err
+	}
+	walletPrivKey, _ := parseNostrPrivateKey(walletKey)
+	clientPrivKey, _ := parseNostrPrivateKey(clientSecret)
+
+	connection := &NWCConnection{
+		ID:             id,
+		Owner:          owner.Name,
+		Session:        request.Session,
+		Relay:          request.Relay,
+		WalletKey:      walletKey,
+		ClientPubKey:   nostrPublicKey(clientPrivKey),
+		MaxPaymentSat:  request.MaxPaymentSat,
+		DailyBudgetSat: request.DailyBudgetSat,
+		Created:        time.Now(),
+	}
+	uri := "nostr+walletconnect://" + nostrPublicKey(walletPrivKey) + "?relay=" + url.QueryEscape(request.Relay) + "&secret=" + clientSecret
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.connections[id] = connection
+	store.save()
+	if err := store.serve(connection); err != nil {
+		return nil, "", err
+	}
+	connectionCopy := *connection
+	return &connectionCopy, uri, nil
+}
+
+func (store *NWCStore) list(identity *Identity) []*NWCConnection {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var owned []*NWCConnection = []*NWCConnection{}
+	for _, connection := range store.connections {
+		if connection.Owner == identity.Name {
+			connectionCopy := *connection
+			owned = append(owned, &connectionCopy)
+		}
+	}
+	return owned
+}
+
+func (store *NWCStore) delete(id string, identity *Identity) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	connection, ok := store.connections[id]
+	if !ok || connection.Owner != identity.Name {
+		return &StatusError{Code: http.StatusNotFound, Message: "NWC connection not found"}
+	}
+	delete(store.connections, id)
+	store.save()
+	if cancel, ok := store.cancel[id]; ok {
+		cancel()
+		delete(store.cancel, id)
+	}
+	return nil
+}
+
+// nwcService listens for the requests of a connection on its relay and
+// executes them on the node of its session.
+type nwcService struct {
+	pool       *ConnectionPool
+	connection NWCConnection
+	walletKey  *btcec.PrivateKey
+	identity   *Identity
+	// created_at of the last request, to resume after reconnecting
+	since int64
+	// requests already handled, relays may send them again
+	handled map[string]int64
+	mutex   sync.Mutex
+}
+
+// run keeps the service connected to the relay, reconnecting with an
+// exponential backoff, until it is canceled.
+func (service *nwcService) run(ctx context.Context) {
+	service.since = time.Now().Unix()
+	var backoff time.Duration = nwcMinBackoff
+	for {
+		connected, err := service.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = nwcMinBackoff
+		}
+		log.Infof("NWC connection %v interrupted, reconnecting in %v: %v", service.connection.ID, backoff, err)
+		incMetric("nwc_reconnects")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > nwcMaxBackoff {
+			backoff = nwcMaxBackoff
+		}
+	}
+}
+
+// listen subscribes to the requests and handles them until the relay
+// connection fails. It returns true if the subscription was established.
+func (service *nwcService) listen(ctx context.Context) (bool, error) {
+	relay, err := dialNostrRelay(ctx, websocket.DefaultDialer, service.connection.Relay)
+	if err != nil {
+		return false, err
+	}
+	defer relay.Close()
+	// unblock the reads when the service is canceled
+	stop := context.AfterFunc(ctx, relay.Close)
+	defer stop()
+
+	info := &NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      nwcInfoKind,
+		Content:   strings.Join(nwcCommands, " "),
+	}
+	if err := info.sign(service.walletKey); err != nil {
+		return false, err
+	}
+	if err := relay.publish(info); err != nil {
+		return false, err
+	}
+
+	service.mutex.Lock()
+	since := service.since
+	service.mutex.Unlock()
+	err = relay.send("REQ", "nwc-"+service.connection.ID, map[string]interface{}{
+		"kinds":   []int{nwcRequestKind},
+		"authors": []string{service.connection.ClientPubKey},
+		"#p":      []string{nostrPublicKey(service.walletKey)},
+		"since":   since,
+	})
+	if err != nil {
+		return false, err
+	}
+	log.Infof("NWC connection %v listening on %v", service.connection.ID, service.connection.Relay)
+
+	for {
+		messageType, args, err := relay.read()
+		if err != nil {
+			return true, err
+		}
+		switch messageType {
+		case "EVENT":
+			var event NostrEvent
+			if len(args) < 2 || json.Unmarshal(args[1], &event) != nil {
+				continue
+			}
+			if service.accept(&event) {
+				go service.handle(ctx, relay, &event)
+			}
+		case "OK":
+			var accepted bool
+			var reason string
+			if len(args) >= 3 {
+				json.Unmarshal(args[1], &accepted)
+				json.Unmarshal(args[2], &reason)
+				if !accepted {
+					log.Infof("NWC event rejected by %v: %v", service.connection.Relay, reason)
+				}
+			}
+		case "NOTICE", "CLOSED":
+			log.Infof("NWC relay %v: %s", service.connection.Relay, args)
+		}
+	}
+}
+
+// accept checks that the event is a valid request of the client that
+// wasn't handled yet.
+func (service *nwcService) accept(event *NostrEvent) bool {
+	if event.Kind != nwcRequestKind || event.PubKey != service.connection.ClientPubKey || event.tag("p") != nostrPublicKey(service.walletKey) {
+		return false
+	}
+	if expiration, err := strconv.ParseInt(event.tag("expiration"), 10, 64); err == nil && expiration < time.Now().Unix() {
+		return false
+	}
+	if err := event.verify(); err != nil {
+		log.Infof("Invalid NWC request: %v", err)
+		return false
+	}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if _, ok := service.handled[event.ID]; ok {
+		return false
+	}
+	service.handled[event.ID] = event.CreatedAt
+	if event.CreatedAt > service.since {
+		service.since = event.CreatedAt
+	}
+	if len(service.handled) > 1000 {
+		for id, createdAt := range service.handled {
+			if createdAt < service.since-3600 {
+				delete(service.handled, id)
+			}
+		}
+	}
+	return true
+}
+
+type nwcRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type nwcError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *nwcError) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+type nwcResponse struct {
+	ResultType string      `json:"result_type"`
+	Error      *nwcError   `json:"error,omitempty"`
+	Result     interface{} `json:"result,omitempty"`
+}
+
+// handle executes a request and publishes the encrypted response.
+func (service *nwcService) handle(ctx context.Context, relay *nostrRelay, event *NostrEvent) {
+	response := nwcResponse{}
+	plaintext, err := nip04Decrypt(service.walletKey, event.PubKey, event.Content)
+	var request nwcRequest
+	if err == nil {
+		err = json.Unmarshal([]byte(plaintext), &request)
+	}
+	if err != nil {
+		response.Error = &nwcError{Code: nwcOther, Message: "invalid request"}
+	} else {
+		log.Infof("NWC connection %v: %v", service.connection.ID, request.Method)
+		incMetric("nwc_requests")
+		response.ResultType = request.Method
+		response.Result, err = service.execute(ctx, request)
+		if err != nil {
+			response.Error = nwcErrorFrom(err)
+			log.Infof("NWC %v failed: %v", request.Method, err)
+		}
+	}
+
+	content, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Unable to encode NWC response: %v", err)
+		return
+	}
+	encrypted, err := nip04Encrypt(service.walletKey, event.PubKey, string(content))
+	if err != nil {
+		log.Errorf("Unable to encrypt NWC response: %v", err)
+		return
+	}
+	reply := &NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      nwcResponseKind,
+		Tags:      [][]string{{"p", event.PubKey}, {"e", event.ID}},
+		Content:   encrypted,
+	}
+	if err := reply.sign(service.walletKey); err != nil {
+		log.Errorf("Unable to sign NWC response: %v", err)
+		return
+	}
+	if err := relay.publish(reply); err != nil {
+		log.Errorf("Unable to publish NWC response: %v", err)
+	}
+}
+
+// nwcErrorFrom maps the errors of the daemon and of the node to the error
+// codes of NIP-47.
+func nwcErrorFrom(err error) *nwcError {
+	var nwcErr *nwcError
+	if errors.As(err, &nwcErr) {
+		return nwcErr
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.Code == http.StatusTooManyRequests:
+			return &nwcError{Code: nwcRateLimited, Message: statusErr.Message}
+		case statusErr.Code == http.StatusForbidden && (strings.Contains(statusErr.Message, "spending policy") || strings.Contains(statusErr.Message, "daily budget exceeded")):
+			return &nwcError{Code: nwcQuotaExceeded, Message: statusErr.Message}
+		case statusErr.Code == http.StatusForbidden:
+			return &nwcError{Code: nwcRestricted, Message: statusErr.Message}
+		}
+	}
+	if strings.Contains(err.Error(), "unable to locate invoice") {
+		return &nwcError{Code: nwcNotFound, Message: err.Error()}
+	}
+	return &nwcError{Code: nwcInternal, Message: err.Error()}
+}
+
+// call executes an lnrpc method through the pool with the identity of the
+// connection.
+func (service *nwcService) call(ctx context.Context, method string, request proto.Message, response proto.Message) error {
+	payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(request)
+	if err != nil {
+		return err
+	}
+	info, err := sessions.connection(service.connection.Session)
+	if err != nil {
+		return err
+	}
+	if err := authorizeCall(service.identity, info, method); err != nil {
+		return err
+	}
+
+	configMutex.RLock()
+	timeout := LNCD_TIMEOUT
+	configMutex.RUnlock()
+	// wallets expect the balance and the invoices to be up to date
+	ctx, cancel := context.WithTimeout(withCacheMode(ctx, cacheRevalidate), timeout)
+	defer cancel()
+	_, result, err := service.pool.call(ctx, info, service.connection.Session, service.identity, method, string(payload))
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(result), response)
+}
+
+// nwcTransaction is a transaction as described by NIP-47, amounts are in
+// millisatoshis.
+type nwcTransaction struct {
+	Type            string `json:"type"`
+	Invoice         string `json:"invoice,omitempty"`
+	Description     string `json:"description,omitempty"`
+	DescriptionHash string `json:"description_hash,omitempty"`
+	Preimage        string `json:"preimage,omitempty"`
+	PaymentHash     string `json:"payment_hash"`
+	Amount          int64  `json:"amount"`
+	FeesPaid        int64  `json:"fees_paid"`
+	CreatedAt       int64  `json:"created_at"`
+	ExpiresAt       int64  `json:"expires_at,omitempty"`
+	SettledAt       int64  `json:"settled_at,omitempty"`
+}
+
+func nwcInvoiceTransaction(invoice *lnrpc.Invoice) nwcTransaction {
+	transaction := nwcTransaction{
+		Type:            "incoming",
+		Invoice:         invoice.PaymentRequest,
+		Description:     invoice.Memo,
+		DescriptionHash: hex.EncodeToString(invoice.DescriptionHash),
+		PaymentHash:     hex.EncodeToString(invoice.RHash),
+		Amount:          invoice.ValueMsat,
+		CreatedAt:       invoice.CreationDate,
+		ExpiresAt:       invoice.CreationDate + invoice.Expiry,
+	}
+	if invoice.State == lnrpc.Invoice_SETTLED {
+		transaction.Preimage = hex.EncodeToString(invoice.RPreimage)
+		transaction.Amount = invoice.AmtPaidMsat
+		transaction.SettledAt = invoice.SettleDate
+	}
+	return transaction
+}
+
+func nwcPaymentTransaction(payment *lnrpc.Payment) nwcTransaction {
+	transaction := nwcTransaction{
+		Type:        "outgoing",
+		Invoice:     payment.PaymentRequest,
+		PaymentHash: payment.PaymentHash,
+		Amount:      payment.ValueMsat,
+		FeesPaid:    payment.FeeMsat,
+		CreatedAt:   payment.CreationTimeNs / int64(time.Second),
+	}
+	if payment.Status == lnrpc.Payment_SUCCEEDED {
+		transaction.Preimage = payment.PaymentPreimage
+		for _, htlc := range payment.Htlcs {
+			if htlc.Status == lnrpc.HTLCAttempt_SUCCEEDED && htlc.ResolveTimeNs/int64(time.Second) > transaction.SettledAt {
+				transaction.SettledAt = htlc.ResolveTimeNs / int64(time.Second)
+			}
+		}
+	}
+	return transaction
+}
+
+// execute runs a command and returns its result.
+func (service *nwcService) execute(ctx context.Context, request nwcRequest) (interface{}, error) {
+	unmarshal := func(params interface{}) error {
+		if len(request.Params) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(request.Params, params); err != nil {
+			return &nwcError{Code: nwcOther, Message: "invalid params"}
+		}
+		return nil
+	}
+
+	switch request.Method {
+	case "pay_invoice":
+		var params struct {
+			Invoice string `json:"invoice"`
+			Amount  int64  `json:"amount"`
+		}
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		response := &lnrpc.SendResponse{}
+		err := service.call(ctx, "lnrpc.Lightning.SendPaymentSync", &lnrpc.SendRequest{
+			PaymentRequest: params.Invoice,
+			AmtMsat:        params.Amount,
+		}, response)
+		if err != nil {
+			return nil, err
+		}
+		if response.PaymentError != "" {
+			code := nwcPaymentFailed
+			if strings.Contains(response.PaymentError, "insufficient") {
+				code = nwcInsufficientBalance
+			}
+			return nil, &nwcError{Code: code, Message: response.PaymentError}
+		}
+		var feesPaid int64
+		if response.PaymentRoute != nil {
+			feesPaid = response.PaymentRoute.TotalFeesMsat
+		}
+		return map[string]interface{}{
+			"preimage":  hex.EncodeToString(response.PaymentPreimage),
+			"fees_paid": feesPaid,
+		}, nil
+
+	case "make_invoice":
+		var params struct {
+			Amount          int64  `json:"amount"`
+			Description     string `json:"description"`
+			DescriptionHash string `json:"description_hash"`
+			Expiry          int64  `json:"expiry"`
+		}
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		descriptionHash, err := hex.DecodeString(params.DescriptionHash)
+		if err != nil {
+			return nil, &nwcError{Code: nwcOther, Message: "invalid description_hash"}
+		}
+		added := &lnrpc.AddInvoiceResponse{}
+		err = service.call(ctx, "lnrpc.Lightning.AddInvoice", &lnrpc.Invoice{
+			ValueMsat:       params.Amount,
+			Memo:            params.Description,
+			DescriptionHash: descriptionHash,
+			Expiry:          params.Expiry,
+		}, added)
+		if err != nil {
+			return nil, err
+		}
+		invoice := &lnrpc.Invoice{}
+		if err := service.call(ctx, "lnrpc.Lightning.LookupInvoice", &lnrpc.PaymentHash{RHash: added.RHash}, invoice); err != nil {
+			return nil, err
+		}
+		return nwcInvoiceTransaction(invoice), nil
+
+	case "get_balance":
+		response := &lnrpc.ChannelBalanceResponse{}
+		if err := service.call(ctx, "lnrpc.Lightning.ChannelBalance", &lnrpc.ChannelBalanceRequest{}, response); err != nil {
+			return nil, err
+		}
+		var balance uint64
+		if response.LocalBalance != nil {
+			balance = response.LocalBalance.Msat
+		}
+		return map[string]interface{}{"balance": balance}, nil
+
+	case "lookup_invoice":
+		var params struct {
+			PaymentHash string `json:"payment_hash"`
+			Invoice     string `json:"invoice"`
+		}
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		hash, err := hex.DecodeString(params.PaymentHash)
+		if params.Invoice != "" {
+			decoded, decodeErr := decodePaymentRequest(params.Invoice)
+			if decodeErr != nil || decoded.PaymentHash == nil {
+				return nil, &nwcError{Code: nwcOther, Message: "invalid invoice"}
+			}
+			hash, err = decoded.PaymentHash[:], nil
+		}
+		if err != nil || len(hash) == 0 {
+			return nil, &nwcError{Code: nwcOther, Message: "payment_hash or invoice is required"}
+		}
+		invoice := &lnrpc.Invoice{}
+		if err := service.call(ctx, "lnrpc.Lightning.LookupInvoice", &lnrpc.PaymentHash{RHash: hash}, invoice); err != nil {
+			return nil, err
+		}
+		return nwcInvoiceTransaction(invoice), nil
+
+	case "list_transactions":
+		var params struct {
+			From   uint64 `json:"from"`
+			Until  uint64 `json:"until"`
+			Limit  int    `json:"limit"`
+			Offset int    `json:"offset"`
+			Unpaid bool   `json:"unpaid"`
+			Type   string `json:"type"`
+		}
+		if err := unmarshal(&params); err != nil {
+			return nil, err
+		}
+		if params.Limit <= 0 || params.Limit > 100 {
+			params.Limit = 100
+		}
+		var max uint64 = uint64(params.Offset + params.Limit)
+
+		var transactions []nwcTransaction = []nwcTransaction{}
+		if params.Type == "" || params.Type == "incoming" {
+			response := &lnrpc.ListInvoiceResponse{}
+			err := service.call(ctx, "lnrpc.Lightning.ListInvoices", &lnrpc.ListInvoiceRequest{
+				NumMaxInvoices:    max,
+				Reversed:          true,
+				CreationDateStart: params.From,
+				CreationDateEnd:   params.Until,
+			}, response)
+			if err != nil {
+				return nil, err
+			}
+			for _, invoice := range response.Invoices {
+				if params.Unpaid || invoice.State == lnrpc.Invoice_SETTLED {
+					transactions = append(transactions, nwcInvoiceTransaction(invoice))
+				}
+			}
+		}
+		if params.Type == "" || params.Type == "outgoing" {
+			response := &lnrpc.ListPaymentsResponse{}
+			err := service.call(ctx, "lnrpc.Lightning.ListPayments", &lnrpc.ListPaymentsRequest{
+				IncludeIncomplete: params.Unpaid,
+				MaxPayments:       max,
+				Reversed:          true,
+				CreationDateStart: params.From,
+				CreationDateEnd:   params.Until,
+			}, response)
+			if err != nil {
+				return nil, err
+			}
+			for _, payment := range response.Payments {
+				transactions = append(transactions, nwcPaymentTransaction(payment))
+			}
+		}
+
+		sort.Slice(transactions, func(i, j int) bool {
+			return transactions[i].CreatedAt > transactions[j].CreatedAt
+		})
+		if params.Offset >= len(transactions) {
+			transactions = []nwcTransaction{}
+		} else {
+			transactions = transactions[params.Offset:min(len(transactions), params.Offset+params.Limit)]
+		}
+		return map[string]interface{}{"transactions": transactions}, nil
+	}
+
+	return nil, &nwcError{Code: nwcNotImplemented, Message: "unknown method " + request.Method}
+}
+
+// nwcView is how a connection is returned to clients, the connection URI
+// is only included when it is created.
+type nwcView struct {
+	ID             string
+	Session        string
+	Relay          string
+	WalletPubKey   string
+	ClientPubKey   string
+	MaxPaymentSat  int64
+	DailyBudgetSat int64
+	Created        time.Time
+	ConnectionURI  string `json:",omitempty"`
+}
+
+func newNWCView(connection *NWCConnection) nwcView {
+	view := nwcView{
+		ID:             connection.ID,
+		Session:        connection.Session,
+		Relay:          connection.Relay,
+		ClientPubKey:   connection.ClientPubKey,
+		MaxPaymentSat:  connection.MaxPaymentSat,
+		DailyBudgetSat: connection.DailyBudgetSat,
+		Created:        connection.Created,
+	}
+	if walletKey, err := parseNostrPrivateKey(connection.WalletKey); err == nil {
+		view.WalletPubKey = nostrPublicKey(walletKey)
+	}
+	return view
+}
+
+func createNWCHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var request NWCRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := identityFromContext(r.Context())
+	for _, method := range nwcMethods {
+		if err := authorizeMethod(identity, method); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	connection, uri, err := nwcConnections.create(identity, request)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("NWC connection %v created by %v", connection.ID, identity.Name)
+
+	view := newNWCView(connection)
+	view.ConnectionURI = uri
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+func listNWCHandler(w http.ResponseWriter, r *http.Request) {
+	var views []nwcView = []nwcView{}
+	for _, connection := range nwcConnections.list(identityFromContext(r.Context())) {
+		views = append(views, newNWCView(connection))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func deleteNWCHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromContext(r.Context())
+	if err := nwcConnections.delete(r.PathValue("id"), identity); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("NWC connection %v deleted by %v", r.PathValue("id"), identity.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/ecdsa"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/gorilla/websocket"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnwire"
+	"github.com/lightningnetwork/lnd/zpay32"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// testNode answers the methods called by the NWC commands in place of a
+// node reached through a mailbox.
+type testNode struct {
+	payments     []*lnrpc.SendRequest
+	invoices     map[string]*lnrpc.Invoice
+	paymentError string
+	mutex        sync.Mutex
+}
+
+func (node *testNode) registry() map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)) {
+	method := func(request proto.Message, handle func(proto.Message) proto.Message) func(context.Context, *grpc.ClientConn, string, func(string, error)) {
+		return func(_ context.Context, _ *grpc.ClientConn, payload string, cb func(string, error)) {
+			request := proto.Clone(request)
+			if err := protojson.Unmarshal([]byte(payload), request); err != nil {
+				cb("", err)
+				return
+			}
+			node.mutex.Lock()
+			response := handle(request)
+			node.mutex.Unlock()
+			result, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(response)
+			cb(string(result), err)
+		}
+	}
+
+	return map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.GetInfo": method(&lnrpc.GetInfoRequest{}, func(proto.Message) proto.Message {
+			return &lnrpc.GetInfoResponse{Chains: []*lnrpc.Chain{{Chain: "bitcoin", Network: "mainnet"}}}
+		}),
+		"lnrpc.Lightning.ChannelBalance": method(&lnrpc.ChannelBalanceRequest{}, func(proto.Message) proto.Message {
+			return &lnrpc.ChannelBalanceResponse{LocalBalance: &lnrpc.Amount{Sat: 21, Msat: 21000}}
+		}),
+		"lnrpc.Lightning.AddInvoice": method(&lnrpc.Invoice{}, func(request proto.Message) proto.Message {
+			invoice := request.(*lnrpc.Invoice)
+			hash := sha256.Sum256([]byte(invoice.Memo))
+			invoice.RHash = hash[:]
+			invoice.PaymentRequest = "lnbc1test" + hex.EncodeToString(hash[:4])
+			invoice.CreationDate = 1700000000
+			node.invoices[hex.EncodeToString(hash[:])] = invoice
+			return &lnrpc.AddInvoiceResponse{RHash: invoice.RHash, PaymentRequest: invoice.PaymentRequest}
+		}),
+		"lnrpc.Lightning.LookupInvoice": method(&lnrpc.PaymentHash{}, func(request proto.Message) proto.Message {
+			return node.invoices[hex.EncodeToString(request.(*lnrpc.PaymentHash).RHash)]
+		}),
+		"lnrpc.Lightning.SendPaymentSync": method(&lnrpc.SendRequest{}, func(request proto.Message) proto.Message {
+			node.payments = append(node.payments, request.(*lnrpc.SendRequest))
+			if node.paymentError != "" {
+				return &lnrpc.SendResponse{PaymentError: node.paymentError}
+			}
+			return &lnrpc.SendResponse{
+				PaymentPreimage: []byte{1, 2, 3, 4},
+				PaymentRoute:    &lnrpc.Route{TotalFeesMsat: 1000},
+			}
+		}),
+	}
+}
+
+func (node *testNode) paymentCount() int {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return len(node.payments)
+}
+
+// testNWCClient is the wallet side of an NWC connection, it sends the
+// requests through the relay and waits for the responses.
+type testNWCClient struct {
+	relay        *testRelay
+	key          *btcec.PrivateKey
+	walletPubKey string
+}
+
+type testNWCResponse struct {
+	ResultType string          `json:"result_type"`
+	Error      *nwcError       `json:"error"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// newTestNWC creates an NWC connection to a test node for owner and starts
+// its service on a local relay.
+func newTestNWC(t *testing.T, owner *Identity, request NWCRequest) (*testNWCClient, *testNode) {
+	configMutex.Lock()
+	enforcePermissions := LNCD_ENFORCE_PERMISSIONS
+	LNCD_ENFORCE_PERMISSIONS = false
+	configMutex.Unlock()
+	previousSessions, previousSpendStore := sessions, spendStore
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_ENFORCE_PERMISSIONS = enforcePermissions
+		configMutex.Unlock()
+		sessions, spendStore = previousSessions, previousSpendStore
+	})
+	var err error
+	if sessions, err = NewSessionStore(""); err != nil {
+		t.Fatal(err)
+	}
+	if spendStore, err = newSpendingStore(""); err != nil {
+		t.Fatal(err)
+	}
+
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "nwc test"}
+	session, err := sessions.create(owner, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &testNode{invoices: make(map[string]*lnrpc.Invoice)}
+	pool := NewConnectionPool()
+	conn := &Connection{connInfo: info, actions: make(chan Action, 1), registry: node.registry(), pool: pool}
+	pool.connections[ConnectionKey{info.Mailbox, info.PairingPhrase}] = conn
+	go conn.runLoop()
+	t.Cleanup(func() { close(conn.actions) })
+
+	relay := newTestRelay(t)
+	store, err := NewNWCStore(pool, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Session, request.Relay = session.ID, relay.url
+	connection, uri, err := store.create(owner, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.delete(connection.ID, owner) })
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "nostr+walletconnect" || parsed.Query().Get("relay") != relay.url {
+		t.Fatalf("invalid connection URI %v", uri)
+	}
+	key, err := parseNostrPrivateKey(parsed.Query().Get("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nostrPublicKey(key) != connection.ClientPubKey {
+		t.Fatal("the secret of the URI is not the one of the client")
+	}
+
+	// requests are only handled once the service is listening
+	walletInfo := relay.waitEvent(t, func(event *NostrEvent) bool { return event.Kind == nwcInfoKind })
+	if walletInfo.PubKey != parsed.Host || walletInfo.Content != strings.Join(nwcCommands, " ") {
+		t.Fatalf("unexpected info event %+v", walletInfo)
+	}
+	return &testNWCClient{relay: relay, key: key, walletPubKey: parsed.Host}, node
+}
+
+// call sends a request and returns the decrypted response.
+func (client *testNWCClient) call(t *testing.T, method string, params interface{}) testNWCResponse {
+	t.Helper()
+	content, err := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := nip04Encrypt(client.key, client.walletPubKey, string(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &NostrEvent{
+		CreatedAt: time.Now().Unix(),
+		Kind:      nwcRequestKind,
+		Tags:      [][]string{{"p", client.walletPubKey}},
+		Content:   encrypted,
+	}
+	if err := request.sign(client.key); err != nil {
+		t.Fatal(err)
+	}
+	if err := publishNostrEvent(context.Background(), websocket.DefaultDialer, client.relay.url, request); err != nil {
+		t.Fatal(err)
+	}
+
+	reply := client.relay.waitEvent(t, func(event *NostrEvent) bool {
+		return event.Kind == nwcResponseKind && event.tag("e") == request.ID
+	})
+	if err := reply.verify(); err != nil || reply.PubKey != client.walletPubKey || reply.tag("p") != nostrPublicKey(client.key) {
+		t.Fatalf("invalid response event %+v: %v", reply, err)
+	}
+	plaintext, err := nip04Decrypt(client.key, client.walletPubKey, reply.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response testNWCResponse
+	if err := json.Unmarshal([]byte(plaintext), &response); err != nil {
+		t.Fatalf("invalid response %s: %v", plaintext, err)
+	}
+	return response
+}
+
+// newTestPaymentRequest returns a mainnet invoice of amountSat signed by a
+// random node.
+func newTestPaymentRequest(t *testing.T, amountSat int64) string {
+	t.Helper()
+	nodeKey := newTestNostrKey(t)
+	var hash [32]byte
+	copy(hash[:], nodeKey.Serialize())
+	invoice, err := zpay32.NewInvoice(
+		&chaincfg.MainNetParams, hash, time.Now(),
+		zpay32.Amount(lnwire.MilliSatoshi(amountSat*1000)),
+		zpay32.Description("nwc test"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payReq, err := invoice.Encode(zpay32.MessageSigner{
+		SignCompact: func(msg []byte) ([]byte, error) {
+			digest := sha256.Sum256(msg)
+			return ecdsa.SignCompact(nodeKey, digest[:], true)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payReq
+}
+
+func TestNWCGetBalance(t *testing.T) {
+	client, _ := newTestNWC(t, &Identity{Name: "alice"}, NWCRequest{})
+
+	response := client.call(t, "get_balance", nil)
+	if response.Error != nil || response.ResultType != "get_balance" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if string(response.Result) != `{"balance":21000}` {
+		t.Fatalf("unexpected balance %s", response.Result)
+	}
+}
+
+func TestNWCMakeInvoice(t *testing.T) {
+	client, node := newTestNWC(t, &Identity{Name: "alice"}, NWCRequest{})
+
+	response := client.call(t, "make_invoice", map[string]interface{}{
+		"amount":      21000,
+		"description": "coffee",
+		"expiry":      600,
+	})
+	if response.Error != nil || response.ResultType != "make_invoice" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	var transaction nwcTransaction
+	if err := json.Unmarshal(response.Result, &transaction); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("coffee"))
+	node.mutex.Lock()
+	invoice := node.invoices[hex.EncodeToString(hash[:])]
+	node.mutex.Unlock()
+	if invoice == nil || invoice.ValueMsat != 21000 || invoice.Expiry != 600 {
+		t.Fatalf("unexpected invoice added %+v", invoice)
+	}
+	expected := nwcTransaction{
+		Type:        "incoming",
+		Invoice:     invoice.PaymentRequest,
+		Description: "coffee",
+		PaymentHash: hex.EncodeToString(hash[:]),
+		Amount:      21000,
+		CreatedAt:   1700000000,
+		ExpiresAt:   1700000600,
+	}
+	if transaction != expected {
+		t.Fatalf("unexpected transaction %+v", transaction)
+	}
+}
+
+func TestNWCPayInvoice(t *testing.T) {
+	client, node := newTestNWC(t, &Identity{Name: "alice"}, NWCRequest{})
+	payReq := newTestPaymentRequest(t, 1000)
+
+	response := client.call(t, "pay_invoice", map[string]interface{}{"invoice": payReq})
+	if response.Error != nil || response.ResultType != "pay_invoice" {
+		t.Fatalf("unexpected response %+v", response)
+	}
+	if string(response.Result) != `{"fees_paid":1000,"preimage":"01020304"}` {
+		t.Fatalf("unexpected result %s", response.Result)
+	}
+	node.mutex.Lock()
+	payments := node.payments
+	node.mutex.Unlock()
+	if len(payments) != 1 || payments[0].PaymentRequest != payReq {
+		t.Fatalf("unexpected payments %v", payments)
+	}
+
+	node.mutex.Lock()
+	node.paymentError = "insufficient local balance"
+	node.mutex.Unlock()
+	response = client.call(t, "pay_invoice", map[string]interface{}{"invoice": payReq})
+	if response.Error == nil || response.Error.Code != nwcInsufficientBalance {
+		t.Fatalf("expected %v, got %+v", nwcInsufficientBalance, response.Error)
+	}
+}
+
+func TestNWCBudgetExhausted(t *testing.T) {
+	// without a fee limit, the fees may be as high as the amount, so each
+	// payment of 1000 sat reserves 2000 sat
+	client, node := newTestNWC(t, &Identity{Name: "alice"}, NWCRequest{MaxPaymentSat: 1500, DailyBudgetSat: 5000})
+
+	response := client.call(t, "pay_invoice", map[string]interface{}{"invoice": newTestPaymentRequest(t, 2000)})
+	if response.Error == nil || response.Error.Code != nwcQuotaExceeded {
+		t.Fatalf("payment above MaxPaymentSat: expected %v, got %+v", nwcQuotaExceeded, response.Error)
+	}
+
+	// failed payments don't count towards the budget
+	node.mutex.Lock()
+	node.paymentError = "no route"
+	node.mutex.Unlock()
+	response = client.call(t, "pay_invoice", map[string]interface{}{"invoice": newTestPaymentRequest(t, 1000)})
+	if response.Error == nil || response.Error.Code != nwcPaymentFailed {
+		t.Fatalf("expected %v, got %+v", nwcPaymentFailed, response.Error)
+	}
+	node.mutex.Lock()
+	node.paymentError = ""
+	node.mutex.Unlock()
+
+	for i := 0; i < 2; i++ {
+		response = client.call(t, "pay_invoice", map[string]interface{}{"invoice": newTestPaymentRequest(t, 1000)})
+		if response.Error != nil {
+			t.Fatalf("payment %d within the budget failed: %+v", i, response.Error)
+		}
+	}
+	response = client.call(t, "pay_invoice", map[string]interface{}{"invoice": newTestPaymentRequest(t, 1000)})
+	if response.Error == nil || response.Error.Code != nwcQuotaExceeded {
+		t.Fatalf("payment above DailyBudgetSat: expected %v, got %+v", nwcQuotaExceeded, response.Error)
+	}
+	if count := node.paymentCount(); count != 3 {
+		t.Fatalf("expected 3 payments to reach the node, got %d", count)
+	}
+
+	// the other commands are not limited by the budget
+	if response := client.call(t, "get_balance", nil); response.Error != nil {
+		t.Fatalf("get_balance failed after the budget was exhausted: %+v", response.Error)
+	}
+}
+
+func TestNWCBudgetLimitedByOwner(t *testing.T) {
+	owner := &Identity{Name: "alice", spending: &SpendingLimits{MaxPaymentSat: 1000, DailyBudgetSat: 5000}}
+	store, err := NewNWCStore(NewConnectionPool(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = store.create(owner, NWCRequest{Relay: "wss://relay.example.com"})
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a connection without budget to be refused, got %v", err)
+	}
+	_, _, err = store.create(owner, NWCRequest{Relay: "wss://relay.example.com", MaxPaymentSat: -1})
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.Code != http.StatusBadRequest {
+		t.Fatalf("expected a negative limit to be refused, got %v", err)
+	}
+
+	client, _ := newTestNWC(t, owner, NWCRequest{MaxPaymentSat: 5000, DailyBudgetSat: 10000})
+	response := client.call(t, "pay_invoice", map[string]interface{}{"invoice": newTestPaymentRequest(t, 2000)})
+	if response.Error == nil || response.Error.Code != nwcQuotaExceeded {
+		t.Fatalf("expected the limits of the owner to apply, got %+v", response.Error)
+	}
+}
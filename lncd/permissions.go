@@ -2,6 +2,9 @@ package main
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
+	"time"
 
 	"regexp"
 
@@ -34,16 +37,43 @@ func NewPermissionManager(conn *Connection) (*PermissionManager, error) {
 }
 
 func (mng *PermissionManager) check(permission string) (bool, error) {
-	permission = permUriREGEX.ReplaceAllString(permission, "/$1.$2/$3")
+	return mng.evaluate(permission).Allowed, nil
+}
 
-	permsMgr := mng.manager
-	ops, ok := permsMgr.URIPermissions(permission)
-	if !ok {
-		log.Debugf("uri %s not found in known permissions list", permission)
-		return false, nil
+// evaluate checks that the macaroon of the connection grants the operations
+// required by the method and that its caveats don't prevent calling it.
+func (mng *PermissionManager) evaluate(permission string) *PermissionCheck {
+	result := &PermissionCheck{Method: permission}
+
+	// built-ins declare their permissions and the node methods they call,
+	// the caveats apply to those methods
+	var uri string
+	var ops []bakery.Op
+	var methods []string = []string{permission}
+	if builtin, ok := builtins[permission]; ok {
+		if len(builtin.permissions) == 0 {
+			result.known = true
+			result.Allowed = true
+			result.Reason = "granted"
+			return result
+		}
+		ops, methods = builtin.permissions, builtin.calls
+	} else {
+		uri = permUriREGEX.ReplaceAllString(permission, "/$1.$2/$3")
+		ops, ok = mng.manager.URIPermissions(uri)
+		if !ok {
+			log.Debugf("uri %s not found in known permissions list", uri)
+			result.Reason = "unknown method"
+			return result
+		}
 	}
+	result.known = true
 
 	macaroon := mng.conn.connInfo.macaroon
+	if macaroon == nil {
+		result.Reason = "no macaroon received for this connection"
+		return result
+	}
 	if UNSAFE_LOGS {
 		log.Debugf("checking permission %s for macaroon %x", permission, macaroon.Id())
 	}
@@ -51,12 +81,81 @@ func (mng *PermissionManager) check(permission string) (bool, error) {
 	macOps, err := extractMacaroonOps(macaroon)
 	if err != nil {
 		log.Debugf("could not extract macaroon ops: %v", err)
-		return false, nil
+		result.Reason = err.Error()
+		return result
 	}
 
 	// Check that the macaroon contains each of the required permissions
 	// for the given URI.
-	return hasPermissions(permission, macOps, ops), nil
+	for _, op := range missingPermissions(uri, macOps, ops) {
+		result.Missing = append(result.Missing, PermissionOp{op.Entity, op.Action})
+	}
+	if len(result.Missing) > 0 {
+		result.Reason = "missing permissions"
+		return result
+	}
+
+	now := time.Now()
+	for _, caveat := range parseCaveats(macaroon) {
+		for i, method := range methods {
+			allowed, note := evaluateCaveat(caveat, method, now)
+			if !allowed {
+				result.Reason = note
+				return result
+			}
+			// the notes don't depend on the method
+			if note != "" && i == 0 {
+				result.Notes = append(result.Notes, note)
+			}
+		}
+	}
+
+	result.Allowed = true
+	result.Reason = "granted"
+	return result
+}
+
+// MacaroonInfo describes what the macaroon of a connection allows.
+type MacaroonInfo struct {
+	// Actions granted for each entity, eg. {"invoices": ["read", "write"]}
+	Permissions map[string][]string
+	Caveats     []Caveat
+	Expiry      *time.Time
+	// The registered methods that the macaroon allows to call
+	Methods []string
+}
+
+// info inspects the macaroon of the connection and checks it against
+// the given methods.
+func (mng *PermissionManager) info(methods []string) (*MacaroonInfo, error) {
+	macaroon := mng.conn.connInfo.macaroon
+	if macaroon == nil {
+		return nil, fmt.Errorf("no macaroon received for this connection")
+	}
+
+	macOps, err := extractMacaroonOps(macaroon)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &MacaroonInfo{
+		Permissions: make(map[string][]string),
+		Caveats:     parseCaveats(macaroon),
+		Methods:     []string{},
+	}
+	for _, op := range macOps {
+		info.Permissions[op.Entity] = append(info.Permissions[op.Entity], op.Actions...)
+	}
+	info.Expiry = macaroonExpiry(info.Caveats)
+
+	sort.Strings(methods)
+	for _, method := range methods {
+		if allowed, _ := mng.check(method); allowed {
+			info.Methods = append(info.Methods, method)
+		}
+	}
+
+	return info, nil
 }
 
 // extractMacaroonOps is a helper function that extracts operations from the
@@ -86,8 +185,10 @@ func extractMacaroonOps(mac *macaroon.Macaroon) ([]*lnrpc.Op, error) {
 	return decodedID.Ops, nil
 }
 
-func hasPermissions(uri string, macOps []*lnrpc.Op,
-	requiredOps []bakery.Op) bool {
+// missingPermissions returns the required operations that are not granted by
+// the macaroon operations.
+func missingPermissions(uri string, macOps []*lnrpc.Op,
+	requiredOps []bakery.Op) []bakery.Op {
 
 	// Create a lookup map of the macaroon operations.
 	macOpsMap := make(map[string]map[string]bool)
@@ -105,23 +206,39 @@ func hasPermissions(uri string, macOps []*lnrpc.Op,
 			if op.Entity == macaroons.PermissionEntityCustomURI &&
 				action == uri {
 
-				return true
+				return nil
 			}
 		}
 	}
 
 	// For each of the required operations, we ensure that the macaroon also
 	// contains the operation.
+	var missing []bakery.Op
 	for _, op := range requiredOps {
-		macEntity, ok := macOpsMap[op.Entity]
-		if !ok {
-			return false
+		if !macOpsMap[op.Entity][op.Action] {
+			missing = append(missing, op)
 		}
+	}
 
-		if !macEntity[op.Action] {
-			return false
-		}
+	return missing
+}
+
+// enforce returns a StatusError explaining why the macaroon of the
+// connection doesn't allow the method.
+// Methods that are not in the permissions list are left to the node.
+func (mng *PermissionManager) enforce(method string) error {
+	result := mng.evaluate(method)
+	if !result.known || result.Allowed {
+		return nil
 	}
 
-	return true
+	var details map[string]interface{} = map[string]interface{}{"reason": result.Reason}
+	if len(result.Missing) > 0 {
+		details["missing"] = result.Missing
+	}
+	return &StatusError{
+		Code:    http.StatusForbidden,
+		Message: fmt.Sprintf("permission denied for %v: %v", method, result.Reason),
+		Details: details,
+	}
 }
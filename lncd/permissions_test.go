@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/macaroon-bakery.v2/bakery"
+	"gopkg.in/macaroon.v2"
+)
+
+// newTestMacaroon returns a macaroon granting ops, with the given first
+// party caveats.
+func newTestMacaroon(t *testing.T, ops map[string][]string, caveats ...string) *macaroon.Macaroon {
+	t.Helper()
+	id := &lnrpc.MacaroonId{Nonce: []byte("nonce"), StorageId: []byte("0")}
+	for entity, actions := range ops {
+		id.Ops = append(id.Ops, &lnrpc.Op{Entity: entity, Actions: actions})
+	}
+	data, err := proto.Marshal(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := macaroon.New([]byte("root key"), append([]byte{byte(bakery.LatestVersion)}, data...), "lnd", macaroon.LatestVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, caveat := range caveats {
+		if err := mac.AddFirstPartyCaveat([]byte(caveat)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mac
+}
+
+// newTestPermissionManager returns the permission manager of a connection
+// whose macaroon is mac.
+func newTestPermissionManager(t *testing.T, mac *macaroon.Macaroon) *PermissionManager {
+	t.Helper()
+	conn := &Connection{connInfo: ConnectionInfo{macaroon: mac}}
+	perms, err := NewPermissionManager(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.perms = perms
+	return perms
+}
+
+func TestPermissionEvaluation(t *testing.T) {
+	invoices := map[string][]string{"invoices": {"read", "write"}}
+	admin := map[string][]string{
+		"info":     {"read"},
+		"invoices": {"read", "write"},
+		"offchain": {"read", "write"},
+		"onchain":  {"read", "write"},
+	}
+	expiry := time.Now().Add(time.Hour).UTC().Format(time.RFC3339Nano)
+	expired := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name    string
+		ops     map[string][]string
+		caveats []string
+		method  string
+		allowed bool
+		reason  string
+		missing []PermissionOp
+		notes   []string
+	}{
+		{name: "granted", ops: invoices, method: "lnrpc.Lightning.AddInvoice", allowed: true, reason: "granted"},
+		{name: "missing permission", ops: invoices, method: "lnrpc.Lightning.SendPaymentSync", reason: "missing permissions",
+			missing: []PermissionOp{{"offchain", "write"}}},
+		{name: "uri permission", ops: map[string][]string{"uri": {"/lnrpc.Lightning/GetInfo"}}, method: "lnrpc.Lightning.GetInfo", allowed: true, reason: "granted"},
+		{name: "unknown method", ops: admin, method: "lnrpc.Lightning.Unknown", reason: "unknown method"},
+		{name: "not expired", ops: invoices, caveats: []string{"time-before " + expiry}, method: "lnrpc.Lightning.AddInvoice", allowed: true, reason: "granted"},
+		{name: "expired", ops: invoices, caveats: []string{"time-before " + expired}, method: "lnrpc.Lightning.AddInvoice",
+			reason: "macaroon expired at " + expired[:19] + "Z"},
+		{name: "ip lock", ops: invoices, caveats: []string{"ipaddr 192.0.2.1"}, method: "lnrpc.Lightning.AddInvoice", allowed: true, reason: "granted",
+			notes: []string{"macaroon is locked to IP 192.0.2.1"}},
+		{name: "account method", ops: admin, caveats: []string{"lnd-custom account 0a1b2c3d"}, method: "lnrpc.Lightning.AddInvoice", allowed: true, reason: "granted",
+			notes: []string{"calls are bound to lit account 0a1b2c3d"}},
+		{name: "method not supported by accounts", ops: admin, caveats: []string{"lnd-custom account 0a1b2c3d"}, method: "lnrpc.Lightning.SendCoins",
+			reason: "method not supported with lit account 0a1b2c3d"},
+		{name: "firewall", ops: admin, caveats: []string{"lnd-custom lit-mac-fw privacy:1"}, method: "lnrpc.Lightning.GetInfo", allowed: true, reason: "granted",
+			notes: []string{"calls are subject to lit firewall rules"}},
+		{name: "firewall metadata", ops: admin, caveats: []string{"lnd-custom lit-mac-fw meta:{}"}, method: "lnrpc.Lightning.GetInfo", allowed: true, reason: "granted"},
+		{name: "built-in", ops: admin, method: "nodeSummary", allowed: true, reason: "granted"},
+		{name: "built-in missing permission", ops: invoices, method: "nodeSummary", reason: "missing permissions",
+			missing: []PermissionOp{{"info", "read"}, {"onchain", "read"}, {"offchain", "read"}}},
+		{name: "built-in calls checked against caveats", ops: admin, caveats: []string{"lnd-custom account 0a1b2c3d"}, method: "nodeSummary", allowed: true, reason: "granted",
+			notes: []string{"calls are bound to lit account 0a1b2c3d"}},
+		{name: "built-in without node calls", ops: invoices, method: "decodeInvoice", allowed: true, reason: "granted"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			perms := newTestPermissionManager(t, newTestMacaroon(t, test.ops, test.caveats...))
+			result := perms.evaluate(test.method)
+			if result.Allowed != test.allowed || result.Reason != test.reason {
+				t.Fatalf("expected allowed %v (%v), got %v (%v)", test.allowed, test.reason, result.Allowed, result.Reason)
+			}
+			if !reflect.DeepEqual(result.Missing, test.missing) {
+				t.Fatalf("expected missing %v, got %v", test.missing, result.Missing)
+			}
+			if !reflect.DeepEqual(result.Notes, test.notes) {
+				t.Fatalf("expected notes %v, got %v", test.notes, result.Notes)
+			}
+		})
+	}
+}
+
+func TestPermissionEvaluationWithoutMacaroon(t *testing.T) {
+	perms := newTestPermissionManager(t, nil)
+	if result := perms.evaluate("lnrpc.Lightning.GetInfo"); result.Allowed || result.Reason != "no macaroon received for this connection" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+}
+
+func TestEnforcePermissions(t *testing.T) {
+	perms := newTestPermissionManager(t, newTestMacaroon(t, map[string][]string{"invoices": {"read", "write"}}))
+
+	if err := perms.enforce("lnrpc.Lightning.AddInvoice"); err != nil {
+		t.Fatalf("granted method refused: %v", err)
+	}
+	// methods missing from the permissions list are left to the node
+	if err := perms.enforce("lnrpc.Lightning.Unknown"); err != nil {
+		t.Fatalf("unknown method refused: %v", err)
+	}
+	err := perms.enforce("lnrpc.Lightning.SendPaymentSync")
+	if statusCode(err) != 403 {
+		t.Fatalf("expected 403, got %v", err)
+	}
+	details := err.(*StatusError).Details
+	if details["reason"] != "missing permissions" || !reflect.DeepEqual(details["missing"], []PermissionOp{{"offchain", "write"}}) {
+		t.Fatalf("unexpected details %v", details)
+	}
+}
+
+func TestCheckPermsBuiltins(t *testing.T) {
+	conn := newTestPermissionManager(t, newTestMacaroon(t, map[string][]string{"invoices": {"read", "write"}})).conn
+	payload := `["lnrpc.Lightning.AddInvoice","lnrpc.Lightning.SendPaymentSync"]`
+
+	// checkPerms keeps returning booleans for the existing clients
+	result, err := checkPerms(conn, payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "[true,false]" {
+		t.Fatalf("unexpected checkPerms result %s", result)
+	}
+
+	result, err = explainPerms(conn, payload, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"Method":"lnrpc.Lightning.AddInvoice","Allowed":true,"Reason":"granted"},` +
+		`{"Method":"lnrpc.Lightning.SendPaymentSync","Allowed":false,"Reason":"missing permissions","Missing":[{"Entity":"offchain","Action":"write"}]}]`
+	if result != expected {
+		t.Fatalf("unexpected explainPerms result\n%s\nexpected\n%s", result, expected)
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"github.com/lightningnetwork/lnd/lnrpc/routerrpc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// SpendingLimits restrict the funds that can leave the node through the
+// daemon. Zero values mean no limit.
+type SpendingLimits struct {
+	// Maximum amount of a single payment, in satoshis
+	MaxPaymentSat int64
+	// Maximum amount spent in the last 24 hours, in satoshis
+	DailyBudgetSat int64
+	// Node public keys or on-chain addresses that can receive funds,
+	// empty means any destination
+	AllowedDestinations []string
+}
+
+func (limits *SpendingLimits) isSet() bool {
+	return limits != nil && (limits.MaxPaymentSat > 0 || limits.DailyBudgetSat > 0 || len(limits.AllowedDestinations) > 0)
+}
+
+// Spend describes the funds that a call would send.
+type Spend struct {
+	AmountSat int64
+	// Maximum routing fee of a payment, counted in the daily budgets
+	FeeSat       int64
+	Destinations []string
+	// False if the amount can't be determined before the call, eg. when
+	// sweeping the wallet
+	amountKnown bool
+}
+
+type spendRecord struct {
+	ID        uint64
+	Time      time.Time
+	AmountSat int64
+}
+
+// spendingStore keeps the running totals of each connection and token,
+// optionally persisted to a JSON file so restarts don't reset the budgets.
+type spendingStore struct {
+	path    string
+	records map[string][]spendRecord
+	nextID  uint64
+	mutex   sync.Mutex
+}
+
+var spendStore *spendingStore
+
+func newSpendingStore(path string) (*spendingStore, error) {
+	store := &spendingStore{
+		path:    path,
+		records: make(map[string][]spendRecord),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.records); err != nil {
+		return nil, fmt.Errorf("invalid spending store %v: %v", path, err)
+	}
+	for _, records := range store.records {
+		for _, record := range records {
+			if record.ID >= store.nextID {
+				store.nextID = record.ID + 1
+			}
+		}
+	}
+	return store, nil
+}
+
+// save writes the records to disk, must be called with the mutex held.
+func (store *spendingStore) save() {
+	if store.path == "" {
+		return
+	}
+	if err := saveJSONFile(store.path, store.records); err != nil {
+		log.Errorf("Unable to save spending store: %v", err)
+	}
+}
+
+// total returns the amount spent by key in the last 24 hours and drops the
+// older records. Must be called with the mutex held.
+func (store *spendingStore) total(key string, now time.Time) int64 {
+	var total int64
+	var recent []spendRecord
+	for _, record := range store.records[key] {
+		if now.Sub(record.Time) < 24*time.Hour {
+			recent = append(recent, record)
+			total += record.AmountSat
+		}
+	}
+	if len(recent) == 0 {
+		delete(store.records, key)
+	} else {
+		store.records[key] = recent
+	}
+	return total
+}
+
+func (store *spendingStore) remove(key string, id uint64) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	records := store.records[key]
+	for i, record := range records {
+		if record.ID == id {
+			store.records[key] = append(records[:i], records[i+1:]...)
+			break
+		}
+	}
+	store.save()
+}
+
+// reserve checks the spend against the daily budget of every key and records
+// it if all of them allow it. The returned function releases the
+// reservation if the spend doesn't happen.
+func (store *spendingStore) reserve(spend *Spend, budgets map[string]int64) (func(), error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	var amount int64 = spend.AmountSat + spend.FeeSat
+	for key, budget := range budgets {
+		if budget <= 0 {
+			continue
+		}
+		if spent := store.total(key, now); spent+amount > budget {
+			return nil, fmt.Errorf("daily budget exceeded: %d of %d sat already spent", spent, budget)
+		}
+	}
+
+	var id uint64 = store.nextID
+	store.nextID++
+	for key := range budgets {
+		store.records[key] = append(store.records[key], spendRecord{
+			ID:        id,
+			Time:      now,
+			AmountSat: amount,
+		})
+	}
+	store.save()
+
+	return func() {
+		for key := range budgets {
+			store.remove(key, id)
+		}
+	}, nil
+}
+
+func msatToSat(msat int64) int64 {
+	return (msat + 999) / 1000
+}
+
+// spendFromPayment returns the spend of a payment to either a payment request
+// or a destination and amount.
+func spendFromPayment(payReq string, amt int64, amtMsat int64, dest []byte) (*Spend, error) {
+	spend := &Spend{amountKnown: true}
+	if payReq != "" {
+		invoice, err := decodePaymentRequest(payReq)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payment request: %v", err)
+		}
+		spend.Destinations = []string{hex.EncodeToString(invoice.Destination.SerializeCompressed())}
+		if invoice.MilliSat != nil {
+			spend.AmountSat = msatToSat(int64(*invoice.MilliSat))
+			return spend, nil
+		}
+	} else {
+		spend.Destinations = []string{hex.EncodeToString(dest)}
+	}
+
+	if amtMsat > 0 {
+		spend.AmountSat = msatToSat(amtMsat)
+	} else {
+		spend.AmountSat = amt
+	}
+	return spend, nil
+}
+
+// feeLimitSat returns the maximum routing fee of a payment of amountSat. When
+// no limit is set, lnd allows fees up to the amount of the payment.
+func feeLimitSat(fixedSat int64, fixedMsat int64, percent int64, amountSat int64) int64 {
+	switch {
+	case fixedSat > 0:
+		return fixedSat
+	case fixedMsat > 0:
+		return msatToSat(fixedMsat)
+	case percent > 0:
+		return (amountSat*percent + 99) / 100
+	}
+	return amountSat
+}
+
+func spendFromRoute(route *lnrpc.Route) *Spend {
+	spend := &Spend{amountKnown: true}
+	if route == nil || len(route.Hops) == 0 {
+		return spend
+	}
+	spend.AmountSat = msatToSat(route.TotalAmtMsat - route.TotalFeesMsat)
+	spend.FeeSat = msatToSat(route.TotalFeesMsat)
+	spend.Destinations = []string{route.Hops[len(route.Hops)-1].PubKey}
+	return spend
+}
+
+// parseSpend returns the funds that the method would send, or nil if the
+// method doesn't send funds.
+func parseSpend(method string, payload string) (*Spend, error) {
+	unmarshal := func(msg proto.Message) error {
+		if strings.TrimSpace(payload) == "" {
+			return nil
+		}
+		return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(payload), msg)
+	}
+
+	switch method {
+	case "lnrpc.Lightning.SendPayment", "lnrpc.Lightning.SendPaymentSync":
+		req := &lnrpc.SendRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		dest := req.Dest
+		if len(dest) == 0 && req.DestString != "" {
+			dest, _ = hex.DecodeString(req.DestString)
+		}
+		spend, err := spendFromPayment(req.PaymentRequest, req.Amt, req.AmtMsat, dest)
+		if err != nil {
+			return nil, err
+		}
+		spend.FeeSat = feeLimitSat(req.FeeLimit.GetFixed(), req.FeeLimit.GetFixedMsat(), req.FeeLimit.GetPercent(), spend.AmountSat)
+		return spend, nil
+
+	case "routerrpc.Router.SendPaymentV2", "routerrpc.Router.SendPayment":
+		req := &routerrpc.SendPaymentRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		spend, err := spendFromPayment(req.PaymentRequest, req.Amt, req.AmtMsat, req.Dest)
+		if err != nil {
+			return nil, err
+		}
+		spend.FeeSat = feeLimitSat(req.FeeLimitSat, req.FeeLimitMsat, 0, spend.AmountSat)
+		return spend, nil
+
+	case "lnrpc.Lightning.SendToRoute", "lnrpc.Lightning.SendToRouteSync":
+		req := &lnrpc.SendToRouteRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		return spendFromRoute(req.Route), nil
+
+	case "routerrpc.Router.SendToRouteV2", "routerrpc.Router.SendToRoute":
+		req := &routerrpc.SendToRouteRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		return spendFromRoute(req.Route), nil
+
+	case "lnrpc.Lightning.SendCoins":
+		req := &lnrpc.SendCoinsRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		return &Spend{
+			AmountSat:    req.Amount,
+			Destinations: []string{req.Addr},
+			amountKnown:  !req.SendAll,
+		}, nil
+
+	case "lnrpc.Lightning.SendMany":
+		req := &lnrpc.SendManyRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		spend := &Spend{amountKnown: true}
+		for addr, amount := range req.AddrToAmount {
+			spend.Destinations = append(spend.Destinations, addr)
+			spend.AmountSat += amount
+		}
+		return spend, nil
+
+	case "lnrpc.Lightning.OpenChannel", "lnrpc.Lightning.OpenChannelSync":
+		req := &lnrpc.OpenChannelRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		// the funding amount includes push_sat, that is given to the peer
+		spend := &Spend{
+			AmountSat:   req.LocalFundingAmount,
+			amountKnown: !req.FundMax && req.FundingShim == nil,
+		}
+		if req.NodePubkeyString != "" {
+			spend.Destinations = append(spend.Destinations, req.NodePubkeyString)
+		} else {
+			spend.Destinations = append(spend.Destinations, hex.EncodeToString(req.NodePubkey))
+		}
+		if req.CloseAddress != "" {
+			spend.Destinations = append(spend.Destinations, req.CloseAddress)
+		}
+		return spend, nil
+
+	case "lnrpc.Lightning.BatchOpenChannel":
+		req := &lnrpc.BatchOpenChannelRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		spend := &Spend{amountKnown: true}
+		for _, channel := range req.Channels {
+			spend.AmountSat += channel.LocalFundingAmount
+			spend.Destinations = append(spend.Destinations, hex.EncodeToString(channel.NodePubkey))
+			if channel.CloseAddress != "" {
+				spend.Destinations = append(spend.Destinations, channel.CloseAddress)
+			}
+		}
+		return spend, nil
+
+	case "lnrpc.Lightning.CloseChannel":
+		req := &lnrpc.CloseChannelRequest{}
+		if err := unmarshal(req); err != nil {
+			return nil, err
+		}
+		// without a delivery address the funds go back to the wallet,
+		// otherwise the whole local balance leaves the node
+		if req.DeliveryAddress == "" {
+			return &Spend{amountKnown: true}, nil
+		}
+		return &Spend{Destinations: []string{req.DeliveryAddress}}, nil
+	}
+
+	return nil, nil
+}
+
+func connectionPolicyKey(info ConnectionInfo) string {
+	hash := sha256.Sum256([]byte(info.Mailbox + "|" + info.PairingPhrase))
+	return "connection:" + hex.EncodeToString(hash[:])
+}
+
+func globalSpendingLimits() *SpendingLimits {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	limits := &SpendingLimits{
+		MaxPaymentSat:  LNCD_SPEND_MAX_PAYMENT_SAT,
+		DailyBudgetSat: LNCD_SPEND_DAILY_BUDGET_SAT,
+	}
+	for _, dest := range strings.Split(LNCD_SPEND_ALLOWED_DESTINATIONS, ",") {
+		if dest = strings.TrimSpace(dest); dest != "" {
+			limits.AllowedDestinations = append(limits.AllowedDestinations, dest)
+		}
+	}
+	return limits
+}
+
+func checkSpendingLimits(spend *Spend, limits *SpendingLimits, scope string) error {
+	if !limits.isSet() {
+		return nil
+	}
+	if (limits.MaxPaymentSat > 0 || limits.DailyBudgetSat > 0) && !spend.amountKnown {
+		return fmt.Errorf("%v: amount cannot be determined in advance", scope)
+	}
+	if limits.MaxPaymentSat > 0 && spend.AmountSat > limits.MaxPaymentSat {
+		return fmt.Errorf("%v: amount %d sat exceeds the maximum of %d sat per payment", scope, spend.AmountSat, limits.MaxPaymentSat)
+	}
+	if len(limits.AllowedDestinations) > 0 {
+		for _, dest := range spend.Destinations {
+			allowed := false
+			for _, allowedDest := range limits.AllowedDestinations {
+				if strings.EqualFold(dest, allowedDest) {
+					allowed = true
+					break
+				}
+			}
+			if !allowed {
+				return fmt.Errorf("%v: destination %v is not allowed", scope, dest)
+			}
+		}
+	}
+	return nil
+}
+
+// spendingScope is a set of limits applied to a call, with the key of its
+// daily budget.
+type spendingScope struct {
+	name      string
+	limits    *SpendingLimits
+	budgetKey string
+}
+
+// spendingScopes returns the limits that apply to the calls of identity on
+// the connection: the daemon ones, the ones of the token and the ones of
+// the token that owns the identity.
+func spendingScopes(info ConnectionInfo, identity *Identity) []spendingScope {
+	var scopes []spendingScope
+	if global := globalSpendingLimits(); global.isSet() {
+		scopes = append(scopes, spendingScope{"spending policy", global, connectionPolicyKey(info)})
+	}
+	if identity == nil {
+		return scopes
+	}
+	if identity.spending.isSet() {
+		scopes = append(scopes, spendingScope{"token spending policy", identity.spending, "token:" + identity.Name})
+	}
+	if identity.owner != "" {
+		if limits := spendingLimitsOf(identity.owner); limits.isSet() {
+			scopes = append(scopes, spendingScope{"owner spending policy", limits, "token:" + identity.owner})
+		}
+	}
+	return scopes
+}
+
+// spendingLimitsSet returns true if any limit applies to the funds that the
+// identity can spend.
+func spendingLimitsSet(identity *Identity) bool {
+	return len(spendingScopes(ConnectionInfo{}, identity)) > 0
+}
+
+// authorizeSpend validates the payment request of the call and applies the
+// spending limits of the daemon (per connection) and of the identity (per
+// token). If the call sends funds, the amount is counted in the daily
+// budgets until the returned release function is called.
+func authorizeSpend(conn *Connection, identity *Identity, method string, payload string) (func(), error) {
+	noop := func() {}
+
+	if err := validatePayment(conn, method, payload); err != nil {
+		return nil, err
+	}
+
+	scopes := spendingScopes(conn.connInfo, identity)
+	if len(scopes) == 0 {
+		return noop, nil
+	}
+
+	spend, err := parseSpend(method, payload)
+	if err != nil {
+		return nil, &StatusError{Code: http.StatusBadRequest, Message: err.Error()}
+	}
+	if spend == nil {
+		// methods that may move funds must be priced when limits are set
+		if class := methodClass(method); class != MethodClassRead && class != MethodClassReceive {
+			return nil, &StatusError{
+				Code:    http.StatusForbidden,
+				Message: fmt.Sprintf("spending policy: the funds moved by %v cannot be determined", method),
+			}
+		}
+		return noop, nil
+	}
+
+	budgets := map[string]int64{}
+	for _, scope := range scopes {
+		if err := checkSpendingLimits(spend, scope.limits, scope.name); err != nil {
+			return nil, &StatusError{Code: http.StatusForbidden, Message: err.Error()}
+		}
+		if scope.limits.DailyBudgetSat > 0 {
+			budgets[scope.budgetKey] = scope.limits.DailyBudgetSat
+		}
+	}
+	if len(budgets) == 0 {
+		return noop, nil
+	}
+
+	release, err := spendStore.reserve(spend, budgets)
+	if err != nil {
+		return nil, &StatusError{Code: http.StatusForbidden, Message: err.Error()}
+	}
+	log.Infof("Reserved %d sat (%d sat of fees) for %v", spend.AmountSat+spend.FeeSat, spend.FeeSat, method)
+	return release, nil
+}
+
+// spendFailed returns true if the response of a payment method reports a
+// failed payment, so that its amount doesn't count towards the budget.
+func spendFailed(resultJSON string) bool {
+	var result struct {
+		PaymentError string `json:"payment_error"`
+		Status       string `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(resultJSON), &result); err != nil {
+		return false
+	}
+	return result.PaymentError != "" || result.Status == "FAILED"
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDestination = "02aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+
+// setTestSpendingLimits sets the daemon spending limits and replaces the
+// spending store with an empty one.
+func setTestSpendingLimits(t *testing.T, limits SpendingLimits) {
+	setTestSpendingStore(t, limits.DailyBudgetSat)
+	configMutex.Lock()
+	previousMax, previousDestinations := LNCD_SPEND_MAX_PAYMENT_SAT, LNCD_SPEND_ALLOWED_DESTINATIONS
+	LNCD_SPEND_MAX_PAYMENT_SAT = limits.MaxPaymentSat
+	LNCD_SPEND_ALLOWED_DESTINATIONS = strings.Join(limits.AllowedDestinations, ",")
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_SPEND_MAX_PAYMENT_SAT, LNCD_SPEND_ALLOWED_DESTINATIONS = previousMax, previousDestinations
+		configMutex.Unlock()
+	})
+}
+
+func TestParseSpend(t *testing.T) {
+	payReq := newTestPaymentRequest(t, 1000)
+	invoice, err := decodePaymentRequest(payReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payee := hex.EncodeToString(invoice.Destination.SerializeCompressed())
+
+	tests := []struct {
+		name    string
+		method  string
+		payload string
+		// nil when the method doesn't send funds
+		spend *Spend
+		err   bool
+	}{
+		{"payment request", "lnrpc.Lightning.SendPaymentSync", `{"payment_request":"` + payReq + `"}`,
+			&Spend{AmountSat: 1000, FeeSat: 1000, Destinations: []string{payee}, amountKnown: true}, false},
+		{"fixed fee limit", "lnrpc.Lightning.SendPaymentSync", `{"payment_request":"` + payReq + `","fee_limit":{"fixed":"10"}}`,
+			&Spend{AmountSat: 1000, FeeSat: 10, Destinations: []string{payee}, amountKnown: true}, false},
+		{"percent fee limit", "lnrpc.Lightning.SendPayment", `{"payment_request":"` + payReq + `","fee_limit":{"percent":"5"}}`,
+			&Spend{AmountSat: 1000, FeeSat: 50, Destinations: []string{payee}, amountKnown: true}, false},
+		{"keysend", "lnrpc.Lightning.SendPaymentSync", `{"dest_string":"` + testDestination + `","amt":"500","fee_limit":{"fixed_msat":"1500"}}`,
+			&Spend{AmountSat: 500, FeeSat: 2, Destinations: []string{testDestination}, amountKnown: true}, false},
+		{"router payment", "routerrpc.Router.SendPaymentV2", `{"payment_request":"` + payReq + `","fee_limit_sat":"20"}`,
+			&Spend{AmountSat: 1000, FeeSat: 20, Destinations: []string{payee}, amountKnown: true}, false},
+		{"router amount in msat", "routerrpc.Router.SendPaymentV2", `{"dest":"` + hexToBase64(t, testDestination) + `","amt_msat":"1500","fee_limit_msat":"1"}`,
+			&Spend{AmountSat: 2, FeeSat: 1, Destinations: []string{testDestination}, amountKnown: true}, false},
+		{"invalid payment request", "lnrpc.Lightning.SendPaymentSync", `{"payment_request":"lnbc1invalid"}`, nil, true},
+		{"route", "lnrpc.Lightning.SendToRouteSync", `{"route":{"total_amt_msat":"1010000","total_fees_msat":"10000","hops":[{"pub_key":"` + testDestination + `"}]}}`,
+			&Spend{AmountSat: 1000, FeeSat: 10, Destinations: []string{testDestination}, amountKnown: true}, false},
+		{"empty route", "routerrpc.Router.SendToRouteV2", `{}`, &Spend{amountKnown: true}, false},
+		{"on-chain", "lnrpc.Lightning.SendCoins", `{"addr":"bc1qexample","amount":"20000"}`,
+			&Spend{AmountSat: 20000, Destinations: []string{"bc1qexample"}, amountKnown: true}, false},
+		{"sweep", "lnrpc.Lightning.SendCoins", `{"addr":"bc1qexample","send_all":true}`,
+			&Spend{Destinations: []string{"bc1qexample"}}, false},
+		{"send many", "lnrpc.Lightning.SendMany", `{"AddrToAmount":{"bc1qexample":"1000"}}`,
+			&Spend{AmountSat: 1000, Destinations: []string{"bc1qexample"}, amountKnown: true}, false},
+		{"channel open", "lnrpc.Lightning.OpenChannelSync", `{"node_pubkey_string":"` + testDestination + `","local_funding_amount":"100000","push_sat":"1000","close_address":"bc1qclose"}`,
+			&Spend{AmountSat: 100000, Destinations: []string{testDestination, "bc1qclose"}, amountKnown: true}, false},
+		{"channel open with all the funds", "lnrpc.Lightning.OpenChannel", `{"node_pubkey_string":"` + testDestination + `","fund_max":true}`,
+			&Spend{Destinations: []string{testDestination}}, false},
+		{"batch channel open", "lnrpc.Lightning.BatchOpenChannel", `{"channels":[{"node_pubkey":"` + hexToBase64(t, testDestination) + `","local_funding_amount":"50000"},{"node_pubkey":"` + hexToBase64(t, testDestination) + `","local_funding_amount":"70000"}]}`,
+			&Spend{AmountSat: 120000, Destinations: []string{testDestination, testDestination}, amountKnown: true}, false},
+		{"cooperative close", "lnrpc.Lightning.CloseChannel", `{}`, &Spend{amountKnown: true}, false},
+		{"close to an address", "lnrpc.Lightning.CloseChannel", `{"delivery_address":"bc1qexample"}`,
+			&Spend{Destinations: []string{"bc1qexample"}}, false},
+		{"invoice", "lnrpc.Lightning.AddInvoice", `{"value":"1000"}`, nil, false},
+		{"invalid payload", "lnrpc.Lightning.SendCoins", `{"amount":"many"}`, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			spend, err := parseSpend(test.method, test.payload)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(spend, test.spend) {
+				t.Fatalf("expected %+v, got %+v", test.spend, spend)
+			}
+		})
+	}
+}
+
+func hexToBase64(t *testing.T, value string) string {
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func TestFeeLimitSat(t *testing.T) {
+	tests := []struct {
+		name                       string
+		fixedSat, fixedMsat, pct   int64
+		amountSat, expectedFeeSats int64
+	}{
+		{"no limit", 0, 0, 0, 1000, 1000},
+		{"fixed", 10, 0, 0, 1000, 10},
+		{"fixed msat rounded up", 0, 1001, 0, 1000, 2},
+		{"percent rounded up", 0, 0, 1, 150, 2},
+		{"fixed over percent", 10, 0, 50, 1000, 10},
+	}
+	for _, test := range tests {
+		if fee := feeLimitSat(test.fixedSat, test.fixedMsat, test.pct, test.amountSat); fee != test.expectedFeeSats {
+			t.Errorf("%v: expected %d sat, got %d", test.name, test.expectedFeeSats, fee)
+		}
+	}
+}
+
+func TestCheckSpendingLimits(t *testing.T) {
+	payment := &Spend{AmountSat: 1000, Destinations: []string{testDestination}, amountKnown: true}
+	sweep := &Spend{Destinations: []string{"bc1qexample"}}
+
+	tests := []struct {
+		name   string
+		spend  *Spend
+		limits *SpendingLimits
+		err    string
+	}{
+		{"no limits", sweep, nil, ""},
+		{"empty limits", sweep, &SpendingLimits{}, ""},
+		{"under the maximum", payment, &SpendingLimits{MaxPaymentSat: 1000}, ""},
+		{"over the maximum", payment, &SpendingLimits{MaxPaymentSat: 999}, "policy: amount 1000 sat exceeds the maximum of 999 sat per payment"},
+		{"unknown amount with a maximum", sweep, &SpendingLimits{MaxPaymentSat: 1000}, "policy: amount cannot be determined in advance"},
+		{"unknown amount with a budget", sweep, &SpendingLimits{DailyBudgetSat: 1000}, "policy: amount cannot be determined in advance"},
+		{"unknown amount to an allowed destination", sweep, &SpendingLimits{AllowedDestinations: []string{"BC1QEXAMPLE"}}, ""},
+		{"allowed destination", payment, &SpendingLimits{AllowedDestinations: []string{"bc1qother", testDestination}}, ""},
+		{"destination not allowed", payment, &SpendingLimits{AllowedDestinations: []string{"bc1qother"}}, "policy: destination " + testDestination + " is not allowed"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSpendingLimits(test.spend, test.limits, "policy")
+			if test.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSpendingStoreReserve(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spending.json")
+	store, err := newSpendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	budgets := map[string]int64{"connection": 3000, "token:alice": 2000}
+	spend := &Spend{AmountSat: 900, FeeSat: 100, amountKnown: true}
+	spent := func(store *spendingStore, key string) int64 {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		return store.total(key, time.Now())
+	}
+
+	release, err := store.reserve(spend, budgets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.reserve(spend, budgets); err != nil {
+		t.Fatal(err)
+	}
+	// the token budget is exhausted, nothing is counted in the other one
+	if _, err := store.reserve(spend, budgets); err == nil || !strings.Contains(err.Error(), "daily budget exceeded: 2000 of 2000 sat") {
+		t.Fatalf("expected the budget to be exceeded, got %v", err)
+	}
+	if spent(store, "connection") != 2000 || spent(store, "token:alice") != 2000 {
+		t.Fatalf("unexpected totals %d and %d", spent(store, "connection"), spent(store, "token:alice"))
+	}
+
+	// a failed spend is released from every budget
+	release()
+	if spent(store, "connection") != 1000 || spent(store, "token:alice") != 1000 {
+		t.Fatalf("reservation not released, totals %d and %d", spent(store, "connection"), spent(store, "token:alice"))
+	}
+
+	// the totals survive a restart, and don't reuse the IDs of the records
+	reloaded, err := newSpendingStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent(reloaded, "connection") != 1000 || reloaded.nextID != store.nextID {
+		t.Fatalf("unexpected reloaded store: %d sat spent, next ID %d", spent(reloaded, "connection"), reloaded.nextID)
+	}
+
+	// spends older than 24 hours don't count
+	reloaded.mutex.Lock()
+	for key, records := range reloaded.records {
+		for i := range records {
+			records[i].Time = records[i].Time.Add(-25 * time.Hour)
+		}
+		reloaded.records[key] = records
+	}
+	reloaded.mutex.Unlock()
+	if spent(reloaded, "connection") != 0 || spent(reloaded, "token:alice") != 0 || len(reloaded.records) != 0 {
+		t.Fatal("old spends still counted")
+	}
+}
+
+func TestAuthorizeSpend(t *testing.T) {
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "policy test"}
+	payment := func(amountSat int) string {
+		return `{"dest_string":"` + testDestination + `","amt":"` + strconv.Itoa(amountSat) + `","fee_limit":{"fixed":"10"}}`
+	}
+
+	tests := []struct {
+		name     string
+		global   SpendingLimits
+		token    *SpendingLimits
+		owner    *SpendingLimits
+		method   string
+		payloads []string
+		// status of the last call, 0 if allowed
+		status int
+		// amount counted in the budget of each key after the calls
+		spent map[string]int64
+	}{
+		{name: "no limits", method: "lnrpc.Lightning.SendCoins", payloads: []string{`{"addr":"bc1qexample","send_all":true}`}},
+		{name: "over the daemon maximum", global: SpendingLimits{MaxPaymentSat: 1000}, method: "lnrpc.Lightning.SendPaymentSync",
+			payloads: []string{payment(1001)}, status: http.StatusForbidden},
+		{name: "destination not allowed", global: SpendingLimits{AllowedDestinations: []string{"bc1qother"}}, method: "lnrpc.Lightning.SendCoins",
+			payloads: []string{`{"addr":"bc1qexample","amount":"1000"}`}, status: http.StatusForbidden},
+		{name: "unpriced method", global: SpendingLimits{DailyBudgetSat: 10000}, method: "walletrpc.WalletKit.SendOutputs",
+			payloads: []string{`{}`}, status: http.StatusForbidden},
+		{name: "read method", global: SpendingLimits{DailyBudgetSat: 10000}, method: "lnrpc.Lightning.GetInfo", payloads: []string{`{}`}},
+		{name: "daemon budget", global: SpendingLimits{DailyBudgetSat: 2500}, method: "lnrpc.Lightning.SendPaymentSync",
+			payloads: []string{payment(1000), payment(1000), payment(1000)}, status: http.StatusForbidden,
+			spent: map[string]int64{connectionPolicyKey(info): 2020}},
+		{name: "token budget", global: SpendingLimits{DailyBudgetSat: 10000}, token: &SpendingLimits{DailyBudgetSat: 1500}, method: "lnrpc.Lightning.SendPaymentSync",
+			payloads: []string{payment(1000), payment(1000)}, status: http.StatusForbidden,
+			spent: map[string]int64{connectionPolicyKey(info): 1010, "token:alice": 1010}},
+		{name: "owner budget", token: &SpendingLimits{MaxPaymentSat: 5000}, owner: &SpendingLimits{DailyBudgetSat: 500}, method: "lnrpc.Lightning.SendPaymentSync",
+			payloads: []string{payment(1000)}, status: http.StatusForbidden,
+			spent: map[string]int64{"token:owner": 0}},
+		{name: "owner maximum", owner: &SpendingLimits{MaxPaymentSat: 100}, method: "lnrpc.Lightning.SendPaymentSync",
+			payloads: []string{payment(1000)}, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestSpendingLimits(t, test.global)
+			var owner []APIToken
+			if test.owner != nil {
+				owner = []APIToken{{Name: "owner", Token: "owner-token", SpendingLimits: *test.owner}}
+			}
+			setTestTokens(t, owner)
+			identity := &Identity{Name: "alice", spending: test.token}
+			if test.owner != nil {
+				identity.owner = "owner"
+			}
+			conn := &Connection{connInfo: info}
+
+			var err error
+			for _, payload := range test.payloads {
+				_, err = authorizeSpend(conn, identity, test.method, payload)
+			}
+			if statusCode(err) != test.status {
+				t.Fatalf("expected status %d, got %v", test.status, err)
+			}
+			for key, amount := range test.spent {
+				if spent := spentToday(key); spent != amount {
+					t.Fatalf("expected %d sat counted for %v, got %d", amount, key, spent)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizeSpendRelease(t *testing.T) {
+	setTestSpendingLimits(t, SpendingLimits{DailyBudgetSat: 1000})
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "policy release test"}
+	payload := `{"dest_string":"` + testDestination + `","amt":"900","fee_limit":{"fixed":"10"}}`
+
+	release, err := authorizeSpend(&Connection{connInfo: info}, anonymousIdentity, "lnrpc.Lightning.SendPaymentSync", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent := spentToday(connectionPolicyKey(info)); spent != 910 {
+		t.Fatalf("expected 910 sat to be reserved, got %d", spent)
+	}
+	release()
+	if spent := spentToday(connectionPolicyKey(info)); spent != 0 {
+		t.Fatalf("expected the reservation to be released, got %d", spent)
+	}
+	if _, err := authorizeSpend(&Connection{connInfo: info}, anonymousIdentity, "lnrpc.Lightning.SendPaymentSync", payload); err != nil {
+		t.Fatalf("released budget not available: %v", err)
+	}
+}
+
+func TestSpendFailed(t *testing.T) {
+	tests := []struct {
+		result string
+		failed bool
+	}{
+		{`{"payment_preimage":"AQ=="}`, false},
+		{`{"payment_error":"no route"}`, true},
+		{`{"status":"SUCCEEDED"}`, false},
+		{`{"status":"IN_FLIGHT"}`, false},
+		{`{"status":"FAILED","failure_reason":"FAILURE_REASON_NO_ROUTE"}`, true},
+		{`not json`, false},
+	}
+	for _, test := range tests {
+		if failed := spendFailed(test.result); failed != test.failed {
+			t.Errorf("%s: expected failed %v, got %v", test.result, test.failed, failed)
+		}
+	}
+}
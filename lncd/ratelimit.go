@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that allows up to burst requests at once and
+// refills at rate requests per second.
+type rateLimiter struct {
+	spec   string
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+// parseRateLimit parses a limit in the form "requests/interval", eg. "60/1m".
+// The number of requests is also used as burst size.
+func parseRateLimit(spec string) (*rateLimiter, error) {
+	countStr, intervalStr, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid rate limit %q, expected requests/interval", spec)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(countStr))
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q: bad request count", spec)
+	}
+	intervalStr = strings.TrimSpace(intervalStr)
+	if intervalStr != "" && (intervalStr[0] < '0' || intervalStr[0] > '9') {
+		// allow "10/s" as a shorthand for "10/1s"
+		intervalStr = "1" + intervalStr
+	}
+	interval, err := time.ParseDuration(intervalStr)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid rate limit %q: bad interval", spec)
+	}
+	limiter := newRateLimiter(float64(count)/interval.Seconds(), float64(count))
+	limiter.spec = spec
+	return limiter, nil
+}
+
+func newRateLimiter(rate float64, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// allow consumes a token if available. Otherwise it returns how long the
+// caller should wait before retrying.
+func (l *rateLimiter) allow() (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+func newRateLimitedError(retryAfter time.Duration) *StatusError {
+	return &StatusError{
+		Code:       http.StatusTooManyRequests,
+		Message:    "Too many requests",
+		RetryAfter: retryAfter,
+	}
+}
+
+const (
+	// Buckets kept by a rate limiter group, the least recently seen ones
+	// are dropped above it
+	rateLimiterGroupMaxKeys = 10000
+	// How often a rate limiter group drops the buckets that are full again
+	rateLimiterGroupPruneInterval = time.Minute
+)
+
+// rateLimiterGroup keeps a separate bucket for each key, eg. for each
+// client IP. Buckets not seen for long enough to be full again are dropped
+// to save memory, and the least recently seen ones when there are more than
+// maxKeys.
+type rateLimiterGroup struct {
+	spec      string
+	limiters  map[string]*rateLimiter
+	maxKeys   int
+	lastPrune time.Time
+	mutex     sync.Mutex
+}
+
+func newRateLimiterGroup(spec string) (*rateLimiterGroup, error) {
+	if _, err := parseRateLimit(spec); err != nil {
+		return nil, err
+	}
+	return &rateLimiterGroup{
+		spec:      spec,
+		limiters:  make(map[string]*rateLimiter),
+		maxKeys:   rateLimiterGroupMaxKeys,
+		lastPrune: time.Now(),
+	}, nil
+}
+
+func (g *rateLimiterGroup) allow(key string) (bool, time.Duration) {
+	if g == nil {
+		return true, 0
+	}
+
+	g.mutex.Lock()
+	limiter, ok := g.limiters[key]
+	if !ok {
+		// cannot fail, the spec was validated when the group was created
+		limiter, _ = parseRateLimit(g.spec)
+		g.limiters[key] = limiter
+	}
+	if now := time.Now(); len(g.limiters) > g.maxKeys || now.Sub(g.lastPrune) >= rateLimiterGroupPruneInterval {
+		g.prune(now)
+	}
+	g.mutex.Unlock()
+
+	return limiter.allow()
+}
+
+// prune drops the buckets that refilled since they were last seen, then
+// the least recently seen ones down to 90% of maxKeys, so a flood of new
+// keys doesn't prune on every request. Must be called with the mutex held.
+func (g *rateLimiterGroup) prune(now time.Time) {
+	g.lastPrune = now
+	type bucket struct {
+		key  string
+		last time.Time
+	}
+	var buckets []bucket = make([]bucket, 0, len(g.limiters))
+	for key, limiter := range g.limiters {
+		limiter.mutex.Lock()
+		full := limiter.tokens+now.Sub(limiter.last).Seconds()*limiter.rate >= limiter.burst
+		last := limiter.last
+		limiter.mutex.Unlock()
+		if full {
+			delete(g.limiters, key)
+		} else {
+			buckets = append(buckets, bucket{key, last})
+		}
+	}
+
+	if len(buckets) <= g.maxKeys {
+		return
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].last.Before(buckets[j].last)
+	})
+	for _, bucket := range buckets[:len(buckets)-g.maxKeys*9/10] {
+		delete(g.limiters, bucket.key)
+	}
+}
+
+// RateLimits are the limits configured with the LNCD_RATE_LIMIT_* variables.
+// A nil group means no limit.
+type RateLimits struct {
+	identity   *rateLimiterGroup
+	ip         *rateLimiterGroup
+	connection *rateLimiterGroup
+	handshake  *rateLimiter
+	// Limits by method glob pattern, applied separately to each connection
+	methods     map[string]*rateLimiterGroup
+	methodOrder []string
+}
+
+var (
+	rateLimitsMutex sync.RWMutex
+	rateLimits      = &RateLimits{}
+)
+
+// loadRateLimits parses the rate limits from the configuration.
+// Limits that didn't change keep their state.
+func loadRateLimits() error {
+	configMutex.RLock()
+	identitySpec, ipSpec, connectionSpec := LNCD_RATE_LIMIT_IDENTITY, LNCD_RATE_LIMIT_IP, LNCD_RATE_LIMIT_CONNECTION
+	handshakeSpec, methodsSpec := LNCD_RATE_LIMIT_HANDSHAKE, LNCD_RATE_LIMIT_METHODS
+	configMutex.RUnlock()
+
+	rateLimitsMutex.RLock()
+	previous := rateLimits
+	rateLimitsMutex.RUnlock()
+
+	group := func(spec string, old *rateLimiterGroup) (*rateLimiterGroup, error) {
+		if spec == "" {
+			return nil, nil
+		}
+		if old != nil && old.spec == spec {
+			return old, nil
+		}
+		return newRateLimiterGroup(spec)
+	}
+
+	var err error
+	limits := &RateLimits{
+		methods: make(map[string]*rateLimiterGroup),
+	}
+	if limits.identity, err = group(identitySpec, previous.identity); err != nil {
+		return fmt.Errorf("LNCD_RATE_LIMIT_IDENTITY: %v", err)
+	}
+	if limits.ip, err = group(ipSpec, previous.ip); err != nil {
+		return fmt.Errorf("LNCD_RATE_LIMIT_IP: %v", err)
+	}
+	if limits.connection, err = group(connectionSpec, previous.connection); err != nil {
+		return fmt.Errorf("LNCD_RATE_LIMIT_CONNECTION: %v", err)
+	}
+	if handshakeSpec != "" {
+		if previous.handshake != nil && previous.handshake.spec == handshakeSpec {
+			limits.handshake = previous.handshake
+		} else if limits.handshake, err = parseRateLimit(handshakeSpec); err != nil {
+			return fmt.Errorf("LNCD_RATE_LIMIT_HANDSHAKE: %v", err)
+		}
+	}
+	for _, entry := range strings.Split(methodsSpec, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		pattern, spec, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimSpace(pattern)
+		if !ok || pattern == "" {
+			return fmt.Errorf("LNCD_RATE_LIMIT_METHODS: invalid entry %q, expected method=limit", entry)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("LNCD_RATE_LIMIT_METHODS: invalid pattern %q", pattern)
+		}
+		if limits.methods[pattern], err = group(strings.TrimSpace(spec), previous.methods[pattern]); err != nil {
+			return fmt.Errorf("LNCD_RATE_LIMIT_METHODS: %v", err)
+		}
+		limits.methodOrder = append(limits.methodOrder, pattern)
+	}
+
+	rateLimitsMutex.Lock()
+	rateLimits = limits
+	rateLimitsMutex.Unlock()
+	return nil
+}
+
+func getRateLimits() *RateLimits {
+	rateLimitsMutex.RLock()
+	defer rateLimitsMutex.RUnlock()
+	return rateLimits
+}
+
+// allowIdentity applies the token specific limit if set, or the default
+// identity limit otherwise.
+func (limits *RateLimits) allowIdentity(identity *Identity) (bool, time.Duration) {
+	if identity.limiter != nil {
+		return identity.limiter.allow()
+	}
+	return limits.identity.allow(identity.Name)
+}
+
+func (limits *RateLimits) allowIP(ip string) (bool, time.Duration) {
+	return limits.ip.allow(ip)
+}
+
+// allowCall applies the per connection and per method limits. The method
+// limit is the one of the first pattern that matches.
+func (limits *RateLimits) allowCall(key ConnectionKey, method string) (bool, time.Duration) {
+	connectionKey := key.mailbox + "|" + key.pairingPhrase
+	if ok, retryAfter := limits.connection.allow(connectionKey); !ok {
+		incMetric("ratelimit_connection")
+		return false, retryAfter
+	}
+	for _, pattern := range limits.methodOrder {
+		if matched, _ := path.Match(pattern, method); matched {
+			if ok, retryAfter := limits.methods[pattern].allow(connectionKey + "|" + method); !ok {
+				incMetric("ratelimit_method")
+				return false, retryAfter
+			}
+			break
+		}
+	}
+	return true, 0
+}
+
+func (limits *RateLimits) allowHandshake() (bool, time.Duration) {
+	if limits.handshake == nil {
+		return true, 0
+	}
+	return limits.handshake.allow()
+}
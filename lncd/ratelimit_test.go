@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// setTestRateLimits replaces the rate limits for the duration of the test.
+func setTestRateLimits(t *testing.T, limits *RateLimits) {
+	rateLimitsMutex.Lock()
+	previous := rateLimits
+	rateLimits = limits
+	rateLimitsMutex.Unlock()
+	t.Cleanup(func() {
+		rateLimitsMutex.Lock()
+		rateLimits = previous
+		rateLimitsMutex.Unlock()
+	})
+}
+
+func newTestRateLimiterGroup(t *testing.T, spec string) *rateLimiterGroup {
+	t.Helper()
+	group, err := newRateLimiterGroup(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return group
+}
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		spec  string
+		rate  float64
+		burst float64
+		valid bool
+	}{
+		{"60/1m", 1, 60, true},
+		{" 10 / 1s ", 10, 10, true},
+		{"10/s", 10, 10, true},
+		{"5/m", 5.0 / 60, 5, true},
+		{"100/500ms", 200, 100, true},
+		{"", 0, 0, false},
+		{"10", 0, 0, false},
+		{"0/1s", 0, 0, false},
+		{"-1/1s", 0, 0, false},
+		{"ten/1s", 0, 0, false},
+		{"10/0s", 0, 0, false},
+		{"10/forever", 0, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			limiter, err := parseRateLimit(test.spec)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("invalid rate limit %q parsed", test.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if limiter.rate != test.rate || limiter.burst != test.burst || limiter.tokens != test.burst {
+				t.Fatalf("expected rate %v and burst %v, got %v and %v", test.rate, test.burst, limiter.rate, limiter.burst)
+			}
+		})
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter(10, 2)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.allow(); !ok {
+			t.Fatalf("request %d within the burst refused", i)
+		}
+	}
+	ok, retryAfter := limiter.allow()
+	if ok || retryAfter <= 0 || retryAfter > 100*time.Millisecond {
+		t.Fatalf("expected to wait up to 100ms, got %v %v", ok, retryAfter)
+	}
+
+	// one token every 100ms
+	limiter.last = limiter.last.Add(-150 * time.Millisecond)
+	if ok, _ := limiter.allow(); !ok {
+		t.Fatal("refilled token refused")
+	}
+	if ok, _ := limiter.allow(); ok {
+		t.Fatal("more tokens than refilled")
+	}
+}
+
+func TestRateLimiterGroup(t *testing.T) {
+	var group *rateLimiterGroup
+	if ok, _ := group.allow("anyone"); !ok {
+		t.Fatal("a nil group must not limit")
+	}
+
+	group = newTestRateLimiterGroup(t, "2/1m")
+	for i := 0; i < 2; i++ {
+		if ok, _ := group.allow("192.0.2.1"); !ok {
+			t.Fatalf("request %d refused", i)
+		}
+	}
+	if ok, _ := group.allow("192.0.2.1"); ok {
+		t.Fatal("request over the limit allowed")
+	}
+	if ok, _ := group.allow("192.0.2.2"); !ok {
+		t.Fatal("keys must have separate buckets")
+	}
+}
+
+func TestRateLimiterGroupPrune(t *testing.T) {
+	tests := []struct {
+		name string
+		// how long ago each key was last seen
+		seen    map[string]time.Duration
+		maxKeys int
+		kept    []string
+	}{
+		{
+			name:    "refilled buckets",
+			seen:    map[string]time.Duration{"a": time.Second, "b": time.Hour, "c": 2 * time.Minute},
+			maxKeys: 100,
+			kept:    []string{"a"},
+		},
+		{
+			// over the cap the least recently seen buckets are dropped,
+			// even if not full
+			name:    "over the cap",
+			seen:    map[string]time.Duration{"a": 4 * time.Second, "b": 3 * time.Second, "c": 2 * time.Second, "d": time.Second},
+			maxKeys: 3,
+			kept:    []string{"c", "d"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			group := newTestRateLimiterGroup(t, "10/1m")
+			group.maxKeys = test.maxKeys
+			now := time.Now()
+			for key, seen := range test.seen {
+				limiter, _ := parseRateLimit(group.spec)
+				limiter.tokens = 0
+				limiter.last = now.Add(-seen)
+				group.limiters[key] = limiter
+			}
+
+			group.prune(now)
+			if len(group.limiters) != len(test.kept) {
+				t.Fatalf("expected %d buckets, got %d", len(test.kept), len(group.limiters))
+			}
+			for _, key := range test.kept {
+				if group.limiters[key] == nil {
+					t.Fatalf("bucket %v dropped", key)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterGroupCap(t *testing.T) {
+	group := newTestRateLimiterGroup(t, "1/1h")
+	group.maxKeys = 100
+	if ok, _ := group.allow("attacker"); !ok {
+		t.Fatal("first request refused")
+	}
+	for i := 0; i < 1000; i++ {
+		group.allow(fmt.Sprintf("198.51.100.%d", i))
+		if len(group.limiters) > group.maxKeys {
+			t.Fatalf("%d buckets over the cap", len(group.limiters))
+		}
+		if i%10 == 0 {
+			// keeps its bucket while it keeps sending requests
+			if ok, _ := group.allow("attacker"); ok {
+				t.Fatal("bucket of an active key dropped")
+			}
+		}
+	}
+}
+
+func TestAllowCall(t *testing.T) {
+	limits := &RateLimits{
+		methods: map[string]*rateLimiterGroup{
+			"lnrpc.Lightning.Send*": newTestRateLimiterGroup(t, "1/1m"),
+			"lnrpc.Lightning.*":     newTestRateLimiterGroup(t, "3/1m"),
+		},
+		methodOrder: []string{"lnrpc.Lightning.Send*", "lnrpc.Lightning.*"},
+	}
+	key := ConnectionKey{"mailbox.example.com:443", "phrase"}
+
+	if ok, _ := limits.allowCall(key, "lnrpc.Lightning.SendPaymentSync"); !ok {
+		t.Fatal("first payment refused")
+	}
+	if ok, _ := limits.allowCall(key, "lnrpc.Lightning.SendPaymentSync"); ok {
+		t.Fatal("payment over the method limit allowed")
+	}
+	// only the first matching pattern applies, and each method has its
+	// own bucket
+	if ok, _ := limits.allowCall(key, "lnrpc.Lightning.SendCoins"); !ok {
+		t.Fatal("other method refused")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := limits.allowCall(key, "lnrpc.Lightning.GetInfo"); !ok {
+			t.Fatalf("call %d refused", i)
+		}
+	}
+	if ok, _ := limits.allowCall(key, "lnrpc.Lightning.GetInfo"); ok {
+		t.Fatal("call over the method limit allowed")
+	}
+	// limits are separate for each connection
+	if ok, _ := limits.allowCall(ConnectionKey{"mailbox.example.com:443", "other"}, "lnrpc.Lightning.GetInfo"); !ok {
+		t.Fatal("call of another connection refused")
+	}
+
+	limits.connection = newTestRateLimiterGroup(t, "1/1m")
+	other := ConnectionKey{"mailbox.example.com:443", "connection limit"}
+	limits.allowCall(other, "walletrpc.WalletKit.ListUnspent")
+	if ok, _ := limits.allowCall(other, "walletrpc.WalletKit.ListUnspent"); ok {
+		t.Fatal("call over the connection limit allowed")
+	}
+}
+
+func TestIPRateLimitBeforeAuthentication(t *testing.T) {
+	setTestTokens(t, []APIToken{{Name: "alice", Token: "alice-token"}})
+	setTestAuthConfig(t, "", "", 0)
+	setTestRateLimits(t, &RateLimits{ip: newTestRateLimiterGroup(t, "3/1h")})
+
+	// failed attempts are counted
+	for i := 0; i < 3; i++ {
+		if _, err := authenticateRequest(nil, "Bearer guess", "203.0.113.1"); statusCode(err) != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %v", i, err)
+		}
+	}
+	if _, err := authenticateRequest(nil, "Bearer guess", "203.0.113.1"); statusCode(err) != http.StatusTooManyRequests {
+		t.Fatalf("expected the guesses to be rate limited, got %v", err)
+	}
+	if _, err := authenticateRequest(nil, "Bearer alice-token", "203.0.113.1"); statusCode(err) != http.StatusTooManyRequests {
+		t.Fatalf("expected the IP to be rate limited, got %v", err)
+	}
+	if _, err := authenticateRequest(nil, "Bearer alice-token", "203.0.113.2"); err != nil {
+		t.Fatalf("other IP refused: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Headers used by the REST routes to select the LNC connection.
+const (
+	headerMailbox       = "Lncd-Mailbox"
+	headerPairingPhrase = "Lncd-Pairing-Phrase"
+	headerLocalKey      = "Lncd-Local-Key"
+	headerRemoteKey     = "Lncd-Remote-Key"
+	headerSession       = "Lncd-Session"
+)
+
+// restCall carries the connection of a REST request through the gateway,
+// and the keys negotiated by the connection back to the response.
+type restCall struct {
+	info    ConnectionInfo
+	session string
+}
+
+type restCallContextKey struct{}
+
+func restCallFromContext(ctx context.Context) *restCall {
+	if call, ok := ctx.Value(restCallContextKey{}).(*restCall); ok {
+		return call
+	}
+	return &restCall{}
+}
+
+// poolClientConn is a grpc.ClientConnInterface that runs the calls of the
+// generated lnd clients through the connection pool, so the REST gateway
+// goes through the same permission and policy checks as /rpc.
+type poolClientConn struct {
+	pool *ConnectionPool
+}
+
+func (conn *poolClientConn) Invoke(ctx context.Context, fullMethod string, args interface{}, reply interface{}, opts ...grpc.CallOption) error {
+	// "/lnrpc.Lightning/GetInfo" is registered as "lnrpc.Lightning.GetInfo"
+	var method string = strings.Replace(strings.TrimPrefix(fullMethod, "/"), "/", ".", 1)
+
+	payload, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(args.(proto.Message))
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	var identity *Identity = identityFromContext(ctx)
+	var call *restCall = restCallFromContext(ctx)
+	log.Infof("Incoming REST request: %v from %v", method, identity.Name)
+
+	info, err := resolveConnection(identity, call.session, call.info)
+	if err != nil {
+		return err
+	}
+	if err := authorizeCall(identity, info, method); err != nil {
+		log.Infof("Refusing method %v: %v", method, err)
+		return err
+	}
+
+	info, result, err := conn.pool.call(ctx, info, call.session, identity, method, string(payload))
+	if err != nil {
+		return err
+	}
+	call.info = info
+	log.Debugf("REST response: %v", result)
+
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal([]byte(result), reply.(proto.Message))
+}
+
+func (conn *poolClientConn) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return nil, status.Error(codes.Unimplemented, "streaming methods are not supported over REST")
+}
+
+// restErrorHandler writes our own errors like the rest of the API and falls
+// back to the gateway handler for the errors returned by lnd.
+func restErrorHandler(ctx context.Context, mux *runtime.ServeMux, marshaler runtime.Marshaler, w http.ResponseWriter, r *http.Request, err error) {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		writeError(w, err)
+		return
+	}
+	runtime.DefaultHTTPErrorHandler(ctx, mux, marshaler, w, r, err)
+}
+
+// restForwardKeys returns the keys of the connection in the response
+// headers, so clients not using sessions can reuse the pairing.
+func restForwardKeys(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+	var call *restCall = restCallFromContext(ctx)
+	if call.session == "" && call.info.LocalKey != "" {
+		w.Header().Set(headerLocalKey, call.info.LocalKey)
+		w.Header().Set(headerRemoteKey, call.info.RemoteKey)
+	}
+	return nil
+}
+
+// restHandler serves lnd's REST routes (e.g. GET /v1/getinfo) using the
+// same request and response formats as lnd's REST proxy. The connection is
+// selected by the Lncd-Session header or by the Lncd-Mailbox,
+// Lncd-Pairing-Phrase and optional key headers.
+func restHandler(pool *ConnectionPool) (http.HandlerFunc, error) {
+	mux := runtime.NewServeMux(
+		runtime.WithMarshalerOption(runtime.MIMEWildcard, &runtime.JSONPb{
+			MarshalOptions:   *lnrpc.RESTJsonMarshalOpts,
+			UnmarshalOptions: *lnrpc.RESTJsonUnmarshalOpts,
+		}),
+		runtime.WithDisablePathLengthFallback(),
+		runtime.WithErrorHandler(restErrorHandler),
+		runtime.WithForwardResponseOption(restForwardKeys),
+	)
+
+	client := lnrpc.NewLightningClient(&poolClientConn{pool: pool})
+	if err := lnrpc.RegisterLightningHandlerClient(context.Background(), mux, client); err != nil {
+		return nil, err
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		call := &restCall{
+			info: ConnectionInfo{
+				Mailbox:       r.Header.Get(headerMailbox),
+				PairingPhrase: r.Header.Get(headerPairingPhrase),
+				LocalKey:      r.Header.Get(headerLocalKey),
+				RemoteKey:     r.Header.Get(headerRemoteKey),
+			},
+			session: r.Header.Get(headerSession),
+		}
+		if call.session == "" && (call.info.Mailbox == "" || call.info.PairingPhrase == "") {
+			writeJSONError(w, "either "+headerSession+" or "+headerMailbox+" and "+headerPairingPhrase+" headers are required", http.StatusBadRequest)
+			return
+		}
+		mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), restCallContextKey{}, call)))
+	}, nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Session stores the credentials of an LNC connection on the daemon, so
+// that clients can refer to it by ID instead of sending the pairing phrase
+// and keys with every call.
+type Session struct {
+	ID         string
+	Owner      string
+	Connection ConnectionInfo
+	Created    time.Time
+}
+
+// SessionStore keeps the sessions in memory and optionally in a JSON file.
+type SessionStore struct {
+	path     string
+	sessions map[string]*Session
+	mutex    sync.RWMutex
+}
+
+var sessions *SessionStore
+
+func NewSessionStore(path string) (*SessionStore, error) {
+	store := &SessionStore{
+		path:     path,
+		sessions: make(map[string]*Session),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.sessions); err != nil {
+		return nil, fmt.Errorf("invalid sessions file %v: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes the sessions to disk, must be called with the mutex held.
+func (store *SessionStore) save() {
+	if store.path == "" {
+		return
+	}
+	if err := saveJSONFile(store.path, store.sessions); err != nil {
+		log.Errorf("Unable to save sessions: %v", err)
+	}
+}
+
+// saveJSONFile atomically replaces the file at path with v encoded as JSON.
+// The files written by the daemon contain secrets, so they are only readable
+// by the owner.
+func saveJSONFile(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// newRandomID returns a random hex identifier that can't be guessed.
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func (store *SessionStore) create(owner *Identity, info ConnectionInfo) (*Session, error) {
+	if info.Mailbox == "" || info.PairingPhrase == "" {
+		return nil, &StatusError{Code: http.StatusBadRequest, Message: "Mailbox and PairingPhrase are required"}
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	session := &Session{
+		ID:    id,
+		Owner: owner.Name,
+		Connection: ConnectionInfo{
+			Mailbox:       info.Mailbox,
+			PairingPhrase: info.PairingPhrase,
+			LocalKey:      info.LocalKey,
+			RemoteKey:     info.RemoteKey,
+		},
+		Created: time.Now(),
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.sessions[session.ID] = session
+	store.save()
+	return session, nil
+}
+
+// get returns a copy of the session if it is owned by identity.
+func (store *SessionStore) get(id string, identity *Identity) (*Session, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	session, ok := store.sessions[id]
+	if !ok || session.Owner != identity.Name {
+		return nil, &StatusError{Code: http.StatusNotFound, Message: "Session not found"}
+	}
+	sessionCopy := *session
+	return &sessionCopy, nil
+}
+
+// connection returns the connection of a session regardless of its owner,
+// for the subsystems that use sessions on behalf of their owner.
+func (store *SessionStore) connection(id string) (ConnectionInfo, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	session, ok := store.sessions[id]
+	if !ok {
+		return ConnectionInfo{}, &StatusError{Code: http.StatusNotFound, Message: "Session not found"}
+	}
+	return session.Connection, nil
+}
+
+func (store *SessionStore) list(identity *Identity) []*Session {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	var owned []*Session = []*Session{}
+	for _, session := range store.sessions {
+		if session.Owner == identity.Name {
+			sessionCopy := *session
+			owned = append(owned, &sessionCopy)
+		}
+	}
+	return owned
+}
+
+// updateKeys stores the keys negotiated by the connection, so that the next
+// calls reuse the same pairing.
+func (store *SessionStore) updateKeys(id string, info ConnectionInfo) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	session, ok := store.sessions[id]
+	if !ok {
+		return
+	}
+	if session.Connection.LocalKey == info.LocalKey && session.Connection.RemoteKey == info.RemoteKey {
+		return
+	}
+	session.Connection.LocalKey = info.LocalKey
+	session.Connection.RemoteKey = info.RemoteKey
+	store.save()
+}
+
+// updateConnectionKeys stores the keys negotiated by a connection in every
+// session that uses it.
+func (store *SessionStore) updateConnectionKeys(info ConnectionInfo) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var changed bool
+	for _, session := range store.sessions {
+		if session.Connection.Mailbox != info.Mailbox || session.Connection.PairingPhrase != info.PairingPhrase {
+			continue
+		}
+		if session.Connection.LocalKey != info.LocalKey || session.Connection.RemoteKey != info.RemoteKey {
+			session.Connection.LocalKey = info.LocalKey
+			session.Connection.RemoteKey = info.RemoteKey
+			changed = true
+		}
+	}
+	if changed {
+		store.save()
+	}
+}
+
+func (store *SessionStore) delete(id string, identity *Identity) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	session, ok := store.sessions[id]
+	if !ok || session.Owner != identity.Name {
+		return &StatusError{Code: http.StatusNotFound, Message: "Session not found"}
+	}
+	delete(store.sessions, id)
+	store.save()
+	return nil
+}
+
+// resolveConnection returns the connection info of the session if sessionID
+// is set, or info otherwise.
+func resolveConnection(identity *Identity, sessionID string, info ConnectionInfo) (ConnectionInfo, error) {
+	if sessionID == "" {
+		return info, nil
+	}
+	session, err := sessions.get(sessionID, identity)
+	if err != nil {
+		return info, err
+	}
+	return session.Connection, nil
+}
+
+// sessionView is how a session is returned to clients, without secrets.
+type sessionView struct {
+	ID      string
+	Mailbox string
+	Created time.Time
+}
+
+func newSessionView(session *Session) sessionView {
+	return sessionView{
+		ID:      session.ID,
+		Mailbox: session.Connection.Mailbox,
+		Created: session.Created,
+	}
+}
+
+// responseConnection returns the connection info sent back with the result
+// of a call. Calls made with a session don't get the pairing phrase and the
+// keys, the session ID is enough to reuse the connection.
+func responseConnection(info ConnectionInfo, sessionID string) ConnectionInfo {
+	if sessionID == "" {
+		return info
+	}
+	return publicConnection(info)
+}
+
+// publicConnection returns the connection info without the pairing phrase
+// and the keys.
+func publicConnection(info ConnectionInfo) ConnectionInfo {
+	return ConnectionInfo{Mailbox: info.Mailbox, Status: info.Status}
+}
+
+// createSessionHandler stores the connection info of the request body and
+// returns the session ID.
+func createSessionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var info ConnectionInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := identityFromContext(r.Context())
+	session, err := sessions.create(identity, info)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Session %v created by %v", session.ID, identity.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newSessionView(session))
+}
+
+func listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	var views []sessionView = []sessionView{}
+	for _, session := range sessions.list(identityFromContext(r.Context())) {
+		views = append(views, newSessionView(session))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func deleteSessionHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromContext(r.Context())
+	if err := sessions.delete(r.PathValue("id"), identity); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Session %v deleted by %v", r.PathValue("id"), identity.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -12,11 +12,15 @@ var (
 type ConnectionStats struct {
 	NumPendingActions int
 	Status            string
+	CachedResponses   int
 }
 
 type Stats struct {
 	NumConnections int
 	Connections    []ConnectionStats
+	Metrics        map[string]uint64
+	// Share of the cacheable calls answered from the cache
+	CacheHitRate float64
 }
 
 func refreshStats(pool *ConnectionPool, stats *Stats) *Stats {
@@ -31,6 +35,11 @@ func refreshStats(pool *ConnectionPool, stats *Stats) *Stats {
 	}
 
 	stats.NumConnections = len(pool.connections)
+	stats.Metrics = getMetrics()
+	stats.CacheHitRate = 0
+	if lookups := stats.Metrics["cache_hits"] + stats.Metrics["cache_misses"]; lookups > 0 {
+		stats.CacheHitRate = float64(stats.Metrics["cache_hits"]) / float64(lookups)
+	}
 	if stats.Connections == nil || len(stats.Connections) != len(pool.connections) {
 		stats.Connections = make([]ConnectionStats, len(pool.connections))
 	}
@@ -40,6 +49,7 @@ func refreshStats(pool *ConnectionPool, stats *Stats) *Stats {
 		stats.Connections[i] = ConnectionStats{
 			NumPendingActions: len(conn.actions),
 			Status:            conn.connInfo.Status,
+			CachedResponses:   conn.cache.len(),
 		}
 		i++
 	}
@@ -64,7 +74,12 @@ func startStatsLoop(pool *ConnectionPool) {
 					statsString += fmt.Sprintf("\n    Connection id: %d", i)
 					statsString += fmt.Sprintf("\n        Pending actions: %d", conn.NumPendingActions)
 					statsString += fmt.Sprintf("\n        Status: %s", conn.Status)
+					statsString += fmt.Sprintf("\n        Cached responses: %d", conn.CachedResponses)
+				}
+				for name, value := range lastStats.Metrics {
+					statsString += fmt.Sprintf("\n    %s: %d", name, value)
 				}
+				statsString += fmt.Sprintf("\n    Cache hit rate: %.2f", lastStats.CacheHitRate)
 				log.Debugf("Stats: %s", statsString)
 			}
 		}
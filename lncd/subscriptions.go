@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Events delivered to the subscriptions
+const (
+	eventInvoiceSettled  = "invoice.settled"
+	eventInvoiceCanceled = "invoice.canceled"
+)
+
+// Subscription delivers the settlement and cancellation of the invoices of
+// a node to a webhook.
+type Subscription struct {
+	ID         string
+	Owner      string
+	URL        string
+	Secret     string
+	Connection ConnectionInfo
+	Created    time.Time
+	// Settle index of the last settlement delivered, or of the node when
+	// the subscription was created. The settlements up to it are not
+	// delivered, and the stream resumes from it after a restart
+	SettleIndex uint64 `json:",omitempty"`
+}
+
+// InvoiceWebhook is the body of the webhooks of a subscription.
+type InvoiceWebhook struct {
+	Event        string
+	Subscription string
+	Time         time.Time
+	Invoice      json.RawMessage
+}
+
+// SubscriptionStore keeps the subscriptions in memory and optionally in a
+// JSON file, and keeps their invoice streams open.
+type SubscriptionStore struct {
+	path          string
+	subscriptions map[string]*Subscription
+	unsubscribe   map[string]func()
+	mutex         sync.Mutex
+}
+
+var subscriptions *SubscriptionStore
+
+func NewSubscriptionStore(path string) (*SubscriptionStore, error) {
+	store := &SubscriptionStore{
+		path:          path,
+		subscriptions: make(map[string]*Subscription),
+		unsubscribe:   make(map[string]func()),
+	}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.subscriptions); err != nil {
+		return nil, fmt.Errorf("invalid subscriptions file %v: %v", path, err)
+	}
+	return store, nil
+}
+
+// save writes the subscriptions to disk, must be called with the mutex held.
+func (store *SubscriptionStore) save() {
+	if store.path == "" {
+		return
+	}
+	if err := saveJSONFile(store.path, store.subscriptions); err != nil {
+		log.Errorf("Unable to save subscriptions: %v", err)
+	}
+}
+
+// start opens the invoice streams of the stored subscriptions. Each stream
+// resumes from the lowest settle index of its subscriptions, so the
+// settlements missed while the daemon was down are delivered to all of them.
+func (store *SubscriptionStore) start() {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var resumeFrom map[ConnectionKey]uint64 = make(map[ConnectionKey]uint64)
+	for _, subscription := range store.subscriptions {
+		key := ConnectionKey{subscription.Connection.Mailbox, subscription.Connection.PairingPhrase}
+		if index, ok := resumeFrom[key]; !ok || subscription.SettleIndex < index {
+			resumeFrom[key] = subscription.SettleIndex
+		}
+	}
+	for _, subscription := range store.subscriptions {
+		key := ConnectionKey{subscription.Connection.Mailbox, subscription.Connection.PairingPhrase}
+		store.listen(subscription, resumeFrom[key])
+	}
+}
+
+// listen registers the subscription on the invoice stream of its
+// connection, must be called with the mutex held.
+func (store *SubscriptionStore) listen(subscription *Subscription, settleIndex uint64) {
+	var id, url, secret string = subscription.ID, subscription.URL, subscription.Secret
+	store.unsubscribe[id] = invoiceStreams.subscribeFrom(subscription.Connection, settleIndex, func(info ConnectionInfo, invoice *lnrpc.Invoice) {
+		var event string
+		switch invoice.State {
+		case lnrpc.Invoice_SETTLED:
+			if !store.markSettled(subscription, invoice.SettleIndex) {
+				return
+			}
+			event = eventInvoiceSettled
+		case lnrpc.Invoice_CANCELED:
+			event = eventInvoiceCanceled
+		default:
+			return
+		}
+
+		invoiceData, err := invoiceJSON(invoice)
+		if err != nil {
+			log.Errorf("Unable to encode invoice: %v", err)
+			return
+		}
+		body, err := json.Marshal(InvoiceWebhook{
+			Event:        event,
+			Subscription: id,
+			Time:         time.Now(),
+			Invoice:      invoiceData,
+		})
+		if err != nil {
+			log.Errorf("Unable to encode webhook: %v", err)
+			return
+		}
+		log.Infof("Sending %v webhook for subscription %v", event, id)
+		sendWebhook(url, body, secret, event)
+	})
+}
+
+// create adds a subscription for the settlements that follow the current
+// settle index of the node.
+func (store *SubscriptionStore) create(ctx context.Context, owner *Identity, webhookURL string, secret string, info ConnectionInfo) (*Subscription, error) {
+	if info.Mailbox == "" || info.PairingPhrase == "" {
+		return nil, &StatusError{Code: http.StatusBadRequest, Message: "Mailbox and PairingPhrase are required"}
+	}
+	if err := validateWebhookURL(webhookURL); err != nil {
+		return nil, err
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+	if secret == "" {
+		if secret, err = newRandomID(); err != nil {
+			return nil, err
+		}
+	}
+
+	settleIndex, err := invoiceStreams.lastSettleIndex(ctx, info, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &Subscription{
+		ID:          id,
+		Owner:       owner.Name,
+		URL:         webhookURL,
+		Secret:      secret,
+		Connection:  info,
+		Created:     time.Now(),
+		SettleIndex: settleIndex,
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.subscriptions[id] = subscription
+	store.save()
+	store.listen(subscription, settleIndex)
+	subscriptionCopy := *subscription
+	return &subscriptionCopy, nil
+}
+
+// markSettled records the settlement as delivered to the subscription. It
+// returns false if it was already delivered, when it is replayed after a
+// restart, or if it happened before the subscription was created.
+func (store *SubscriptionStore) markSettled(subscription *Subscription, settleIndex uint64) bool {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if settleIndex <= subscription.SettleIndex {
+		return false
+	}
+	subscription.SettleIndex = settleIndex
+	store.save()
+	return true
+}
+
+func (store *SubscriptionStore) list(identity *Identity) []*Subscription {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var owned []*Subscription = []*Subscription{}
+	for _, subscription := range store.subscriptions {
+		if subscription.Owner == identity.Name {
+			subscriptionCopy := *subscription
+			owned = append(owned, &subscriptionCopy)
+		}
+	}
+	return owned
+}
+
+// updateConnectionKeys stores the keys negotiated by a connection in every
+// subscription that uses it.
+func (store *SubscriptionStore) updateConnectionKeys(info ConnectionInfo) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var changed bool
+	for _, subscription := range store.subscriptions {
+		if subscription.Connection.Mailbox != info.Mailbox || subscription.Connection.PairingPhrase != info.PairingPhrase {
+			continue
+		}
+		if subscription.Connection.LocalKey != info.LocalKey || subscription.Connection.RemoteKey != info.RemoteKey {
+			subscription.Connection.LocalKey = info.LocalKey
+			subscription.Connection.RemoteKey = info.RemoteKey
+			changed = true
+		}
+	}
+	if changed {
+		store.save()
+	}
+}
+
+func (store *SubscriptionStore) delete(id string, identity *Identity) error {
+	store.mutex.Lock()
+	subscription, ok := store.subscriptions[id]
+	if !ok || subscription.Owner != identity.Name {
+		store.mutex.Unlock()
+		return &StatusError{Code: http.StatusNotFound, Message: "Subscription not found"}
+	}
+	delete(store.subscriptions, id)
+	store.save()
+	unsubscribe := store.unsubscribe[id]
+	delete(store.unsubscribe, id)
+	store.mutex.Unlock()
+
+	// called without the mutex, it may need to wait for the stream
+	if unsubscribe != nil {
+		unsubscribe()
+	}
+	return nil
+}
+
+// SubscriptionRequest is the body of POST /subscriptions. If Secret is not
+// set, a random one is generated.
+type SubscriptionRequest struct {
+	Connection ConnectionInfo
+	Session    string
+	URL        string
+	Secret     string
+}
+
+// subscriptionView is how a subscription is returned to clients, the secret
+// is only included when it is created.
+type subscriptionView struct {
+	ID      string
+	URL     string
+	Mailbox string
+	Secret  string `json:",omitempty"`
+	Created time.Time
+}
+
+func newSubscriptionView(subscription *Subscription) subscriptionView {
+	return subscriptionView{
+		ID:      subscription.ID,
+		URL:     subscription.URL,
+		Mailbox: subscription.Connection.Mailbox,
+		Created: subscription.Created,
+	}
+}
+
+func createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	var request SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	identity := identityFromContext(r.Context())
+	if err := authorizeMethod(identity, "lnrpc.Lightning.SubscribeInvoices"); err != nil {
+		writeError(w, err)
+		return
+	}
+	info, err := resolveConnection(identity, request.Session, request.Connection)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	subscription, err := subscriptions.create(r.Context(), identity, request.URL, request.Secret, info)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Subscription %v created by %v", subscription.ID, identity.Name)
+
+	view := newSubscriptionView(subscription)
+	view.Secret = subscription.Secret
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(view)
+}
+
+func listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	var views []subscriptionView = []subscriptionView{}
+	for _, subscription := range subscriptions.list(identityFromContext(r.Context())) {
+		views = append(views, newSubscriptionView(subscription))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(views)
+}
+
+func deleteSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	identity := identityFromContext(r.Context())
+	if err := subscriptions.delete(r.PathValue("id"), identity); err != nil {
+		writeError(w, err)
+		return
+	}
+	log.Infof("Subscription %v deleted by %v", r.PathValue("id"), identity.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
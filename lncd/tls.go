@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the TLS certificate from memory and reloads it from
+// disk on request or when the files change, so renewed certificates are
+// picked up without restarting the daemon.
+// If a client CA bundle is set, it is reloaded alongside the certificate.
+type certReloader struct {
+	certPath   string
+	keyPath    string
+	caPath     string
+	clientAuth tls.ClientAuthType
+	cert       *tls.Certificate
+	clientCAs  *x509.CertPool
+	modTime    time.Time
+	mutex      sync.RWMutex
+}
+
+func newCertReloader(certPath string, keyPath string, caPath string, clientAuth string) (*certReloader, error) {
+	reloader := &certReloader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		caPath:   caPath,
+	}
+	if caPath != "" {
+		switch clientAuth {
+		case "required":
+			reloader.clientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			reloader.clientAuth = tls.VerifyClientCertIfGiven
+		case "none":
+			reloader.clientAuth = tls.NoClientCert
+		default:
+			return nil, fmt.Errorf("invalid client auth mode %q", clientAuth)
+		}
+	}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime := r.lastModTime()
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if r.caPath != "" {
+		caBundle, err := os.ReadFile(r.caPath)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBundle) {
+			return fmt.Errorf("no valid certificates in %v", r.caPath)
+		}
+	}
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTime = modTime
+	r.mutex.Unlock()
+
+	log.Infof("TLS certificate loaded from %v", r.certPath)
+	if r.caPath != "" {
+		log.Infof("TLS client CA bundle loaded from %v", r.caPath)
+	}
+	return nil
+}
+
+func (r *certReloader) lastModTime() time.Time {
+	var modTime time.Time
+	for _, path := range []string{r.certPath, r.keyPath, r.caPath} {
+		if path == "" {
+			continue
+		}
+		if stat, err := os.Stat(path); err == nil && stat.ModTime().After(modTime) {
+			modTime = stat.ModTime()
+		}
+	}
+	return modTime
+}
+
+// watch polls the certificate files and reloads them when they change.
+func (r *certReloader) watch(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			r.mutex.RLock()
+			changed := r.lastModTime().After(r.modTime)
+			r.mutex.RUnlock()
+			if changed {
+				if err := r.reload(); err != nil {
+					log.Errorf("Unable to reload TLS certificate: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.cert, nil
+}
+
+// tlsConfig returns a TLS configuration that always uses the last loaded
+// certificate and client CA bundle.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return &tls.Config{
+				GetCertificate: r.GetCertificate,
+				ClientAuth:     r.clientAuth,
+				ClientCAs:      r.clientCAs,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// clientCertificate returns the verified client certificate of the request,
+// if any.
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
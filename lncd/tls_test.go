@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate with its key, signed by parent or self
+// signed.
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCertificate(t *testing.T, template *x509.Certificate, parent *testCertificate) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+func newTestCA(t *testing.T, name string) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func newTestClientCertificate(t *testing.T, name string, ca *testCertificate) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: name},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+}
+
+func newTestServerCertificate(t *testing.T, ca *testCertificate) *testCertificate {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "lncd"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+}
+
+func (c *testCertificate) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der})
+}
+
+func (c *testCertificate) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c *testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestServerCertificate writes the certificate and key of the server
+// in dir and returns their paths.
+func writeTestServerCertificate(t *testing.T, dir string, cert *testCertificate) (string, string) {
+	certPath, keyPath := filepath.Join(dir, "tls.cert"), filepath.Join(dir, "tls.key")
+	writeTestFile(t, certPath, cert.certPEM())
+	writeTestFile(t, keyPath, cert.keyPEM(t))
+	return certPath, keyPath
+}
+
+// serveTestTLS starts a server with the TLS configuration of reloader that
+// responds with the common name of the verified client certificate.
+func serveTestTLS(t *testing.T, reloader *certReloader) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert := clientCertificate(r); cert != nil {
+			io.WriteString(w, cert.Subject.CommonName)
+		}
+	}))
+	server.TLS = reloader.tlsConfig()
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// getTestTLS returns the body of a request to url, made trusting ca and with
+// the client certificate, if set.
+func getTestTLS(url string, ca *testCertificate, clientCert *tls.Certificate) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		// sent even if it isn't signed by one of the CAs of the server
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCert, nil
+		}
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}, Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestClientCertificateModes(t *testing.T) {
+	ca := newTestCA(t, "lncd test CA")
+	untrustedCA := newTestCA(t, "untrusted CA")
+	dir := t.TempDir()
+	certPath, keyPath := writeTestServerCertificate(t, dir, newTestServerCertificate(t, ca))
+	caPath := filepath.Join(dir, "client-ca.pem")
+	writeTestFile(t, caPath, ca.certPEM())
+
+	trusted := newTestClientCertificate(t, "invoice-service", ca).tlsCertificate(t)
+	untrusted := newTestClientCertificate(t, "mallory", untrustedCA).tlsCertificate(t)
+
+	tests := []struct {
+		name   string
+		caPath string
+		mode   string
+		client *tls.Certificate
+		// common name of the client certificate seen by the handler
+		subject string
+		refused bool
+	}{
+		{name: "no client CA", client: &trusted},
+		{name: "required", caPath: caPath, mode: "required", client: &trusted, subject: "invoice-service"},
+		{name: "required without certificate", caPath: caPath, mode: "required", refused: true},
+		{name: "required with an untrusted certificate", caPath: caPath, mode: "required", client: &untrusted, refused: true},
+		{name: "optional", caPath: caPath, mode: "optional", client: &trusted, subject: "invoice-service"},
+		{name: "optional without certificate", caPath: caPath, mode: "optional"},
+		{name: "optional with an untrusted certificate", caPath: caPath, mode: "optional", client: &untrusted, refused: true},
+		{name: "none", caPath: caPath, mode: "none", client: &trusted},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reloader, err := newCertReloader(certPath, keyPath, test.caPath, test.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subject, err := getTestTLS(serveTestTLS(t, reloader), ca, test.client)
+			if test.refused {
+				if err == nil {
+					t.Fatal("expected the handshake to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if subject != test.subject {
+				t.Fatalf("expected client certificate %q, got %q", test.subject, subject)
+			}
+		})
+	}
+}
+
+func TestNewCertReloaderErrors(t *testing.T) {
+	ca := newTestCA(t, "lncd test CA")
+	dir := t.TempDir()
+	certPath, keyPath := writeTestServerCertificate(t, dir, newTestServerCertificate(t, ca))
+	caPath := filepath.Join(dir, "client-ca.pem")
+	writeTestFile(t, caPath, ca.certPEM())
+	emptyCAPath := filepath.Join(dir, "empty-ca.pem")
+	writeTestFile(t, emptyCAPath, []byte("not a certificate"))
+
+	tests := []struct {
+		name     string
+		certPath string
+		caPath   string
+		mode     string
+	}{
+		{"invalid mode", certPath, caPath, "sometimes"},
+		{"missing certificate", filepath.Join(dir, "missing.cert"), "", ""},
+		{"missing client CA", certPath, filepath.Join(dir, "missing.pem"), "required"},
+		{"client CA without certificates", certPath, emptyCAPath, "required"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newCertReloader(test.certPath, keyPath, test.caPath, test.mode); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestCertReloaderPicksUpNewFiles(t *testing.T) {
+	ca := newTestCA(t, "lncd test CA")
+	dir := t.TempDir()
+	certPath, keyPath := writeTestServerCertificate(t, dir, newTestServerCertificate(t, ca))
+	caPath := filepath.Join(dir, "client-ca.pem")
+	writeTestFile(t, caPath, ca.certPEM())
+
+	reloader, err := newCertReloader(certPath, keyPath, caPath, "required")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloader.watch(10 * time.Millisecond)
+	url := serveTestTLS(t, reloader)
+
+	// the server certificate and the client CA are renewed
+	renewedCA := newTestCA(t, "renewed CA")
+	renewed := newTestServerCertificate(t, renewedCA)
+	writeTestServerCertificate(t, dir, renewed)
+	writeTestFile(t, caPath, renewedCA.certPEM())
+	future := time.Now().Add(time.Minute)
+	for _, path := range []string{certPath, keyPath, caPath} {
+		os.Chtimes(path, future, future)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cert, _ := reloader.GetCertificate(nil)
+		if cert.Leaf == nil {
+			cert.Leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if cert.Leaf.Equal(renewed.cert) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client := newTestClientCertificate(t, "invoice-service", renewedCA).tlsCertificate(t)
+	if subject, err := getTestTLS(url, renewedCA, &client); err != nil || subject != "invoice-service" {
+		t.Fatalf("expected the renewed client CA to be used, got %q %v", subject, err)
+	}
+	previous := newTestClientCertificate(t, "invoice-service", ca).tlsCertificate(t)
+	if _, err := getTestTLS(url, renewedCA, &previous); err == nil {
+		t.Fatal("certificate of the replaced client CA accepted")
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = 5 * time.Minute
+)
+
+// Headers of the webhook requests
+const (
+	webhookEventHeader     = "Lncd-Event"
+	webhookTimestampHeader = "Lncd-Timestamp"
+	webhookSignatureHeader = "Lncd-Signature"
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// validateWebhookURL checks that a webhook URL can be used.
+func validateWebhookURL(webhookURL string) error {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &StatusError{Code: http.StatusBadRequest, Message: "invalid webhook URL"}
+	}
+	return nil
+}
+
+// signWebhook returns the hex encoded HMAC-SHA256 of "timestamp.body".
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func postWebhook(webhookURL string, body []byte, secret string, event string) error {
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if event != "" {
+		req.Header.Set(webhookEventHeader, event)
+	}
+	if secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, "sha256="+signWebhook(secret, timestamp, body))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// DeadLetter is a webhook that could not be delivered, appended as a JSON
+// line to LNCD_WEBHOOK_DEAD_LETTER_PATH.
+type DeadLetter struct {
+	Time     time.Time
+	URL      string
+	Event    string `json:",omitempty"`
+	Attempts int
+	Error    string
+	Body     json.RawMessage
+}
+
+var deadLetterMutex sync.Mutex
+
+func writeDeadLetter(letter DeadLetter) {
+	configMutex.RLock()
+	path := LNCD_WEBHOOK_DEAD_LETTER_PATH
+	configMutex.RUnlock()
+	if path == "" {
+		return
+	}
+
+	data, err := json.Marshal(letter)
+	if err != nil {
+		log.Errorf("Unable to encode dead letter: %v", err)
+		return
+	}
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("Unable to write dead letter: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Errorf("Unable to write dead letter: %v", err)
+	}
+}
+
+// sendWebhook POSTs body to webhookURL in the background, retrying with an
+// exponential backoff when the delivery fails. If secret is set, the body
+// is signed. Webhooks that can't be delivered are written to the dead
+// letter log.
+func sendWebhook(webhookURL string, body []byte, secret string, event string) {
+	configMutex.RLock()
+	attempts := LNCD_WEBHOOK_MAX_ATTEMPTS
+	configMutex.RUnlock()
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	go func() {
+		var backoff time.Duration = webhookMinBackoff
+		var err error
+		for attempt := 1; attempt <= attempts; attempt++ {
+			err = postWebhook(webhookURL, body, secret, event)
+			if err == nil {
+				incMetric("webhooks_delivered")
+				return
+			}
+			log.Infof("Webhook delivery to %v failed (attempt %d/%d): %v", webhookURL, attempt, attempts, err)
+			if attempt < attempts {
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > webhookMaxBackoff {
+					backoff = webhookMaxBackoff
+				}
+			}
+		}
+		incMetric("webhooks_failed")
+		log.Errorf("Giving up webhook delivery to %v: %v", webhookURL, err)
+		writeDeadLetter(DeadLetter{
+			Time:     time.Now(),
+			URL:      webhookURL,
+			Event:    event,
+			Attempts: attempts,
+			Error:    err.Error(),
+			Body:     body,
+		})
+	}()
+}
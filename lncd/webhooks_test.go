@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+	time   time.Time
+}
+
+// testWebhookServer records the webhooks it receives and answers them with
+// the status returned by status for the number of the request.
+type testWebhookServer struct {
+	server   *httptest.Server
+	requests []webhookRequest
+	mutex    sync.Mutex
+}
+
+func newTestWebhookServer(t *testing.T, status func(request int) int) *testWebhookServer {
+	webhooks := &testWebhookServer{}
+	webhooks.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		webhooks.mutex.Lock()
+		webhooks.requests = append(webhooks.requests, webhookRequest{r.Header.Clone(), body, time.Now()})
+		var count int = len(webhooks.requests)
+		webhooks.mutex.Unlock()
+		w.WriteHeader(status(count))
+	}))
+	t.Cleanup(webhooks.server.Close)
+	return webhooks
+}
+
+// wait waits until the server received count requests and returns them.
+func (webhooks *testWebhookServer) wait(t *testing.T, count int, timeout time.Duration) []webhookRequest {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		webhooks.mutex.Lock()
+		requests := append([]webhookRequest{}, webhooks.requests...)
+		webhooks.mutex.Unlock()
+		if len(requests) >= count {
+			return requests
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("webhook server didn't receive %d requests", count)
+	return nil
+}
+
+func setTestWebhookConfig(t *testing.T, attempts int, deadLetterPath string) {
+	configMutex.Lock()
+	previousAttempts, previousPath := LNCD_WEBHOOK_MAX_ATTEMPTS, LNCD_WEBHOOK_DEAD_LETTER_PATH
+	LNCD_WEBHOOK_MAX_ATTEMPTS, LNCD_WEBHOOK_DEAD_LETTER_PATH = attempts, deadLetterPath
+	configMutex.Unlock()
+	t.Cleanup(func() {
+		configMutex.Lock()
+		LNCD_WEBHOOK_MAX_ATTEMPTS, LNCD_WEBHOOK_DEAD_LETTER_PATH = previousAttempts, previousPath
+		configMutex.Unlock()
+	})
+}
+
+func TestPostWebhookSignature(t *testing.T) {
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusOK })
+	body := []byte(`{"Event":"invoice.settled"}`)
+
+	if err := postWebhook(webhooks.server.URL, body, "s3cret", eventInvoiceSettled); err != nil {
+		t.Fatal(err)
+	}
+	request := webhooks.wait(t, 1, time.Second)[0]
+	if string(request.body) != string(body) {
+		t.Fatalf("unexpected body %s", request.body)
+	}
+	if request.header.Get(webhookEventHeader) != eventInvoiceSettled {
+		t.Fatalf("unexpected event %q", request.header.Get(webhookEventHeader))
+	}
+
+	timestamp := request.header.Get(webhookTimestampHeader)
+	if sent, err := strconv.ParseInt(timestamp, 10, 64); err != nil || time.Since(time.Unix(sent, 0)) > time.Minute {
+		t.Fatalf("invalid timestamp %q", timestamp)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if signature := request.header.Get(webhookSignatureHeader); !hmac.Equal([]byte(signature), []byte(expected)) {
+		t.Fatalf("signature %q doesn't match %q", signature, expected)
+	}
+}
+
+func TestPostWebhookWithoutSecret(t *testing.T) {
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusNoContent })
+	if err := postWebhook(webhooks.server.URL, []byte(`{}`), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	request := webhooks.wait(t, 1, time.Second)[0]
+	if request.header.Get(webhookSignatureHeader) != "" || request.header.Get(webhookTimestampHeader) != "" {
+		t.Fatal("webhook without secret is signed")
+	}
+}
+
+func TestPostWebhookFailsOnErrorStatus(t *testing.T) {
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusInternalServerError })
+	if err := postWebhook(webhooks.server.URL, []byte(`{}`), "", ""); err == nil {
+		t.Fatal("delivery succeeded with status 500")
+	}
+}
+
+func TestSendWebhookRetriesWithBackoff(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	setTestWebhookConfig(t, 3, deadLetterPath)
+	webhooks := newTestWebhookServer(t, func(request int) int {
+		if request < 3 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+
+	sendWebhook(webhooks.server.URL, []byte(`{"retry":true}`), "s3cret", "job.finished")
+	requests := webhooks.wait(t, 3, 10*time.Second)
+
+	// the backoff starts at webhookMinBackoff and doubles
+	if gap := requests[1].time.Sub(requests[0].time); gap < webhookMinBackoff {
+		t.Fatalf("second attempt after %v", gap)
+	}
+	if gap := requests[2].time.Sub(requests[1].time); gap < 2*webhookMinBackoff {
+		t.Fatalf("third attempt after %v", gap)
+	}
+	for _, request := range requests {
+		if string(request.body) != `{"retry":true}` || request.header.Get(webhookSignatureHeader) == "" {
+			t.Fatal("retries must send the same signed body")
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(deadLetterPath); !os.IsNotExist(err) {
+		t.Fatal("delivered webhook written to the dead letter log")
+	}
+}
+
+// waitDeadLetters waits until the dead letter log is written and returns
+// its entries.
+func waitDeadLetters(t *testing.T, path string) []DeadLetter {
+	t.Helper()
+	var letters []DeadLetter
+	deadline := time.Now().Add(5 * time.Second)
+	for len(letters) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		file, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var letter DeadLetter
+			if err := json.Unmarshal(scanner.Bytes(), &letter); err != nil {
+				t.Fatalf("invalid dead letter %s: %v", scanner.Bytes(), err)
+			}
+			letters = append(letters, letter)
+		}
+		file.Close()
+	}
+	return letters
+}
+
+func TestSendWebhookDeadLetter(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	setTestWebhookConfig(t, 2, deadLetterPath)
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusBadGateway })
+
+	body := []byte(`{"ID":"job"}`)
+	sendWebhook(webhooks.server.URL, body, "", "job.finished")
+	webhooks.wait(t, 2, 10*time.Second)
+
+	letters := waitDeadLetters(t, deadLetterPath)
+	if len(letters) != 1 {
+		t.Fatalf("expected one dead letter, got %d", len(letters))
+	}
+	letter := letters[0]
+	if letter.URL != webhooks.server.URL || letter.Event != "job.finished" || letter.Attempts != 2 {
+		t.Fatalf("unexpected dead letter %+v", letter)
+	}
+	if !strings.Contains(letter.Error, "502") || string(letter.Body) != string(body) {
+		t.Fatalf("unexpected dead letter error %q or body %s", letter.Error, letter.Body)
+	}
+	if len(webhooks.wait(t, 2, time.Second)) != 2 {
+		t.Fatal("webhook retried more than LNCD_WEBHOOK_MAX_ATTEMPTS times")
+	}
+}
+
+func TestJobWebhookHidesConnectionSecrets(t *testing.T) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead-letters.jsonl")
+	setTestWebhookConfig(t, 1, deadLetterPath)
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusBadGateway })
+	info := ConnectionInfo{
+		Mailbox:       "mailbox.example.com:443",
+		PairingPhrase: "job webhook secret phrase",
+		LocalKey:      "6c6f63616c206b6579",
+		RemoteKey:     "02aabbcc",
+	}
+	pool := newTestPool(t, info, map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.GetInfo": func(_ context.Context, _ *grpc.ClientConn, _ string, cb func(string, error)) {
+			cb(`{"alias":"node"}`, nil)
+		},
+	})
+	owner := &Identity{Name: "alice"}
+
+	job, err := startJob(pool, owner, info, "", "lnrpc.Lightning.GetInfo", "{}", false, webhooks.server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := webhooks.wait(t, 1, 5*time.Second)[0]
+	letters := waitDeadLetters(t, deadLetterPath)
+	if len(letters) != 1 {
+		t.Fatalf("expected one dead letter, got %d", len(letters))
+	}
+	for _, body := range [][]byte{request.body, letters[0].Body} {
+		var delivered Job
+		if err := json.Unmarshal(body, &delivered); err != nil {
+			t.Fatal(err)
+		}
+		if delivered.Status != JobSucceeded || delivered.Connection == nil || *delivered.Connection != (ConnectionInfo{Mailbox: info.Mailbox}) {
+			t.Fatalf("unexpected job delivered %s", body)
+		}
+		for _, secret := range []string{info.PairingPhrase, info.LocalKey, info.RemoteKey} {
+			if strings.Contains(string(body), secret) {
+				t.Fatalf("connection secret delivered in %s", body)
+			}
+		}
+	}
+
+	// the owner of the job still gets the negotiated connection
+	stored, err := jobs.get(job.ID, owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Connection == nil || *stored.Connection != info {
+		t.Fatalf("unexpected connection %+v", stored.Connection)
+	}
+}
+
+func TestSubscriptionDeliversEachSettlementOnce(t *testing.T) {
+	setTestWebhookConfig(t, 1, "")
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusOK })
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "subscription test"}
+	deliver := newTestInvoiceStream(t, info)
+
+	path := filepath.Join(t.TempDir(), "subscriptions.json")
+	store, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := store.create(context.Background(), &Identity{Name: "alice"}, webhooks.server.URL, "s3cret", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 3, RHash: []byte{3}})
+	webhooks.wait(t, 1, 5*time.Second)
+	// replayed after a reconnection
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 3, RHash: []byte{3}})
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 4, RHash: []byte{4}})
+	requests := webhooks.wait(t, 2, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	if len(webhooks.wait(t, 2, time.Second)) != 2 {
+		t.Fatal("settlement delivered twice")
+	}
+	for _, request := range requests {
+		if request.header.Get(webhookEventHeader) != eventInvoiceSettled {
+			t.Fatalf("unexpected event %q", request.header.Get(webhookEventHeader))
+		}
+	}
+
+	// the settle index is persisted for the restart
+	reloaded, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := reloaded.subscriptions[subscription.ID].SettleIndex; index != 4 {
+		t.Fatalf("expected settle index 4 to be saved, got %d", index)
+	}
+}
+
+func TestSubscriptionSkipsSettlementsBeforeCreation(t *testing.T) {
+	setTestWebhookConfig(t, 1, "")
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusOK })
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "subscription creation test"}
+	deliver := newTestInvoiceStreamAt(t, info, 7)
+
+	store, err := NewSubscriptionStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := store.create(context.Background(), &Identity{Name: "alice"}, webhooks.server.URL, "s3cret", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subscription.SettleIndex != 7 {
+		t.Fatalf("expected the settle index of the node, got %d", subscription.SettleIndex)
+	}
+
+	// replayed by the shared stream for another subscription
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 6, RHash: []byte{6}})
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 7, RHash: []byte{7}})
+	deliver(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: 8, RHash: []byte{8}})
+	webhooks.wait(t, 1, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	requests := webhooks.wait(t, 1, time.Second)
+	if len(requests) != 1 || !strings.Contains(string(requests[0].body), `"settle_index":"8"`) {
+		t.Fatalf("expected only the settlement after the creation, got %d webhooks", len(requests))
+	}
+}
+
+// testSettlingNode is a node whose SubscribeInvoices stream replays the
+// settlements after the requested settle index and then waits.
+type testSettlingNode struct {
+	settleIndex uint64
+	// settle index requested by each stream
+	resumed chan uint64
+	mutex   sync.Mutex
+}
+
+func (node *testSettlingNode) settle(count int) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.settleIndex += uint64(count)
+}
+
+func (node *testSettlingNode) listInvoices(_ context.Context, _ *grpc.ClientConn, _ string, cb func(string, error)) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	cb(fmt.Sprintf(`{"invoices": [{"settle_index": "%d", "state": "SETTLED"}, {"state": "OPEN"}]}`, node.settleIndex), nil)
+}
+
+func (node *testSettlingNode) subscribeInvoices(_ interface{}, stream grpc.ServerStream) error {
+	frame := &rawFrame{}
+	if err := stream.RecvMsg(frame); err != nil {
+		return err
+	}
+	request := &lnrpc.InvoiceSubscription{}
+	if err := proto.Unmarshal(frame.data, request); err != nil {
+		return err
+	}
+	node.resumed <- request.SettleIndex
+
+	node.mutex.Lock()
+	last := node.settleIndex
+	node.mutex.Unlock()
+	for index := request.SettleIndex + 1; request.SettleIndex > 0 && index <= last; index++ {
+		data, err := proto.Marshal(&lnrpc.Invoice{State: lnrpc.Invoice_SETTLED, SettleIndex: index, RHash: []byte{byte(index)}})
+		if err != nil {
+			return err
+		}
+		if err := stream.SendMsg(&rawFrame{data}); err != nil {
+			return err
+		}
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func TestSubscriptionsResumeAfterRestart(t *testing.T) {
+	setTestWebhookConfig(t, 1, "")
+	webhooks := newTestWebhookServer(t, func(int) int { return http.StatusOK })
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "subscription restart test"}
+	node := &testSettlingNode{settleIndex: 7, resumed: make(chan uint64, 2)}
+
+	pool := newTestPool(t, info, map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.ListInvoices": node.listInvoices,
+	})
+	pool.connections[ConnectionKey{info.Mailbox, info.PairingPhrase}].grpcClient = serveTestGRPC(t, node.subscribeInvoices)
+	previous := invoiceStreams
+	t.Cleanup(func() { invoiceStreams = previous })
+	closeStreams := func(store *SubscriptionStore) {
+		store.mutex.Lock()
+		defer store.mutex.Unlock()
+		for _, unsubscribe := range store.unsubscribe {
+			unsubscribe()
+		}
+	}
+
+	// neither subscription gets a settlement before the restart
+	invoiceStreams = NewInvoiceStreams(pool)
+	path := filepath.Join(t.TempDir(), "subscriptions.json")
+	store, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := store.create(context.Background(), &Identity{Name: "alice"}, webhooks.server.URL, "s3cret", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index := <-node.resumed; index != 7 {
+		t.Fatalf("expected the stream to start from settle index 7, got %d", index)
+	}
+	closeStreams(store)
+	node.settle(2)
+	invoiceStreams = NewInvoiceStreams(pool)
+	if store, err = NewSubscriptionStore(path); err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.create(context.Background(), &Identity{Name: "alice"}, webhooks.server.URL, "s3cret", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-node.resumed
+	closeStreams(store)
+
+	// settled while the daemon is down
+	node.settle(1)
+	invoiceStreams = NewInvoiceStreams(pool)
+	restarted, err := NewSubscriptionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.start()
+	t.Cleanup(func() { closeStreams(restarted) })
+	if index := <-node.resumed; index != 7 {
+		t.Fatalf("expected the stream to resume from the oldest subscription, got %d", index)
+	}
+
+	// the first subscription gets settlements 8, 9 and 10, the second one
+	// only 10
+	webhooks.wait(t, 4, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	var delivered map[string][]string = make(map[string][]string)
+	for _, request := range webhooks.wait(t, 4, time.Second) {
+		var webhook struct {
+			Subscription string
+			Invoice      struct {
+				SettleIndex string `json:"settle_index"`
+			}
+		}
+		if err := json.Unmarshal(request.body, &webhook); err != nil {
+			t.Fatal(err)
+		}
+		delivered[webhook.Subscription] = append(delivered[webhook.Subscription], webhook.Invoice.SettleIndex)
+	}
+	// the webhooks are sent concurrently
+	sort.Strings(delivered[first.ID])
+	if !reflect.DeepEqual(delivered[first.ID], []string{"10", "8", "9"}) || !reflect.DeepEqual(delivered[second.ID], []string{"10"}) {
+		t.Fatalf("unexpected settlements delivered %v", delivered)
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/gorilla/websocket"
+	"github.com/lightningnetwork/lnd/lnrpc"
+)
+
+// Event kinds of NIP-57
+const (
+	zapRequestKind = 9734
+	zapReceiptKind = 9735
+)
+
+const (
+	maxZapRelays = 10
+	// Expiry of the invoices of zaps, they are watched until then
+	zapInvoiceExpiry = time.Hour
+	// Zaps waiting for the settlement of their invoice, over all the nodes
+	maxZapWatches = 1000
+)
+
+var (
+	errZapPending   = errors.New("zap request is already pending")
+	errTooManyZaps  = errors.New("too many pending zaps, retry later")
+	zapWatchesMutex sync.Mutex
+	// Pending zaps by the description hash of their invoice
+	zapWatches = map[string]struct{}{}
+)
+
+// Key that signs the zap receipts, zaps are disabled when it is not set
+var zapKey *btcec.PrivateKey
+
+// zapRelayDialer only connects to public addresses: the relays of a zap
+// request are chosen by its sender, that could otherwise make the daemon
+// connect to the services of its network. The address is checked once the
+// host is resolved, when connecting, and there is no proxy, that would
+// resolve the host itself.
+var zapRelayDialer = &websocket.Dialer{
+	NetDialContext:   (&net.Dialer{Timeout: nostrRelayTimeout, Control: refusePrivateAddress}).DialContext,
+	HandshakeTimeout: nostrRelayTimeout,
+}
+
+// sharedAddressSpace is the range of carrier-grade NAT (RFC 6598), not
+// covered by net.IP.IsPrivate.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicAddress returns false for loopback, private, link-local and other
+// addresses that are not reachable on the internet.
+func isPublicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip))
+}
+
+// refusePrivateAddress is the net.Dialer Control function of
+// zapRelayDialer.
+func refusePrivateAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+		return fmt.Errorf("refusing to connect to the non public address %v", host)
+	}
+	return nil
+}
+
+// isAllowedZapRelay returns true if the host of the relay is in
+// LNCD_ZAP_ALLOWED_RELAYS, so it can be on a private address.
+func isAllowedZapRelay(relayURL string) bool {
+	parsed, err := url.Parse(relayURL)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range strings.Split(LNCD_ZAP_ALLOWED_RELAYS, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed != "" && (allowed == strings.ToLower(parsed.Host) || allowed == strings.ToLower(parsed.Hostname())) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateZapRelayURL checks that a relay of a zap request can be used:
+// besides the checks of validateRelayURL, it must not be a non public
+// address or localhost, unless it is allowed with LNCD_ZAP_ALLOWED_RELAYS.
+// Hosts resolving to non public addresses are refused by zapRelayDialer.
+func validateZapRelayURL(relayURL string) error {
+	if err := validateRelayURL(relayURL); err != nil {
+		return err
+	}
+	if isAllowedZapRelay(relayURL) {
+		return nil
+	}
+	parsed, _ := url.Parse(relayURL)
+	host := strings.ToLower(strings.TrimSuffix(parsed.Hostname(), "."))
+	if ip := net.ParseIP(host); (ip != nil && !isPublicAddress(ip)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("relay URL %q is not public", relayURL)
+	}
+	return nil
+}
+
+// parseZapRequest validates a zap request (NIP-57 appendix D) sent to the
+// LNURL callback and returns it with the relays where the receipt must be
+// published.
+func parseZapRequest(zapRequest string, amount int64) (*NostrEvent, []string, error) {
+	var event NostrEvent
+	if err := json.Unmarshal([]byte(zapRequest), &event); err != nil {
+		return nil, nil, errors.New("invalid zap request")
+	}
+	if event.Kind != zapRequestKind {
+		return nil, nil, errors.New("invalid zap request kind")
+	}
+	if err := event.verify(); err != nil {
+		return nil, nil, err
+	}
+
+	var recipients, events int
+	var relays []string
+	for _, tag := range event.Tags {
+		if len(tag) < 2 {
+			continue
+		}
+		switch tag[0] {
+		case "p":
+			recipients++
+		case "e":
+			events++
+		case "relays":
+			relays = append(relays, tag[1:]...)
+		case "amount":
+			if requested, err := strconv.ParseInt(tag[1], 10, 64); err != nil || requested != amount {
+				return nil, nil, errors.New("zap request amount does not match")
+			}
+		}
+	}
+	if recipients != 1 {
+		return nil, nil, errors.New("zap request must have one p tag")
+	}
+	if events > 1 {
+		return nil, nil, errors.New("zap request must have at most one e tag")
+	}
+
+	var valid []string
+	for _, relay := range relays {
+		if validateZapRelayURL(relay) == nil && len(valid) < maxZapRelays {
+			valid = append(valid, relay)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, nil, errors.New("zap request has no relays")
+	}
+	return &event, valid, nil
+}
+
+// watchZap waits for the settlement of the invoice committing to
+// descriptionHash on the invoice stream of the node, and publishes its
+// receipt. It must be called before the invoice is created, so that the
+// settlement can't be missed, and the invoice must expire within
+// zapInvoiceExpiry. The returned function stops watching.
+// A zap request is only watched once, and at most maxZapWatches zaps are
+// watched at the same time.
+func watchZap(info ConnectionInfo, descriptionHash []byte, zapRequest string, request *NostrEvent, relays []string) (func(), error) {
+	var key string = hex.EncodeToString(descriptionHash)
+	zapWatchesMutex.Lock()
+	if _, ok := zapWatches[key]; ok {
+		zapWatchesMutex.Unlock()
+		return nil, errZapPending
+	}
+	if len(zapWatches) >= maxZapWatches {
+		zapWatchesMutex.Unlock()
+		incMetric("zaps_rejected")
+		return nil, errTooManyZaps
+	}
+	zapWatches[key] = struct{}{}
+	zapWatchesMutex.Unlock()
+
+	var once sync.Once
+	var done chan struct{} = make(chan struct{})
+	unsubscribe := invoiceStreams.subscribe(info, func(_ ConnectionInfo, invoice *lnrpc.Invoice) {
+		if !bytes.Equal(invoice.DescriptionHash, descriptionHash) {
+			return
+		}
+		switch invoice.State {
+		case lnrpc.Invoice_SETTLED:
+			once.Do(func() {
+				close(done)
+				go publishZapReceipt(invoice, zapRequest, request, relays)
+			})
+		case lnrpc.Invoice_CANCELED:
+			once.Do(func() { close(done) })
+		}
+	})
+
+	go func() {
+		timer := time.NewTimer(zapInvoiceExpiry)
+		defer timer.Stop()
+		select {
+		case <-done:
+		case <-timer.C:
+		}
+		unsubscribe()
+		zapWatchesMutex.Lock()
+		delete(zapWatches, key)
+		zapWatchesMutex.Unlock()
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}, nil
+}
+
+// publishZapReceipt publishes the zap receipt of a settled invoice to the
+// relays of the zap request.
+func publishZapReceipt(invoice *lnrpc.Invoice, zapRequest string, request *NostrEvent, relays []string) {
+	tags := [][]string{}
+	for _, name := range []string{"p", "e", "a"} {
+		if value := request.tag(name); value != "" {
+			tags = append(tags, []string{name, value})
+		}
+	}
+	tags = append(tags,
+		[]string{"P", request.PubKey},
+		[]string{"bolt11", invoice.PaymentRequest},
+		[]string{"description", zapRequest},
+		[]string{"preimage", hex.EncodeToString(invoice.RPreimage)},
+	)
+
+	receipt := &NostrEvent{
+		CreatedAt: invoice.SettleDate,
+		Kind:      zapReceiptKind,
+		Tags:      tags,
+	}
+	if err := receipt.sign(zapKey); err != nil {
+		log.Errorf("Unable to sign zap receipt: %v", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, relay := range relays {
+		wg.Add(1)
+		go func(relay string) {
+			defer wg.Done()
+			var dialer *websocket.Dialer = zapRelayDialer
+			if isAllowedZapRelay(relay) {
+				dialer = websocket.DefaultDialer
+			}
+			if err := publishNostrEvent(context.Background(), dialer, relay, receipt); err != nil {
+				log.Infof("Unable to publish zap receipt to %v: %v", relay, err)
+				return
+			}
+			incMetric("zap_receipts_published")
+		}(relay)
+	}
+	wg.Wait()
+	log.Infof("Zap receipt %v published for invoice %x", receipt.ID, invoice.RHash)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/lightningnetwork/lnd/lnrpc"
+	"google.golang.org/grpc"
+)
+
+// newTestZapRequest returns a signed zap request with the given tags.
+func newTestZapRequest(t *testing.T, key *btcec.PrivateKey, tags [][]string) string {
+	t.Helper()
+	event := &NostrEvent{CreatedAt: time.Now().Unix(), Kind: zapRequestKind, Tags: tags}
+	if err := event.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// newTestInvoiceStream replaces the invoice streams with one for info that
+// is not connected to a node. The returned function delivers an invoice
+// update to its listeners.
+func newTestInvoiceStream(t *testing.T, info ConnectionInfo) func(*lnrpc.Invoice) {
+	return newTestInvoiceStreamAt(t, info, 0)
+}
+
+// newTestInvoiceStreamAt is newTestInvoiceStream for a node whose last
+// settle index is settleIndex.
+func newTestInvoiceStreamAt(t *testing.T, info ConnectionInfo, settleIndex uint64) func(*lnrpc.Invoice) {
+	previous := invoiceStreams
+	invoiceStreams = NewInvoiceStreams(newTestPool(t, info, map[string]func(context.Context, *grpc.ClientConn, string, func(string, error)){
+		"lnrpc.Lightning.ListInvoices": func(_ context.Context, _ *grpc.ClientConn, _ string, cb func(string, error)) {
+			cb(fmt.Sprintf(`{"invoices": [{"settle_index": "%d"}]}`, settleIndex), nil)
+		},
+	}))
+	t.Cleanup(func() { invoiceStreams = previous })
+
+	// the listener keeps the stream open when the others unsubscribe
+	stream := &invoiceStream{
+		info:      info,
+		listeners: map[uint64]invoiceListener{0: func(ConnectionInfo, *lnrpc.Invoice) {}},
+		cancel:    func() {},
+	}
+	invoiceStreams.streams[ConnectionKey{info.Mailbox, info.PairingPhrase}] = stream
+	return func(invoice *lnrpc.Invoice) {
+		invoiceStreams.mutex.Lock()
+		var listeners []invoiceListener
+		for _, listener := range stream.listeners {
+			listeners = append(listeners, listener)
+		}
+		invoiceStreams.mutex.Unlock()
+		for _, listener := range listeners {
+			listener(info, invoice)
+		}
+	}
+}
+
+func setTestZapKey(t *testing.T) *btcec.PrivateKey {
+	previous := zapKey
+	zapKey = newTestNostrKey(t)
+	t.Cleanup(func() { zapKey = previous })
+	return zapKey
+}
+
+// waitZapReleased waits until the zap with the description hash is no
+// longer watched.
+func waitZapReleased(t *testing.T, descriptionHash []byte) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		zapWatchesMutex.Lock()
+		_, ok := zapWatches[hex.EncodeToString(descriptionHash)]
+		zapWatchesMutex.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("zap is still watched")
+}
+
+func TestParseZapRequest(t *testing.T) {
+	sender := newTestNostrKey(t)
+	recipient := nostrPublicKey(newTestNostrKey(t))
+	relays := []string{"relays", "wss://relay.example.com", "https://not-a-relay.example.com"}
+
+	tests := []struct {
+		name   string
+		tags   [][]string
+		amount int64
+		err    string
+	}{
+		{"valid", [][]string{{"p", recipient}, {"amount", "21000"}, relays}, 21000, ""},
+		{"without amount", [][]string{{"p", recipient}, relays}, 21000, ""},
+		{"wrong amount", [][]string{{"p", recipient}, {"amount", "1000"}, relays}, 21000, "zap request amount does not match"},
+		{"no recipient", [][]string{relays}, 21000, "zap request must have one p tag"},
+		{"two recipients", [][]string{{"p", recipient}, {"p", recipient}, relays}, 21000, "zap request must have one p tag"},
+		{"two events", [][]string{{"p", recipient}, {"e", "aa"}, {"e", "bb"}, relays}, 21000, "zap request must have at most one e tag"},
+		{"no relays", [][]string{{"p", recipient}}, 21000, "zap request has no relays"},
+		{"invalid relays", [][]string{{"p", recipient}, {"relays", "https://relay.example.com"}}, 21000, "zap request has no relays"},
+		{"private relays ignored", [][]string{{"p", recipient}, {"relays", "ws://192.168.1.10:7000", "wss://relay.example.com"}}, 21000, ""},
+		{"loopback relay", [][]string{{"p", recipient}, {"relays", "ws://127.0.0.1:8080"}}, 21000, "zap request has no relays"},
+		{"localhost relay", [][]string{{"p", recipient}, {"relays", "ws://localhost:8080", "ws://relay.localhost"}}, 21000, "zap request has no relays"},
+		{"private relay", [][]string{{"p", recipient}, {"relays", "wss://10.0.0.1", "wss://172.16.0.1", "wss://100.64.0.1"}}, 21000, "zap request has no relays"},
+		{"link-local relay", [][]string{{"p", recipient}, {"relays", "ws://169.254.169.254", "ws://[fe80::1]:80"}}, 21000, "zap request has no relays"},
+		{"unspecified relay", [][]string{{"p", recipient}, {"relays", "ws://0.0.0.0", "ws://[::]"}}, 21000, "zap request has no relays"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request, validRelays, err := parseZapRequest(newTestZapRequest(t, sender, test.tags), test.amount)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if request.PubKey != nostrPublicKey(sender) {
+				t.Fatalf("unexpected sender %v", request.PubKey)
+			}
+			if !reflect.DeepEqual(validRelays, []string{"wss://relay.example.com"}) {
+				t.Fatalf("unexpected relays %v", validRelays)
+			}
+		})
+	}
+}
+
+func TestParseZapRequestRejectsInvalidEvents(t *testing.T) {
+	sender := newTestNostrKey(t)
+	tags := [][]string{{"p", nostrPublicKey(sender)}, {"relays", "wss://relay.example.com"}}
+
+	note := &NostrEvent{CreatedAt: time.Now().Unix(), Kind: 1, Tags: tags}
+	if err := note.sign(sender); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(note)
+	if _, _, err := parseZapRequest(string(data), 1000); err == nil || err.Error() != "invalid zap request kind" {
+		t.Fatalf("accepted an event of kind 1: %v", err)
+	}
+
+	var forged NostrEvent
+	json.Unmarshal([]byte(newTestZapRequest(t, sender, tags)), &forged)
+	forged.Tags = append(forged.Tags, []string{"amount", "1000"})
+	data, _ = json.Marshal(forged)
+	if _, _, err := parseZapRequest(string(data), 1000); err == nil {
+		t.Fatal("accepted a zap request with an invalid id")
+	}
+
+	if _, _, err := parseZapRequest("not json", 1000); err == nil {
+		t.Fatal("accepted an invalid zap request")
+	}
+}
+
+func TestParseZapRequestLimitsRelays(t *testing.T) {
+	sender := newTestNostrKey(t)
+	var relays []string = []string{"relays"}
+	for i := 0; i < maxZapRelays+5; i++ {
+		relays = append(relays, fmt.Sprintf("wss://relay%d.example.com", i))
+	}
+	_, valid, err := parseZapRequest(newTestZapRequest(t, sender, [][]string{{"p", nostrPublicKey(sender)}, relays}), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(valid) != maxZapRelays {
+		t.Fatalf("expected %d relays, got %d", maxZapRelays, len(valid))
+	}
+}
+
+// setTestZapAllowedRelays allows the zap requests to use the relay.
+func setTestZapAllowedRelays(t *testing.T, relay *testRelay) {
+	previous := LNCD_ZAP_ALLOWED_RELAYS
+	LNCD_ZAP_ALLOWED_RELAYS = strings.TrimPrefix(relay.url, "ws://")
+	t.Cleanup(func() { LNCD_ZAP_ALLOWED_RELAYS = previous })
+}
+
+func TestIsPublicAddress(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.31.0.1", false},
+		{"192.168.0.1", false},
+		{"100.100.0.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+	}
+	for _, test := range tests {
+		if public := isPublicAddress(net.ParseIP(test.ip)); public != test.public {
+			t.Errorf("expected %v to be public: %v, got %v", test.ip, test.public, public)
+		}
+	}
+}
+
+func TestZapRelayDialerRefusesPrivateAddresses(t *testing.T) {
+	relay := newTestRelay(t)
+	event := &NostrEvent{CreatedAt: time.Now().Unix(), Kind: zapReceiptKind}
+	if err := event.sign(newTestNostrKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(strings.TrimPrefix(relay.url, "ws://"))
+	// the host resolves to a loopback address
+	for _, relayURL := range []string{relay.url, "ws://localhost:" + port} {
+		err := publishNostrEvent(context.Background(), zapRelayDialer, relayURL, event)
+		if err == nil || !strings.Contains(err.Error(), "non public address") {
+			t.Fatalf("expected %v to be refused, got %v", relayURL, err)
+		}
+	}
+	relay.mutex.Lock()
+	defer relay.mutex.Unlock()
+	if len(relay.events) != 0 {
+		t.Fatal("event published to a private relay")
+	}
+}
+
+func TestZapAllowedRelays(t *testing.T) {
+	relay := newTestRelay(t)
+	if err := validateZapRelayURL(relay.url); err == nil {
+		t.Fatal("local relay accepted")
+	}
+	setTestZapAllowedRelays(t, relay)
+	if err := validateZapRelayURL(relay.url); err != nil {
+		t.Fatalf("allowed relay refused: %v", err)
+	}
+	// the port must match when it is set
+	if err := validateZapRelayURL("ws://127.0.0.1:1"); err == nil {
+		t.Fatal("relay on another port accepted")
+	}
+}
+
+func TestWatchZapPublishesReceipt(t *testing.T) {
+	key := setTestZapKey(t)
+	relay := newTestRelay(t)
+	setTestZapAllowedRelays(t, relay)
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "zap test"}
+	deliver := newTestInvoiceStream(t, info)
+
+	sender := newTestNostrKey(t)
+	recipient := nostrPublicKey(newTestNostrKey(t))
+	zapRequest := newTestZapRequest(t, sender, [][]string{
+		{"p", recipient},
+		{"e", "e0e0"},
+		{"a", "30023:" + recipient + ":post"},
+		{"amount", "21000"},
+		{"relays", relay.url},
+	})
+	request, relays, err := parseZapRequest(zapRequest, 21000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptionHash := sha256.Sum256([]byte(zapRequest))
+
+	stop, err := watchZap(info, descriptionHash[:], zapRequest, request, relays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if _, err := watchZap(info, descriptionHash[:], zapRequest, request, relays); !errors.Is(err, errZapPending) {
+		t.Fatalf("expected the replayed zap request to be refused, got %v", err)
+	}
+
+	// updates of other invoices are ignored
+	deliver(&lnrpc.Invoice{DescriptionHash: []byte("other"), State: lnrpc.Invoice_SETTLED})
+	deliver(&lnrpc.Invoice{DescriptionHash: descriptionHash[:], State: lnrpc.Invoice_OPEN})
+
+	preimage := []byte{1, 2, 3, 4}
+	deliver(&lnrpc.Invoice{
+		DescriptionHash: descriptionHash[:],
+		State:           lnrpc.Invoice_SETTLED,
+		PaymentRequest:  "lnbc210n1zap",
+		RPreimage:       preimage,
+		SettleDate:      1700000100,
+	})
+
+	receipt := relay.waitEvents(t, 1)[0]
+	if err := receipt.verify(); err != nil {
+		t.Fatalf("invalid receipt: %v", err)
+	}
+	if receipt.Kind != zapReceiptKind || receipt.PubKey != nostrPublicKey(key) {
+		t.Fatalf("unexpected receipt kind %v from %v", receipt.Kind, receipt.PubKey)
+	}
+	if receipt.CreatedAt != 1700000100 || receipt.Content != "" {
+		t.Fatalf("unexpected receipt created_at %v and content %q", receipt.CreatedAt, receipt.Content)
+	}
+	expected := [][]string{
+		{"p", recipient},
+		{"e", "e0e0"},
+		{"a", "30023:" + recipient + ":post"},
+		{"P", nostrPublicKey(sender)},
+		{"bolt11", "lnbc210n1zap"},
+		{"description", zapRequest},
+		{"preimage", hex.EncodeToString(preimage)},
+	}
+	if !reflect.DeepEqual(receipt.Tags, expected) {
+		t.Fatalf("unexpected receipt tags\n%v\nexpected\n%v", receipt.Tags, expected)
+	}
+
+	waitZapReleased(t, descriptionHash[:])
+	if len(relay.waitEvents(t, 1)) != 1 {
+		t.Fatal("more than one receipt published")
+	}
+}
+
+func TestWatchZapReleasedOnCancel(t *testing.T) {
+	setTestZapKey(t)
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "zap cancel test"}
+	deliver := newTestInvoiceStream(t, info)
+	descriptionHash := sha256.Sum256([]byte("canceled zap"))
+
+	if _, err := watchZap(info, descriptionHash[:], "{}", &NostrEvent{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	deliver(&lnrpc.Invoice{DescriptionHash: descriptionHash[:], State: lnrpc.Invoice_CANCELED})
+	waitZapReleased(t, descriptionHash[:])
+
+	stop, err := watchZap(info, descriptionHash[:], "{}", &NostrEvent{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	waitZapReleased(t, descriptionHash[:])
+}
+
+func TestWatchZapLimit(t *testing.T) {
+	info := ConnectionInfo{Mailbox: "mailbox.example.com:443", PairingPhrase: "zap limit test"}
+	newTestInvoiceStream(t, info)
+
+	zapWatchesMutex.Lock()
+	for i := 0; i < maxZapWatches; i++ {
+		zapWatches[fmt.Sprintf("pending-%d", i)] = struct{}{}
+	}
+	zapWatchesMutex.Unlock()
+	defer func() {
+		zapWatchesMutex.Lock()
+		for i := 0; i < maxZapWatches; i++ {
+			delete(zapWatches, fmt.Sprintf("pending-%d", i))
+		}
+		zapWatchesMutex.Unlock()
+	}()
+
+	descriptionHash := sha256.Sum256([]byte("one too many"))
+	if _, err := watchZap(info, descriptionHash[:], "{}", &NostrEvent{}, nil); !errors.Is(err, errTooManyZaps) {
+		t.Fatalf("expected the zap to be refused, got %v", err)
+	}
+}